@@ -0,0 +1,71 @@
+package luks
+
+import (
+	"fmt"
+	"io"
+)
+
+// maximum physical block size accepted by WithPhysicalBlockSize
+const maxPhysicalBlockSize = 64 * 1024
+
+func checkPhysicalBlockSize(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if n < storageSectorSize || n > maxPhysicalBlockSize || !isPowerOfTwo(uint(n)) {
+		return fmt.Errorf("invalid physical block size %v", n)
+	}
+	return nil
+}
+
+func (d *Device) setPhysicalBlockSize(n int) error {
+	if err := checkPhysicalBlockSize(n); err != nil {
+		return err
+	}
+	d.physicalBlockSize = n
+	return nil
+}
+
+// alignedReaderAt extends reads to whole physical blocks of the underlying device
+type alignedReaderAt struct {
+	r         io.ReaderAt
+	blockSize int64
+}
+
+// newAlignedReaderAt returns `r` itself if no alignment is needed
+func newAlignedReaderAt(r io.ReaderAt, blockSize int) io.ReaderAt {
+	if blockSize <= storageSectorSize {
+		return r
+	}
+	return &alignedReaderAt{r: r, blockSize: int64(blockSize)}
+}
+
+func (a *alignedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid read offset %v", off)
+	}
+	start := off - off%a.blockSize
+	end := off + int64(len(p))
+	if rem := end % a.blockSize; rem != 0 {
+		end += a.blockSize - rem
+	}
+	if start == off && end == off+int64(len(p)) {
+		return a.r.ReadAt(p, off)
+	}
+
+	buff := make([]byte, end-start)
+	defer clearSlice(buff)
+	n, err := a.r.ReadAt(buff, start)
+
+	read := 0
+	if skip := off - start; int64(n) > skip {
+		read = copy(p, buff[skip:n])
+	}
+	if read == len(p) {
+		return read, nil // the error relates to the padding past the requested range
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return read, err
+}
@@ -0,0 +1,107 @@
+package luks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// blockDeviceReaderAt simulates a 4K-native device that rejects reads not aligned to its physical block size
+type blockDeviceReaderAt struct {
+	r         io.ReaderAt
+	blockSize int64
+}
+
+func (b *blockDeviceReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off%b.blockSize != 0 || int64(len(p))%b.blockSize != 0 {
+		return 0, fmt.Errorf("misaligned read of %v bytes at %v", len(p), off)
+	}
+	return b.r.ReadAt(p, off)
+}
+
+func TestReaderAtPhysicalBlockSize(t *testing.T) {
+	const dataOffset = 1024 * 1024
+
+	disk, err := ioutil.TempFile("", "luks.go.reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+	if err := disk.Truncate(dataOffset + 64*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	volume := &VolumeInfo{
+		key:               randomBytes(t, 64),
+		storageEncryption: "aes-xts-plain64",
+		storageSectorSize: 512,
+		storageOffset:     dataOffset / 512,
+	}
+	plaintext := randomBytes(t, 16*1024)
+	writeEncryptedSectors(t, disk, volume, 0, plaintext)
+	dev := &blockDeviceReaderAt{r: disk, blockSize: 4096}
+
+	r, err := NewReaderAt(dev, volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	window := make([]byte, 100)
+	if _, err := r.ReadAt(window, 4096+1000); err == nil {
+		t.Fatal("reading 512-byte sectors is expected to fail at the 4K-native device")
+	}
+
+	r, err = NewReaderAt(dev, volume, WithPhysicalBlockSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(window, 4096+1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(window, plaintext[4096+1000:4096+1100]) {
+		t.Fatal("decrypted window does not match")
+	}
+
+	// a window that crosses physical blocks
+	window = make([]byte, 5000)
+	if _, err := r.ReadAt(window, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(window, plaintext[3000:8000]) {
+		t.Fatal("decrypted window does not match")
+	}
+
+	if _, err := NewReaderAt(dev, volume, WithPhysicalBlockSize(1000)); err == nil {
+		t.Fatal("invalid physical block size is expected to fail")
+	}
+}
+
+func TestKeyslotAreaReadPhysicalBlockSize(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.nextAreaOff += storageSectorSize // the area is aligned to the LUKS sector but not to the physical block
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	expected, err := d.KeyslotAreaRead(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := &blockDeviceReaderAt{r: disk, blockSize: 4096}
+	if _, err := d.KeyslotAreaRead(dev, 0); err == nil {
+		t.Fatal("misaligned keyslot area read is expected to fail at the 4K-native device")
+	}
+	if err := d.setPhysicalBlockSize(4096); err != nil {
+		t.Fatal(err)
+	}
+	data, err := d.KeyslotAreaRead(dev, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatal("keyslot area content does not match")
+	}
+}
@@ -5,8 +5,24 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash"
+	"io"
 )
 
+// ErrUnsupportedAfType indicates a keyslot with anti-forensic splitter other than 'luks1', the only type defined
+// by the LUKS2 specification
+var ErrUnsupportedAfType = fmt.Errorf("%w: unsupported anti-forensic type", ErrKeyslotUnsupported)
+
+// validate checks the keyslot 'af' object before its parameters are used to split or merge the volume key
+func (af *antiForensic) validate() error {
+	if af.Type != "luks1" {
+		return fmt.Errorf("%w: %q", ErrUnsupportedAfType, af.Type)
+	}
+	if af.Stripes != stripesNum {
+		return fmt.Errorf("%w: LUKS currently supports only af with 4000 stripes", ErrKeyslotUnsupported)
+	}
+	return nil
+}
+
 func xorSlices(src1, src2 []byte, dest []byte) {
 	// src1, src2, dest are all the same size
 	for i := range dest {
@@ -16,32 +32,69 @@ func xorSlices(src1, src2 []byte, dest []byte) {
 
 func diffuse(src []byte, h hash.Hash) []byte {
 	// src and dest are of the same size
-	sliceSize := len(src)
-	result := make([]byte, 0, sliceSize)
-	digestSize := h.Size()
-
-	for i := 0; i < sliceSize/digestSize; i++ {
-		ivSlice := make([]byte, 4)
-		binary.BigEndian.PutUint32(ivSlice, uint32(i))
-
-		h.Reset()
-		h.Write(ivSlice)
-		h.Write(src[i*digestSize : (i+1)*digestSize])
-		result = h.Sum(result)
+	dest := append([]byte(nil), src...)
+	newDiffuser(h).diffuse(dest)
+	return dest
+}
+
+// diffuser applies the diffusion function in place. It keeps the block index and digest buffers between calls
+// so diffusing 4000 stripes does not allocate.
+type diffuser struct {
+	h   hash.Hash
+	iv  []byte
+	sum []byte
+}
+
+func newDiffuser(h hash.Hash) *diffuser {
+	return &diffuser{h: h, iv: make([]byte, 4), sum: make([]byte, 0, h.Size())}
+}
+
+func (d *diffuser) diffuse(data []byte) {
+	digestSize := d.h.Size()
+
+	for i := 0; i*digestSize < len(data); i++ {
+		binary.BigEndian.PutUint32(d.iv, uint32(i))
+
+		end := (i + 1) * digestSize
+		if end > len(data) {
+			end = len(data) // the last block is shorter than the digest if the size is not a multiple of it
+		}
+		block := data[i*digestSize : end]
+		d.h.Reset()
+		d.h.Write(d.iv)
+		d.h.Write(block)
+		d.sum = d.h.Sum(d.sum[:0])
+		copy(block, d.sum)
 	}
+}
 
-	return result
+// AfDiffuse applies the LUKS anti-forensic diffusion function to data. Every digest-sized block `i` of data
+// is replaced with H(i || block) where `i` is a 32-bit big-endian block index, see section 2.4 of the LUKS1
+// on-disk format specification. If the data size is not a multiple of the digest size, the last shorter block is
+// replaced with a prefix of its digest the same way cryptsetup does. The function is hash based and thus is not
+// invertible: AF merge applies it in the same direction as AF split, so there is no "undiffuse" counterpart.
+func AfDiffuse(data []byte, h hash.Hash) []byte {
+	return diffuse(data, h)
 }
 
-func afSplit(src []byte, blockNum int, h hash.Hash) ([]byte, error) {
+// afSplit splits src into blockNum stripes. Random data for the stripes is read from rnd,
+// crypto/rand is used if rnd is nil.
+func afSplit(src []byte, blockNum int, h hash.Hash, rnd io.Reader) ([]byte, error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+
 	blockSize := len(src)
+	if blockSize == 0 || blockNum <= 0 {
+		return nil, fmt.Errorf("invalid af split parameters: block size %v, number of blocks %v", blockSize, blockNum)
+	}
 	buffer := make([]byte, blockSize)
 	dest := make([]byte, blockSize*blockNum)
 
 	// first blockNum-1 are random data
 	// the very last block value depends on input src data
 	randomDataSize := (blockNum - 1) * blockSize
-	n, err := rand.Read(dest[:randomDataSize])
+	n, err := io.ReadFull(rnd, dest[:randomDataSize])
 	if err != nil {
 		return nil, err
 	}
@@ -49,11 +102,12 @@ func afSplit(src []byte, blockNum int, h hash.Hash) ([]byte, error) {
 		return nil, fmt.Errorf("Expected to generate %v bytes of random data, got %v", randomDataSize, n)
 	}
 
+	diff := newDiffuser(h)
 	for i := 0; i < blockNum-1; i++ {
 		b := dest[blockSize*i : blockSize*(i+1)]
 
 		xorSlices(b, buffer, buffer)
-		buffer = diffuse(buffer, h)
+		diff.diffuse(buffer)
 	}
 
 	xorSlices(src, buffer, dest[randomDataSize:randomDataSize+blockSize])
@@ -62,21 +116,20 @@ func afSplit(src []byte, blockNum int, h hash.Hash) ([]byte, error) {
 }
 
 func afMerge(src []byte, blockSize, blockNum int, h hash.Hash) ([]byte, error) {
-	buffer := make([]byte, blockSize)
-
+	if blockSize <= 0 || blockNum <= 0 {
+		return nil, fmt.Errorf("invalid af merge parameters: block size %v, number of blocks %v", blockSize, blockNum)
+	}
 	if blockSize*blockNum > len(src) {
 		return nil, fmt.Errorf("af merge input buffer size mismatch %v * %v != %v", blockSize, blockNum, len(src))
 	}
-	digestSize := h.Size()
-	if blockSize%digestSize != 0 {
-		return nil, fmt.Errorf("af merge block size mismatch: input buffer size %v, hash size is %v", blockSize, digestSize)
-	}
+	buffer := make([]byte, blockSize)
 
+	diff := newDiffuser(h)
 	for i := 0; i < blockNum-1; i++ {
 		b := src[blockSize*i : blockSize*(i+1)]
 
 		xorSlices(b, buffer, buffer)
-		buffer = diffuse(buffer, h)
+		diff.diffuse(buffer)
 	}
 
 	xorSlices(src[blockSize*(blockNum-1):blockSize*blockNum], buffer, buffer)
@@ -3,6 +3,9 @@ package luks
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	mathrand "math/rand"
 	"testing"
 )
 
@@ -16,7 +19,7 @@ func TestAntiforensic(t *testing.T) {
 	secret = append(secret, password...)
 	secret = secret[:keySize] // expand input data to its key size
 
-	dest, err := afSplit(secret, stripes, hash)
+	dest, err := afSplit(secret, stripes, hash, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -34,3 +37,165 @@ func TestAntiforensic(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestAfDiffuse(t *testing.T) {
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// H(0x00000000 || data[0:32]) || H(0x00000001 || data[32:64])
+	expected := decodeHex(t, "bff51a6d513395979e3a870c8483769a5a70002e6e32c146c53e1d2edc467002"+
+		"b32f0e0ffb9565b7420f28f7178244f549461806e38b750e2d47de25d70e9049")
+
+	if got := AfDiffuse(data, sha256.New()); !bytes.Equal(got, expected) {
+		t.Fatalf("expected %x, got %x", expected, got)
+	}
+}
+
+func TestAfSplitDeterministicRandom(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	split := func() []byte {
+		rnd := mathrand.New(mathrand.NewSource(42))
+		dest, err := afSplit(secret, 100, sha256.New(), rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dest
+	}
+
+	first := split()
+	if !bytes.Equal(first, split()) {
+		t.Fatal("af split with the same random source is expected to be reproducible")
+	}
+
+	merged, err := afMerge(first, len(secret), 100, sha256.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, secret) {
+		t.Fatal("merged secret does not match")
+	}
+}
+
+func TestAntiforensicUnalignedKeySize(t *testing.T) {
+	// 48-byte key (e.g. aes-192-xts) is not a multiple of sha256 digest size
+	secret := make([]byte, 48)
+	mathrand.Read(secret)
+
+	dest, err := afSplit(secret, 4000, sha256.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := afMerge(dest, len(secret), 4000, sha256.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, final) {
+		t.Fatal("af merge does not restore the split data")
+	}
+
+	// the last 16-byte block is replaced with the first 16 bytes of its digest
+	data := make([]byte, 48)
+	h := sha256.New()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(data[32:])
+	if got := AfDiffuse(data, sha256.New()); len(got) != 48 || !bytes.Equal(got[32:], h.Sum(nil)[:16]) {
+		t.Fatalf("unexpected diffuse result %x", got)
+	}
+
+	if _, err := afMerge(dest, 0, 4000, sha256.New()); err == nil {
+		t.Fatal("expected an error for zero block size")
+	}
+	if _, err := afMerge(dest[:1000], len(secret), 4000, sha256.New()); err == nil {
+		t.Fatal("expected an error for a short input buffer")
+	}
+}
+
+func TestAntiforensicSha512(t *testing.T) {
+	// sha512 digest is larger than the key, the whole key is a single partial block
+	for _, keySize := range []int{24, 32, 64, 100} {
+		secret := make([]byte, keySize)
+		mathrand.Read(secret)
+
+		h, err := luks2AfHash("sha512")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest, err := afSplit(secret, 4000, h, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		final, err := afMerge(dest, keySize, 4000, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, final) {
+			t.Fatalf("af merge does not restore %v-byte key", keySize)
+		}
+	}
+
+	// 24-byte data: H(0x00000000 || data)[:24]
+	data := make([]byte, 24)
+	sum := sha512.Sum512(append([]byte{0, 0, 0, 0}, data...))
+	if got := AfDiffuse(data, sha512.New()); !bytes.Equal(got, sum[:24]) {
+		t.Fatalf("expected %x, got %x", sum[:24], got)
+	}
+}
+
+func TestAfSplitGolden(t *testing.T) {
+	// digests of af split output created before the diffusion loop started to work in place
+	tests := []struct {
+		keySize  int
+		hash     string
+		expected string
+	}{
+		{64, "sha256", "56db7cda2e7d263dcbf8bc91ee0cc31b164772ae3fcea7ce428bb2319430bf1b"},
+		{48, "sha256", "7426214e19d644eaa81c91ebcbdc8dd343fe0cd95651ade5c5247137df00d055"},
+		{32, "sha512", "897e514a7a81f75b07799ff26add168078210f00cbbf4670b1f0f84af582d881"},
+	}
+	for _, test := range tests {
+		secret := make([]byte, test.keySize)
+		for i := range secret {
+			secret[i] = byte(i)
+		}
+		h, err := luks2AfHash(test.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dest, err := afSplit(secret, stripesNum, h, mathrand.New(mathrand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(dest); hex.EncodeToString(sum[:]) != test.expected {
+			t.Fatalf("%v-byte key with %v: unexpected af split result digest %x", test.keySize, test.hash, sum)
+		}
+
+		merged, err := afMerge(dest, test.keySize, stripesNum, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(merged, secret) {
+			t.Fatalf("%v-byte key with %v: merged secret does not match", test.keySize, test.hash)
+		}
+	}
+}
+
+func BenchmarkAfMerge(b *testing.B) {
+	secret := make([]byte, 64)
+	mathrand.Read(secret)
+	dest, err := afSplit(secret, stripesNum, sha256.New(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := afMerge(dest, len(secret), stripesNum, sha256.New()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package luks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// HeaderBackup is a copy of the LUKS2 header area: both header copies and the keyslots region, the same content
+// as stored by `cryptsetup luksHeaderBackup`. It implements io.WriterTo and io.ReaderFrom so a backup can be
+// streamed to and from any writer or reader, e.g. a network connection.
+type HeaderBackup struct {
+	data []byte
+}
+
+// NewHeaderBackup reads the header area of the LUKS2 device
+func NewHeaderBackup(f *os.File) (*HeaderBackup, error) {
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		return nil, err
+	}
+	size, err := headerAreaSize(d)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		clearSlice(data)
+		return nil, err
+	}
+	return &HeaderBackup{data: data}, nil
+}
+
+// WriteTo writes the backup to `w` and returns the number of bytes written
+func (b *HeaderBackup) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b.data)
+	return int64(n), err
+}
+
+// maximum size of the keyslots region, see LUKS2_MAX_KEYSLOTS_SIZE in cryptsetup
+const maxKeyslotsRegion = 128 * 1024 * 1024
+
+// maximum size of a header backup: both headers of the maximum size followed by the largest keyslots region
+const maxHeaderBackupSize = 2*maxHeaderSize + maxKeyslotsRegion
+
+// ReadFrom loads a backup from `r`, it reads `r` until EOF. The backup is validated before it is accepted.
+// Input larger than the largest possible LUKS2 header area is rejected without buffering it in whole.
+func (b *HeaderBackup) ReadFrom(r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxHeaderBackupSize+1))
+	if err != nil {
+		clearSlice(data)
+		return int64(len(data)), err
+	}
+	if len(data) > maxHeaderBackupSize {
+		clearSlice(data)
+		return int64(len(data)), fmt.Errorf("header backup is larger than the maximum LUKS2 header area size %v", maxHeaderBackupSize)
+	}
+	if err := validateHeaderBackup(data); err != nil {
+		clearSlice(data)
+		return int64(len(data)), err
+	}
+	b.data = data
+	return int64(len(data)), nil
+}
+
+// Restore writes the backup over the header area of the device. The data area is not modified.
+func (b *HeaderBackup) Restore(f *os.File) error {
+	if len(b.data) == 0 {
+		return fmt.Errorf("header backup is empty")
+	}
+	size, err := deviceSize(f)
+	if err != nil {
+		return err
+	}
+	if size < int64(len(b.data)) {
+		return fmt.Errorf("device of size %v is too small for the header backup of size %v", size, len(b.data))
+	}
+	if _, err := f.WriteAt(b.data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// BackupHeader writes a backup of the LUKS2 header area to `w`
+func BackupHeader(f *os.File, w io.Writer) error {
+	b, err := NewHeaderBackup(f)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(b.data)
+	_, err = b.WriteTo(w)
+	return err
+}
+
+// RestoreHeader reads a header backup created by BackupHeader from `r` and writes it to the device
+func RestoreHeader(f *os.File, r io.Reader) error {
+	var b HeaderBackup
+	if _, err := b.ReadFrom(r); err != nil {
+		return err
+	}
+	defer clearSlice(b.data)
+	return b.Restore(f)
+}
+
+// headerAreaSize returns size of both header copies and the keyslots region
+func headerAreaSize(d *Device) (int64, error) {
+	keyslotsSize, err := d.meta.Config.KeyslotsSize.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid config.keyslots_size value: %v", err)
+	}
+	return 2*int64(d.hdr.HeaderSize) + keyslotsSize, nil
+}
+
+func validateHeaderBackup(data []byte) error {
+	d, err := luks2OpenDevice(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid header backup: %v", err)
+	}
+	size, err := headerAreaSize(d)
+	if err != nil {
+		return err
+	}
+	if size != int64(len(data)) {
+		return fmt.Errorf("header backup of size %v does not match the header area size %v", len(data), size)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package luks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHeaderBackupPipe(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, _ := fx.open(t)
+
+	backup, err := NewHeaderBackup(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := ioutil.TempFile("", "luks.go.restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	defer os.Remove(target.Name())
+	if err := target.Truncate(fx.diskSize); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan int64, 1)
+	go func() {
+		n, err := backup.WriteTo(pw)
+		pw.CloseWithError(err)
+		written <- n
+	}()
+	if err := RestoreHeader(target, pr); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-written; n != fixtureDataOffset {
+		t.Fatalf("expected the header area of %v bytes to be written, got %v", fixtureDataOffset, n)
+	}
+
+	// the restored header unlocks the same way as the original one
+	d, err := luks2OpenDevice(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume, err := d.unlockKeyslot(target, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+}
+
+func TestRestoreHeaderInvalid(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk, _ := fx.open(t)
+
+	var buf bytes.Buffer
+	if err := BackupHeader(disk, &buf); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-4096]
+	if err := RestoreHeader(disk, bytes.NewReader(truncated)); err == nil {
+		t.Fatal("truncated backup is expected to fail")
+	}
+	if err := RestoreHeader(disk, bytes.NewReader(make([]byte, 65536))); err == nil {
+		t.Fatal("backup without LUKS header is expected to fail")
+	}
+}
+
+// endlessReader returns zeros forever and counts the bytes read
+type endlessReader struct{ n int64 }
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestHeaderBackupReadFromOversized(t *testing.T) {
+	r := &endlessReader{}
+	var backup HeaderBackup
+	if _, err := backup.ReadFrom(r); err == nil {
+		t.Fatal("endless stream is expected to be rejected")
+	}
+	if r.n > maxHeaderBackupSize+1 {
+		t.Fatalf("read %v bytes, the limit is %v", r.n, maxHeaderBackupSize+1)
+	}
+}
@@ -0,0 +1,140 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// UnlockAllError holds per-device errors returned by UnlockAll. Entries of successfully unlocked devices are nil.
+type UnlockAllError []error
+
+func (e UnlockAllError) Error() string {
+	var msgs []string
+	for i, err := range e {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("device %v: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// UnlockAll unlocks several devices that share the same passphrase. Key derivation of the devices runs
+// concurrently in a worker pool, its size is set with WithWorkers and defaults to the number of CPUs.
+// devices[i] is read from files[i], the options are applied to every device the same way as by Unlock.
+// Results have the same order as devices, if any device fails then UnlockAllError is returned along with
+// the volumes unlocked successfully.
+func UnlockAll(devices []*Device, files []*os.File, passphrase []byte, opts ...Option) ([]*VolumeInfo, error) {
+	if len(devices) != len(files) {
+		return nil, fmt.Errorf("number of devices %v does not match number of files %v", len(devices), len(files))
+	}
+
+	o := buildOptions(opts)
+	passphrase, wipe := o.normalizePassphrase(passphrase)
+	defer wipe()
+
+	unlock := func(d *Device, f *os.File) (*VolumeInfo, error) {
+		if err := d.applyOptions(o); err != nil {
+			return nil, err
+		}
+		highPrio, normPrio, _ := d.keyslotsByPriority()
+		volume, _, err := unlockKeyslots(f, d, append(highPrio, normPrio...), passphrase, o)
+		return volume, err
+	}
+
+	volumes := make([]*VolumeInfo, len(devices))
+	errs := make(UnlockAllError, len(devices))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(devices) {
+		workers = len(devices)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				volumes[i], errs[i] = unlock(devices[i], files[i])
+			}
+		}()
+	}
+	for i := range devices {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// report warnings from this goroutine, the warning function does not have to be safe for concurrent use
+	for _, volume := range volumes {
+		if volume != nil {
+			o.warnVolume(volume)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return volumes, errs
+		}
+	}
+	return volumes, nil
+}
+
+// FormatConfig describes a single device created by BatchFormat
+type FormatConfig struct {
+	Path       string
+	Passphrase []byte
+	Opts       *FormatOptions
+}
+
+// BatchFormat formats several LUKS2 devices concurrently. The number of workers is set with WithWorkers, the options
+// are passed to Format as well.
+// Devices are formatted independently, a failure of one device does not stop the others. The returned slice
+// has an entry per config, nil for devices formatted successfully. If any device fails then a summary error is
+// returned as well.
+func BatchFormat(configs []FormatConfig, opts ...Option) ([]error, error) {
+	o := buildOptions(opts)
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(configs) {
+		workers = len(configs)
+	}
+
+	errs := make([]error, len(configs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				c := configs[i]
+				errs[i] = Format(c.Path, c.Passphrase, c.Opts, opts...)
+			}
+		}()
+	}
+	for i := range configs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", configs[i].Path, err))
+		}
+	}
+	if len(msgs) != 0 {
+		return errs, fmt.Errorf("failed to format %v of %v devices: %v", len(msgs), len(configs), strings.Join(msgs, "; "))
+	}
+	return errs, nil
+}
@@ -0,0 +1,121 @@
+package luks
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestUnlockAll(t *testing.T) {
+	var fixtures []*luks2Fixture
+	var devices []*Device
+	var files []*os.File
+	for i := 0; i < 4; i++ {
+		password := "shared"
+		if i == 3 {
+			password = "different"
+		}
+
+		fx := newLuks2Fixture(t, 64)
+		fx.addKeyslot(t, 0, password, "aes-xts-plain64")
+		disk, d := fx.open(t)
+
+		fixtures = append(fixtures, fx)
+		devices = append(devices, d)
+		files = append(files, disk)
+	}
+
+	volumes, err := UnlockAll(devices[:3], files[:3], []byte("shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range volumes {
+		if !bytes.Equal(v.key, fixtures[i].volumeKey) {
+			t.Fatalf("device %v: unlocked volume key does not match", i)
+		}
+	}
+
+	volumes, err = UnlockAll(devices, files, []byte("shared"))
+	errs, ok := err.(UnlockAllError)
+	if !ok {
+		t.Fatalf("expected UnlockAllError, got %v", err)
+	}
+	if errs[0] != nil || errs[3] != ErrPassphraseDoesNotMatch {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if volumes[0] == nil || volumes[3] != nil {
+		t.Fatal("unexpected unlock results")
+	}
+}
+
+func TestUnlockAllOptions(t *testing.T) {
+	var fixtures []*luks2Fixture
+	var devices []*Device
+	var files []*os.File
+	for i := 0; i < 3; i++ {
+		fx := newLuks2Fixture(t, 64)
+		fx.addKeyslot(t, 0, "caf\u00e9", "aes-xts-plain64") // composed form
+		fx.addKeyslot(t, 1, "caf\u00e9", "aes-xts-plain64")
+		if i == 1 {
+			// keyslot 0 area points to the data segment
+			ks := fx.meta.Keyslots[0]
+			ks.Area.Offset = jsonNumber(strconv.Itoa(fixtureDataOffset))
+			fx.meta.Keyslots[0] = ks
+		}
+		disk, d := fx.open(t)
+
+		fixtures = append(fixtures, fx)
+		devices = append(devices, d)
+		files = append(files, disk)
+	}
+
+	decomposed := []byte("cafe\u0301")
+	volumes, err := UnlockAll(devices, files, decomposed, WithWorkers(1), WithContinueOnKeyslotError(), WithPassphraseNormalization(composeAcute{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range volumes {
+		if !bytes.Equal(v.key, fixtures[i].volumeKey) {
+			t.Fatalf("device %v: unlocked volume key does not match", i)
+		}
+	}
+
+	_, err = UnlockAll(devices, files, decomposed, WithPassphraseNormalization(composeAcute{}))
+	errs, ok := err.(UnlockAllError)
+	if !ok || errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("corrupted keyslot is expected to fail device 1 only without WithContinueOnKeyslotError, got %v", err)
+	}
+}
+
+func TestBatchFormat(t *testing.T) {
+	var configs []FormatConfig
+	for i := 0; i < 3; i++ {
+		path := tempDisk(t, 32*1024*1024)
+		configs = append(configs, FormatConfig{Path: path, Passphrase: []byte("foobar"), Opts: testFormatOptions})
+	}
+	configs[1].Path = "/non/existing/path"
+
+	errs, err := BatchFormat(configs, WithWorkers(2))
+	if err == nil {
+		t.Fatal("expected a summary error")
+	}
+	if len(errs) != 3 || errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("unexpected per-device errors: %v", errs)
+	}
+
+	for _, i := range []int{0, 2} {
+		disk, err := os.Open(configs[i].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer disk.Close()
+		d, err := luks2OpenDevice(disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+			t.Fatalf("device %v: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package luks
+
+import (
+	"encoding/base64"
+	"sync"
+
+	"golang.org/x/sys/cpu"
+)
+
+// BuildInfo describes algorithms and capabilities available in this build of the package
+type BuildInfo struct {
+	SupportedCiphers []string
+	SupportedKDFs    []string
+	SupportedHashes  []string
+	HasSecureMemory  bool // SecretBuffer can allocate locked (non-swappable) memory, mlock may be limited by RLIMIT_MEMLOCK
+	HasAESNI         bool // CPU provides hardware AES acceleration
+}
+
+// algorithm names used by LUKS implementations, the build support is detected by probing them
+var (
+	knownCiphers = []string{"aes", "serpent", "twofish", "camellia", "cast5", "cast6", "sm4", "magma", "gost89"}
+	knownKDFs    = []string{"pbkdf2", "argon2i", "argon2id"}
+	knownHashes  = []string{"sha1", "sha224", "sha256", "sha384", "sha512", "ripemd160", "whirlpool", "sm3", "stribog256", "stribog512"}
+	knownModes   = []string{"xts", "cbc", "cfb", "ecb", "ctr", "lrw", "pcbc"}
+	// 'plain' is not probed as building it logs a deprecation warning, it is always supported
+	knownIVModes = []string{"plain64", "plain64be", "essiv:sha256", "benbi", "null", "lmk", "tcw", "eboiv", "elephant"}
+)
+
+// Algorithms lists the algorithm names that can be used in LUKS cipher specs and keyslots
+type Algorithms struct {
+	Ciphers []string // e.g. 'aes'
+	Modes   []string // block cipher modes, e.g. 'xts'
+	IVModes []string // IV generators, e.g. 'plain64'
+	Hashes  []string
+	KDFs    []string
+}
+
+var (
+	buildInfo  BuildInfo
+	algorithms Algorithms
+	probeOnce  sync.Once
+)
+
+// probeBuild detects the supported algorithms. It runs key derivations thus it is done on the first use
+// rather than in init() of every program that imports the package.
+func probeBuild() {
+	buildInfo = BuildInfo{
+		HasAESNI: cpu.X86.HasAES || cpu.ARM64.HasAES,
+	}
+	if secret, err := NewSecretBuffer(1); err == nil {
+		buildInfo.HasSecureMemory = secret.Destroy() == nil
+	}
+
+	key := make([]byte, 32)
+	for _, c := range knownCiphers {
+		if _, err := buildSectorCipher(c, "cbc", "plain64", key); err == nil {
+			buildInfo.SupportedCiphers = append(buildInfo.SupportedCiphers, c)
+		}
+	}
+
+	salt := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	for _, k := range knownKDFs {
+		params := kdf{Type: k, Salt: salt, Hash: "sha256", Iterations: 1, Time: 1, Memory: 8, Cpus: 1}
+		if key, err := deriveLuks2AfKey(params, 0, []byte("probe"), 16); err == nil {
+			key.Destroy()
+			buildInfo.SupportedKDFs = append(buildInfo.SupportedKDFs, k)
+		}
+	}
+
+	for _, h := range knownHashes {
+		if _, err := luks2AfHash(h); err == nil {
+			buildInfo.SupportedHashes = append(buildInfo.SupportedHashes, h)
+		}
+	}
+
+	algorithms = Algorithms{
+		Ciphers: buildInfo.SupportedCiphers,
+		Hashes:  buildInfo.SupportedHashes,
+		KDFs:    buildInfo.SupportedKDFs,
+	}
+	for _, m := range knownModes {
+		if _, err := buildSectorCipher("aes", m, "plain64", key); err == nil {
+			algorithms.Modes = append(algorithms.Modes, m)
+		}
+	}
+	algorithms.IVModes = []string{"plain"}
+	for _, iv := range knownIVModes {
+		if _, err := buildSectorCipher("aes", "cbc", iv, key); err == nil {
+			algorithms.IVModes = append(algorithms.IVModes, iv)
+		}
+	}
+}
+
+// PackageBuildInfo reports which algorithms are available in this build. It allows to check whether a device
+// can be opened before attempting to unlock it.
+func PackageBuildInfo() BuildInfo {
+	probeOnce.Do(probeBuild)
+	info := buildInfo
+	info.SupportedCiphers = append([]string(nil), buildInfo.SupportedCiphers...)
+	info.SupportedKDFs = append([]string(nil), buildInfo.SupportedKDFs...)
+	info.SupportedHashes = append([]string(nil), buildInfo.SupportedHashes...)
+	return info
+}
+
+// SupportedAlgorithms returns the ciphers, modes, IV generators, hashes and KDFs implemented by the package.
+// A device can be unlocked if its keyslot and segment specs use only these algorithms.
+func SupportedAlgorithms() Algorithms {
+	probeOnce.Do(probeBuild)
+	return Algorithms{
+		Ciphers: append([]string(nil), algorithms.Ciphers...),
+		Modes:   append([]string(nil), algorithms.Modes...),
+		IVModes: append([]string(nil), algorithms.IVModes...),
+		Hashes:  append([]string(nil), algorithms.Hashes...),
+		KDFs:    append([]string(nil), algorithms.KDFs...),
+	}
+}
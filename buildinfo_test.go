@@ -0,0 +1,73 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackageBuildInfo(t *testing.T) {
+	info := PackageBuildInfo()
+
+	if !reflect.DeepEqual(info.SupportedCiphers, []string{"aes", "magma"}) {
+		t.Fatalf("unexpected ciphers %v", info.SupportedCiphers)
+	}
+	if !reflect.DeepEqual(info.SupportedKDFs, []string{"pbkdf2", "argon2i", "argon2id"}) {
+		t.Fatalf("unexpected KDFs %v", info.SupportedKDFs)
+	}
+	if !reflect.DeepEqual(info.SupportedHashes, []string{"sha224", "sha256", "sha384", "sha512"}) {
+		t.Fatalf("unexpected hashes %v", info.SupportedHashes)
+	}
+
+	secret, err := NewSecretBuffer(1)
+	if err == nil {
+		defer secret.Destroy()
+	}
+	if info.HasSecureMemory != (err == nil) {
+		t.Fatalf("HasSecureMemory is %v while SecretBuffer allocation returns %v", info.HasSecureMemory, err)
+	}
+
+	// the returned info is a copy
+	info.SupportedCiphers[0] = "modified"
+	if PackageBuildInfo().SupportedCiphers[0] != "aes" {
+		t.Fatal("build info is expected to be immutable")
+	}
+}
+
+func TestSupportedAlgorithms(t *testing.T) {
+	algs := SupportedAlgorithms()
+
+	contains := func(list []string, name string) bool {
+		for _, s := range list {
+			if s == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, check := range []struct {
+		list []string
+		name string
+	}{
+		{algs.Ciphers, "aes"},
+		{algs.Modes, "xts"},
+		{algs.Modes, "cbc"},
+		{algs.IVModes, "plain64"},
+		{algs.IVModes, "essiv:sha256"},
+		{algs.Hashes, "sha256"},
+		{algs.KDFs, "pbkdf2"},
+		{algs.KDFs, "argon2id"},
+	} {
+		if !contains(check.list, check.name) {
+			t.Errorf("%v is expected to be supported: %+v", check.name, algs)
+		}
+	}
+	if contains(algs.Modes, "ecb") || contains(algs.IVModes, "benbi") {
+		t.Fatalf("unimplemented algorithms are reported: %+v", algs)
+	}
+
+	// the returned lists are copies
+	algs.Ciphers[0] = "modified"
+	if SupportedAlgorithms().Ciphers[0] == "modified" {
+		t.Fatal("SupportedAlgorithms returns internal state")
+	}
+}
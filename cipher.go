@@ -0,0 +1,228 @@
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/xts"
+)
+
+// sectorCipher encrypts/decrypts data sector by sector. The sector number is used to compute the IV/tweak.
+// It matches the method set of xts.Cipher.
+type sectorCipher interface {
+	Encrypt(ciphertext, plaintext []byte, sectorNum uint64)
+	Decrypt(plaintext, ciphertext []byte, sectorNum uint64)
+}
+
+// ivGenerator fills iv with a value computed for the given sector
+type ivGenerator func(iv []byte, sectorNum uint64)
+
+// plain64 IV is the full 64-bit little-endian sector number padded with zeros
+func ivPlain64(iv []byte, sectorNum uint64) {
+	clearSlice(iv)
+	binary.LittleEndian.PutUint64(iv, sectorNum)
+}
+
+// plain IV uses only the lower 32 bits of the sector number. For devices larger than 2TiB (with 512 bytes sectors)
+// the IV wraps around and the same IV is reused for different sectors, which is a known security weakness of this mode.
+func ivPlain(iv []byte, sectorNum uint64) {
+	clearSlice(iv)
+	binary.LittleEndian.PutUint32(iv, uint32(sectorNum))
+}
+
+// IVModeIsWeak reports whether the IV generator, e.g. the third part of ParseEncryption result, is known to reuse
+// IVs. 'plain' uses 32-bit sector numbers that wrap around at 2^32 sectors, unlocking such a volume produces
+// a warning that is passed to the WithWarnings function.
+func IVModeIsWeak(ivMode string) bool {
+	return ivMode == "plain"
+}
+
+// buildIvGenerator creates IV generator for the given mode, e.g. 'plain64' or 'essiv:sha256'.
+// The key is the encryption key that is used by ESSIV to compute the salt.
+func buildIvGenerator(ivMode string, cipherFunc func(key []byte) (cipher.Block, error), key []byte) (ivGenerator, error) {
+	switch {
+	case ivMode == "plain64":
+		return ivPlain64, nil
+	case ivMode == "plain":
+		return ivPlain, nil
+	case strings.HasPrefix(ivMode, "essiv:"):
+		// ESSIV: IV = E(salt, plain64 sector number) where salt = H(key)
+		hashName := strings.TrimPrefix(ivMode, "essiv:")
+		var salt []byte
+		switch hashName {
+		case "sha256":
+			sum := sha256.Sum256(key)
+			salt = sum[:]
+		default:
+			return nil, fmt.Errorf("Unknown ESSIV hash algorithm: %v", hashName)
+		}
+		essivCipher, err := cipherFunc(salt)
+		clearSlice(salt)
+		if err != nil {
+			return nil, err
+		}
+		return func(iv []byte, sectorNum uint64) {
+			ivPlain64(iv, sectorNum)
+			essivCipher.Encrypt(iv, iv)
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown IV mode: %v", ivMode)
+	}
+}
+
+type cbcCipher struct {
+	block cipher.Block
+	iv    ivGenerator
+}
+
+func (c *cbcCipher) Encrypt(ciphertext, plaintext []byte, sectorNum uint64) {
+	iv := make([]byte, c.block.BlockSize())
+	c.iv(iv, sectorNum)
+	cipher.NewCBCEncrypter(c.block, iv).CryptBlocks(ciphertext, plaintext)
+}
+
+func (c *cbcCipher) Decrypt(plaintext, ciphertext []byte, sectorNum uint64) {
+	iv := make([]byte, c.block.BlockSize())
+	c.iv(iv, sectorNum)
+	cipher.NewCBCDecrypter(c.block, iv).CryptBlocks(plaintext, ciphertext)
+}
+
+// cfbCipher implements full-block CFB mode, the same as the kernel 'cfb' template. Every sector starts from
+// the IV computed for the sector.
+type cfbCipher struct {
+	block cipher.Block
+	iv    ivGenerator
+}
+
+func (c *cfbCipher) Encrypt(ciphertext, plaintext []byte, sectorNum uint64) {
+	iv := make([]byte, c.block.BlockSize())
+	c.iv(iv, sectorNum)
+	cipher.NewCFBEncrypter(c.block, iv).XORKeyStream(ciphertext, plaintext)
+}
+
+func (c *cfbCipher) Decrypt(plaintext, ciphertext []byte, sectorNum uint64) {
+	iv := make([]byte, c.block.BlockSize())
+	c.iv(iv, sectorNum)
+	cipher.NewCFBDecrypter(c.block, iv).XORKeyStream(plaintext, ciphertext)
+}
+
+const xtsBlockSize = 16
+
+// xtsCipher implements XTS mode (IEEE 1619) with a tweak computed from an arbitrary IV generator.
+// golang.org/x/crypto/xts supports plain64 IV only.
+type xtsCipher struct {
+	k1, k2 cipher.Block
+	iv     ivGenerator
+}
+
+func newXtsCipher(cipherFunc func(key []byte) (cipher.Block, error), key []byte, iv ivGenerator) (*xtsCipher, error) {
+	if len(key)%2 != 0 {
+		return nil, fmt.Errorf("xts: invalid key size %v", len(key))
+	}
+	k1, err := cipherFunc(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	k2, err := cipherFunc(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	if k1.BlockSize() != xtsBlockSize {
+		return nil, fmt.Errorf("xts: cipher block size must be %v", xtsBlockSize)
+	}
+	return &xtsCipher{k1: k1, k2: k2, iv: iv}, nil
+}
+
+func (c *xtsCipher) crypt(dst, src []byte, sectorNum uint64, crypt func(dst, src []byte)) {
+	if len(src)%xtsBlockSize != 0 {
+		panic("xts: input is not a multiple of block size")
+	}
+
+	var tweak [xtsBlockSize]byte
+	c.iv(tweak[:], sectorNum)
+	c.k2.Encrypt(tweak[:], tweak[:])
+
+	var block [xtsBlockSize]byte
+	for i := 0; i < len(src); i += xtsBlockSize {
+		xorSlices(src[i:i+xtsBlockSize], tweak[:], block[:])
+		crypt(block[:], block[:])
+		xorSlices(block[:], tweak[:], dst[i:i+xtsBlockSize])
+		xtsMul2(&tweak)
+	}
+}
+
+func (c *xtsCipher) Encrypt(ciphertext, plaintext []byte, sectorNum uint64) {
+	c.crypt(ciphertext, plaintext, sectorNum, c.k1.Encrypt)
+}
+
+func (c *xtsCipher) Decrypt(plaintext, ciphertext []byte, sectorNum uint64) {
+	c.crypt(plaintext, ciphertext, sectorNum, c.k1.Decrypt)
+}
+
+// xtsMul2 multiplies the tweak by the primitive element x in GF(2^128)
+func xtsMul2(tweak *[xtsBlockSize]byte) {
+	var carryIn byte
+	for i := range tweak {
+		carryOut := tweak[i] >> 7
+		tweak[i] = (tweak[i] << 1) | carryIn
+		carryIn = carryOut
+	}
+	if carryIn != 0 {
+		tweak[0] ^= 0x87
+	}
+}
+
+// buildSectorCipher creates a cipher for the given cipher spec. A spec like 'aes-cbc-essiv:sha256' is passed here
+// as cipherName='aes', cipherMode='cbc', ivMode='essiv:sha256'. See crypt_parse_name_and_mode() in cryptsetup.
+func buildSectorCipher(cipherName, cipherMode, ivMode string, key []byte) (sectorCipher, error) {
+	var cipherFunc func(key []byte) (cipher.Block, error)
+	switch cipherName {
+	case "aes":
+		cipherFunc = aes.NewCipher
+	case "magma":
+		// Magma has 64-bit block thus it can be used with 'cbc' and 'cfb' modes only
+		cipherFunc = newMagmaCipher
+	case "gost89":
+		return nil, fmt.Errorf("GOST 28147-89 with custom S-boxes is not supported, only 'magma' (GOST R 34.12-2015) S-boxes are implemented")
+	default:
+		return nil, fmt.Errorf("Unknown cipher: %v", cipherName)
+	}
+
+	switch cipherMode {
+	case "xts":
+		if ivMode == "plain64" {
+			return xts.NewCipher(cipherFunc, key)
+		}
+		iv, err := buildIvGenerator(ivMode, cipherFunc, key)
+		if err != nil {
+			return nil, err
+		}
+		return newXtsCipher(cipherFunc, key, iv)
+	case "cbc":
+		block, err := cipherFunc(key)
+		if err != nil {
+			return nil, err
+		}
+		iv, err := buildIvGenerator(ivMode, cipherFunc, key)
+		if err != nil {
+			return nil, err
+		}
+		return &cbcCipher{block: block, iv: iv}, nil
+	case "cfb":
+		block, err := cipherFunc(key)
+		if err != nil {
+			return nil, err
+		}
+		iv, err := buildIvGenerator(ivMode, cipherFunc, key)
+		if err != nil {
+			return nil, err
+		}
+		return &cfbCipher{block: block, iv: iv}, nil
+	default:
+		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
+	}
+}
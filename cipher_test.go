@@ -0,0 +1,191 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/xts"
+)
+
+func TestIvPlainWrapsAround(t *testing.T) {
+	iv1 := make([]byte, 16)
+	iv2 := make([]byte, 16)
+
+	ivPlain(iv1, 5)
+	ivPlain(iv2, 1<<32+5)
+	if !bytes.Equal(iv1, iv2) {
+		t.Fatalf("plain IV is expected to use only lower 32 bits of the sector number")
+	}
+
+	ivPlain64(iv1, 5)
+	ivPlain64(iv2, 1<<32+5)
+	if bytes.Equal(iv1, iv2) {
+		t.Fatalf("plain64 IV is expected to use all 64 bits of the sector number")
+	}
+	if !bytes.Equal(iv2, []byte{5, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("unexpected plain64 IV value: %x", iv2)
+	}
+
+	if !IVModeIsWeak("plain") || IVModeIsWeak("plain64") || IVModeIsWeak("essiv:sha256") {
+		t.Fatal("only 'plain' IV mode is expected to be weak")
+	}
+}
+
+func TestLuks2UnlockCbcKeyslot(t *testing.T) {
+	for _, encryption := range []string{"aes-cbc-plain", "aes-cbc-plain64"} {
+		fx := newLuks2Fixture(t, 32)
+		fx.addKeyslot(t, 0, "foobar", encryption)
+		disk, d := fx.open(t)
+
+		volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+		if err != nil {
+			t.Fatalf("%v: %v", encryption, err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatalf("%v: unlocked volume key does not match", encryption)
+		}
+	}
+}
+
+func TestPlainIVWarning(t *testing.T) {
+	for _, encryption := range []string{"aes-cbc-plain", "aes-cbc-plain64"} {
+		fx := newLuks2Fixture(t, 32)
+		fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+		seg := fx.meta.Segments[0]
+		seg.Encryption = encryption
+		fx.meta.Segments[0] = seg
+		disk := fx.writeDisk(t)
+
+		var warnings []string
+		volume, err := Unlock(disk, AnyKeyslot, []byte("foobar"), WithWarnings(func(msg string) {
+			warnings = append(warnings, msg)
+		}))
+		if err != nil {
+			t.Fatalf("%v: %v", encryption, err)
+		}
+		volume.Destroy()
+
+		weak := encryption == "aes-cbc-plain"
+		if weak && (len(warnings) != 1 || !strings.Contains(warnings[0], "wrap around")) {
+			t.Fatalf("%v: expected a wrap around warning, got %q", encryption, warnings)
+		}
+		if !weak && len(warnings) != 0 {
+			t.Fatalf("%v: unexpected warnings %q", encryption, warnings)
+		}
+	}
+}
+
+func TestXtsMatchesReferenceImplementation(t *testing.T) {
+	key := make([]byte, 64)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	plaintext := make([]byte, 512)
+	for i := range plaintext {
+		plaintext[i] = byte(i * 7)
+	}
+
+	reference, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err := newXtsCipher(aes.NewCipher, key, ivPlain64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sector := range []uint64{0, 1, 1<<32 + 3} {
+		expected := make([]byte, len(plaintext))
+		got := make([]byte, len(plaintext))
+		reference.Encrypt(expected, plaintext, sector)
+		ours.Encrypt(got, plaintext, sector)
+		if !bytes.Equal(expected, got) {
+			t.Fatalf("sector %v: xts output does not match the reference implementation", sector)
+		}
+
+		ours.Decrypt(got, got, sector)
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("sector %v: xts decryption failed", sector)
+		}
+	}
+}
+
+func TestIvEssiv(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	gen, err := buildIvGenerator("essiv:sha256", aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := sha256.Sum256(key)
+	essiv, err := aes.NewCipher(salt[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, 16)
+	expected[0] = 7
+	essiv.Encrypt(expected, expected)
+
+	iv := make([]byte, 16)
+	gen(iv, 7)
+	if !bytes.Equal(iv, expected) {
+		t.Fatalf("expected ESSIV %x, got %x", expected, iv)
+	}
+
+	if _, err := buildIvGenerator("essiv:md4", aes.NewCipher, key); err == nil {
+		t.Fatal("unknown ESSIV hash is expected to fail")
+	}
+}
+
+func TestLuks2UnlockEssivKeyslot(t *testing.T) {
+	for _, tc := range []struct {
+		encryption string
+		keySize    int
+	}{
+		{"aes-xts-essiv:sha256", 64},
+		{"aes-cbc-essiv:sha256", 32},
+	} {
+		fx := newLuks2Fixture(t, tc.keySize)
+		fx.addKeyslot(t, 0, "foobar", tc.encryption)
+		disk, d := fx.open(t)
+
+		volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.encryption, err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatalf("%v: unlocked volume key does not match", tc.encryption)
+		}
+	}
+}
+
+func TestParseEncryption(t *testing.T) {
+	tests := []struct {
+		spec             string
+		cipher, mode, iv string
+	}{
+		{"aes-xts-plain64", "aes", "xts", "plain64"},
+		{"aes-cbc-essiv:sha256", "aes", "cbc", "essiv:sha256"},
+		{"capi:xts(aes)-plain64", "aes", "xts", "plain64"},
+		{"capi:cbc(twofish)-essiv:sha256", "twofish", "cbc", "essiv:sha256"},
+	}
+	for _, test := range tests {
+		cipher, mode, iv, err := ParseEncryption(test.spec)
+		if err != nil {
+			t.Errorf("%v: %v", test.spec, err)
+			continue
+		}
+		if cipher != test.cipher || mode != test.mode || iv != test.iv {
+			t.Errorf("%v: got (%v, %v, %v)", test.spec, cipher, mode, iv)
+		}
+	}
+
+	for _, spec := range []string{"", "aes", "aes-xts", "aes--plain64", "aes-xts-plain64-extra", "capi:xts(aes)", "capi:(aes)-plain64", "capi:xts(aes)-"} {
+		if _, _, _, err := ParseEncryption(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
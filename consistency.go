@@ -0,0 +1,76 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+)
+
+// possible offsets of the secondary LUKS2 header, used when the primary header is damaged and its
+// HeaderSize field cannot be trusted. See hdr_read_disk() in cryptsetup.
+var luks2SecondaryHeaderOffsets = []int64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+// ConsistencyReport describes the state of the primary and secondary LUKS2 header copies
+type ConsistencyReport struct {
+	PrimaryError   error // nil if the primary header checksum is valid
+	SecondaryError error // nil if the secondary header checksum is valid
+
+	PrimarySequenceId   uint64
+	SecondarySequenceId uint64
+	PrimaryUUID         string
+	SecondaryUUID       string
+	SecondaryOffset     int64 // offset of the secondary header, 0 if it is not found
+
+	// Consistent is true when both copies have valid checksums and agree on SequenceId and UUID
+	Consistent bool
+}
+
+// HeaderConsistency verifies checksums of both LUKS2 header copies and compares their SequenceId and UUID.
+// Divergent copies are reported in ConsistencyReport, an error is returned only if the device cannot be read
+// or it is not a LUKS2 device.
+func HeaderConsistency(f *os.File) (ConsistencyReport, error) {
+	var report ConsistencyReport
+
+	version, err := readLuksVersion(f)
+	if err != nil {
+		return report, err
+	}
+	if version != 2 {
+		return report, fmt.Errorf("header consistency check is supported for LUKS2 only, got version %v", version)
+	}
+
+	primary, _, err := readLuks2Header(f, 0)
+	if err != nil {
+		report.PrimaryError = err
+	} else {
+		report.PrimarySequenceId = primary.SequenceId
+		report.PrimaryUUID = fixedArrayToString(primary.UUID[:])
+	}
+
+	offsets := luks2SecondaryHeaderOffsets
+	if primary != nil {
+		offsets = []int64{int64(primary.HeaderSize)}
+	}
+	report.SecondaryError = fmt.Errorf("secondary header is not found")
+	for _, offset := range offsets {
+		secondary, _, err := readLuks2Header(f, offset)
+		if err != nil {
+			if primary != nil {
+				report.SecondaryError = err
+			}
+			continue
+		}
+		if secondary.HeaderOffset != uint64(offset) {
+			report.SecondaryError = fmt.Errorf("secondary header at %v has unexpected offset field %v", offset, secondary.HeaderOffset)
+			continue
+		}
+		report.SecondaryError = nil
+		report.SecondaryOffset = offset
+		report.SecondarySequenceId = secondary.SequenceId
+		report.SecondaryUUID = fixedArrayToString(secondary.UUID[:])
+		break
+	}
+
+	report.Consistent = report.PrimaryError == nil && report.SecondaryError == nil &&
+		report.PrimarySequenceId == report.SecondarySequenceId && report.PrimaryUUID == report.SecondaryUUID
+	return report, nil
+}
@@ -0,0 +1,74 @@
+package luks
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestHeaderConsistency(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	report, err := HeaderConsistency(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent {
+		t.Fatalf("fresh header copies are expected to be consistent: %+v", report)
+	}
+	if report.SecondaryOffset != int64(fx.hdr.HeaderSize) {
+		t.Fatalf("expected secondary header at %v, got %v", fx.hdr.HeaderSize, report.SecondaryOffset)
+	}
+}
+
+func TestHeaderConsistencyDiverged(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	// primary header is updated but the secondary is not, e.g. interrupted metadata write
+	seqId := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqId, fx.hdr.SequenceId+1)
+	if err := PatchHeaderField(disk, "SequenceId", seqId); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := HeaderConsistency(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PrimaryError != nil || report.SecondaryError != nil {
+		t.Fatalf("both header copies are expected to have valid checksums: %+v", report)
+	}
+	if report.Consistent {
+		t.Fatal("header copies with different sequence ids are reported as consistent")
+	}
+	if report.PrimarySequenceId != fx.hdr.SequenceId+1 || report.SecondarySequenceId != fx.hdr.SequenceId {
+		t.Fatalf("unexpected sequence ids: primary %v, secondary %v", report.PrimarySequenceId, report.SecondarySequenceId)
+	}
+}
+
+func TestHeaderConsistencyDamagedPrimary(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	if _, err := disk.WriteAt([]byte("garbage"), 448); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := HeaderConsistency(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PrimaryError == nil {
+		t.Fatal("damaged primary header is expected to fail checksum verification")
+	}
+	if report.SecondaryError != nil {
+		t.Fatalf("secondary header is expected to be found: %v", report.SecondaryError)
+	}
+	if report.SecondaryOffset != int64(fx.hdr.HeaderSize) {
+		t.Fatalf("expected secondary header at %v, got %v", fx.hdr.HeaderSize, report.SecondaryOffset)
+	}
+	if report.Consistent {
+		t.Fatal("damaged header is reported as consistent")
+	}
+}
@@ -0,0 +1,112 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DebugDump writes LUKS2 header content in a form useful for manual header recovery. The output contains
+// the binary header fields annotated with their byte offsets, hex dump of the binary header, the raw JSON area
+// and the parsed metadata. Header checksum is not verified so the function can be used with corrupted headers.
+func DebugDump(f *os.File, w io.Writer) error {
+	var hdr headerV2
+	hdrData := make([]byte, binary.Size(hdr))
+	if _, err := f.ReadAt(hdrData, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdrData[0:6], []byte("LUKS\xba\xbe")) {
+		return ErrNotLUKS
+	}
+	if err := binary.Read(bytes.NewReader(hdrData), binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.Version != 2 {
+		return fmt.Errorf("debug dump is supported for LUKS2 only, got version %v", hdr.Version)
+	}
+
+	fmt.Fprintln(w, "# Binary header fields")
+	dumpHeaderFields(w, &hdr)
+
+	fmt.Fprintln(w, "# Binary header hex dump")
+	fmt.Fprint(w, hex.Dump(hdrData))
+
+	hdrSize := hdr.HeaderSize
+	if !isPowerOfTwo(uint(hdrSize)) || hdrSize < 16384 || hdrSize > 4194304 {
+		return fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
+	}
+	jsonData := make([]byte, JsonAreaSize(&hdr))
+	if _, err := f.ReadAt(jsonData, int64(JsonAreaOffset())); err != nil {
+		return err
+	}
+	if idx := bytes.IndexByte(jsonData, 0); idx != -1 {
+		jsonData = jsonData[:idx]
+	}
+
+	fmt.Fprintln(w, "# JSON area")
+	fmt.Fprintf(w, "%s\n", jsonData)
+
+	fmt.Fprintln(w, "# Parsed metadata")
+	var meta metadata
+	if err := json.Unmarshal(jsonData, &meta); err != nil {
+		fmt.Fprintf(w, "unable to parse JSON metadata: %v\n", err)
+		return nil
+	}
+	parsed, err := json.MarshalIndent(&meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", parsed)
+
+	return nil
+}
+
+// dumpHeaderFields prints each binary header field as '[0x06-0x07] Version: 0x0002'
+func dumpHeaderFields(w io.Writer, hdr *headerV2) {
+	v := reflect.ValueOf(hdr).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Name == "_" {
+			continue // padding
+		}
+
+		start := field.Offset
+		end := start + field.Type.Size() - 1
+
+		var value string
+		switch field.Type.Kind() {
+		case reflect.Uint16, reflect.Uint64:
+			value = fmt.Sprintf("0x%0*x (%d)", 2*field.Type.Size(), v.Field(i).Uint(), v.Field(i).Uint())
+		case reflect.Array:
+			buff := make([]byte, field.Type.Len())
+			reflect.Copy(reflect.ValueOf(buff), v.Field(i))
+			value = formatHeaderBytes(buff)
+		}
+
+		fmt.Fprintf(w, "[0x%03x-0x%03x] %s: %s\n", start, end, field.Name, value)
+	}
+}
+
+// formatHeaderBytes renders text fields (labels, UUID, algorithm names) as strings and binary fields as hex
+func formatHeaderBytes(buff []byte) string {
+	s := fixedArrayToString(buff)
+	printable := utf8.ValidString(s)
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+	if printable && len(s) > 0 {
+		return fmt.Sprintf("%q", s)
+	}
+	return hex.EncodeToString(buff)
+}
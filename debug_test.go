@@ -0,0 +1,40 @@
+package luks
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDebugDump(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	// corrupt the checksum, dump should still work
+	if _, err := disk.WriteAt([]byte{0xff}, 448); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DebugDump(disk, &buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"[0x000-0x005] Magic: 4c554b53babe",
+		"[0x006-0x007] Version: 0x0002 (2)",
+		"[0x008-0x00f] HeaderSize: 0x0000000000004000 (16384)",
+		`[0x048-0x067] ChecksumAlgorithm: "sha256"`,
+		`[0x0a8-0x0cf] UUID: "8a7ba2d6-6b5b-4a4b-9b4f-1b1c4aa2f4c3"`,
+		"00000000  4c 55 4b 53 ba be 00 02",
+		`"encryption":"aes-xts-plain64"`,
+		`    "encryption": "aes-xts-plain64",`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Fatalf("dump output does not contain %q:\n%v", e, out)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package luks
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// Metadata is a snapshot of LUKS2 JSON metadata, e.g. taken before and after a configuration change
+type Metadata struct {
+	meta metadata
+}
+
+// ParseMetadata parses LUKS2 JSON metadata, such as the output of ExportMetadata
+func ParseMetadata(data []byte) (*Metadata, error) {
+	var m Metadata
+	if err := unmarshalMetadata(data, &m.meta); err != nil {
+		return nil, err
+	}
+	if err := m.meta.validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Metadata returns a snapshot of the device metadata. Later modifications of the device do not affect it.
+func (d *Device) Metadata() (*Metadata, error) {
+	data, err := d.ExportMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetadata(data)
+}
+
+// MetadataChange describes a single difference between two metadata snapshots. Field is a dot-separated JSON path,
+// e.g. "keyslots.1.kdf.iterations". OldValue is nil for an added field and NewValue is nil for a removed one.
+type MetadataChange struct {
+	Field    string
+	OldValue interface{}
+	NewValue interface{}
+}
+
+// Diff compares keyslots, digests, segments, tokens and config of two metadata snapshots and reports added,
+// removed and modified fields. Values are in their JSON form: strings, numbers, booleans, arrays and objects.
+// Arrays are compared as a whole. The changes are grouped by section and sorted by field path within it.
+func Diff(old, new *Metadata) []MetadataChange {
+	oldTree, newTree := metadataTree(old), metadataTree(new)
+
+	var changes []MetadataChange
+	for _, section := range []string{"keyslots", "digests", "segments", "tokens", "config"} {
+		diffValues(section, oldTree[section], newTree[section], &changes)
+	}
+	return changes
+}
+
+// metadataTree converts metadata into generic JSON values, a nil snapshot is an empty tree.
+// The metadata is parsed from JSON so marshalling it back cannot fail.
+func metadataTree(m *Metadata) map[string]interface{} {
+	tree := map[string]interface{}{}
+	if m == nil {
+		return tree
+	}
+	data, _ := json.Marshal(&m.meta)
+	_ = json.Unmarshal(data, &tree)
+	return tree
+}
+
+func diffValues(path string, oldVal, newVal interface{}, changes *[]MetadataChange) {
+	oldMap, oldIsMap := oldVal.(map[string]interface{})
+	newMap, newIsMap := newVal.(map[string]interface{})
+	if !oldIsMap || !newIsMap {
+		if !reflect.DeepEqual(oldVal, newVal) {
+			*changes = append(*changes, MetadataChange{Field: path, OldValue: oldVal, NewValue: newVal})
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(oldMap)+len(newMap))
+	for k := range oldMap {
+		keys = append(keys, k)
+	}
+	for k := range newMap {
+		if _, ok := oldMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		o, inOld := oldMap[k]
+		n, inNew := newMap[k]
+		switch {
+		case !inOld:
+			*changes = append(*changes, MetadataChange{Field: path + "." + k, NewValue: n})
+		case !inNew:
+			*changes = append(*changes, MetadataChange{Field: path + "." + k, OldValue: o})
+		default:
+			diffValues(path+"."+k, o, n, changes)
+		}
+	}
+}
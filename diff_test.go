@@ -0,0 +1,54 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetadataDiff(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	_, d := fx.open(t)
+
+	before, err := d.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := Diff(before, before); len(changes) != 0 {
+		t.Fatalf("identical snapshots are expected to have no changes: %+v", changes)
+	}
+
+	ks := d.meta.Keyslots[0]
+	ks.Kdf.Iterations = 2000
+	d.meta.Keyslots[0] = ks
+	d.meta.Keyslots[1] = ks
+	d.meta.Config.Flags = []string{"allow-discards"}
+
+	after, err := d.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := Diff(before, after)
+
+	fields := map[string]MetadataChange{}
+	for _, c := range changes {
+		fields[c.Field] = c
+	}
+	if c, ok := fields["keyslots.0.kdf.iterations"]; !ok || c.OldValue != float64(1000) || c.NewValue != float64(2000) {
+		t.Errorf("iterations change is not reported: %+v", changes)
+	}
+	if c, ok := fields["keyslots.1"]; !ok || c.OldValue != nil || c.NewValue == nil {
+		t.Errorf("keyslot addition is not reported: %+v", changes)
+	}
+	if c, ok := fields["config.flags"]; !ok || c.OldValue != nil || !reflect.DeepEqual(c.NewValue, []interface{}{"allow-discards"}) {
+		t.Errorf("config flags change is not reported: %+v", changes)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changes, got %+v", changes)
+	}
+
+	// the earlier snapshot is not affected by device modifications
+	if changes := Diff(before, before); len(changes) != 0 {
+		t.Fatalf("snapshot is modified: %+v", changes)
+	}
+}
@@ -0,0 +1,120 @@
+package luks
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DigestInfo describes a LUKS2 volume key digest, the parameters allow to re-verify a volume key
+type DigestInfo struct {
+	Type       string // 'pbkdf2'
+	Hash       string
+	Iterations uint
+	Salt       []byte
+	Digest     string // base64 encoded expected digest value
+	Keyslots   []int
+	Segments   []int
+}
+
+// DigestInfo returns parameters of digest `digestIdx`
+func (d *Device) DigestInfo(digestIdx int) (DigestInfo, error) {
+	dig, ok := d.meta.Digests[digestIdx]
+	if !ok {
+		return DigestInfo{}, fmt.Errorf("digest %d is not found", digestIdx)
+	}
+	salt, err := base64.StdEncoding.DecodeString(dig.Salt)
+	if err != nil {
+		return DigestInfo{}, fmt.Errorf("digest[%v].salt base64 parsing failed: %v", digestIdx, err)
+	}
+	info := DigestInfo{
+		Type:       dig.Type,
+		Hash:       dig.Hash,
+		Iterations: dig.Iterations,
+		Salt:       salt,
+		Digest:     dig.Digest,
+	}
+	for _, k := range dig.Keyslots {
+		idx, err := k.Int64()
+		if err != nil {
+			return DigestInfo{}, fmt.Errorf("digest[%v] has invalid keyslot %q", digestIdx, k)
+		}
+		info.Keyslots = append(info.Keyslots, int(idx))
+	}
+	for _, s := range dig.Segments {
+		idx, err := s.Int64()
+		if err != nil {
+			return DigestInfo{}, fmt.Errorf("digest[%v] has invalid segment %q", digestIdx, s)
+		}
+		info.Segments = append(info.Segments, int(idx))
+	}
+	return info, nil
+}
+
+// Verify computes the digest of the volume key and compares it with the base64 encoded `expected` value
+// in constant time
+func (i DigestInfo) Verify(key []byte, expected string) (bool, error) {
+	expectedDigest, err := base64.StdEncoding.DecodeString(expected)
+	if err != nil {
+		return false, fmt.Errorf("digest base64 parsing failed: %v", err)
+	}
+	dig := digest{
+		Type:       i.Type,
+		Hash:       i.Hash,
+		Iterations: i.Iterations,
+		Salt:       base64.StdEncoding.EncodeToString(i.Salt),
+	}
+	generated, err := computeDigestForKey(&dig, AnyKeyslot, key)
+	if err != nil {
+		return false, err
+	}
+	defer clearSlice(generated)
+	return subtle.ConstantTimeCompare(generated, expectedDigest) == 1, nil
+}
+
+// ErrKeyslotWithoutDigest reports a keyslot that is not bound to any digest, such keyslot cannot be unlocked
+type ErrKeyslotWithoutDigest struct {
+	Index int
+}
+
+func (e ErrKeyslotWithoutDigest) Error() string {
+	return fmt.Sprintf("No digest is found for keyslot %v", e.Index)
+}
+
+// Unwrap makes the error match ErrKeyslotCorrupt
+func (e ErrKeyslotWithoutDigest) Unwrap() error {
+	return ErrKeyslotCorrupt
+}
+
+// DigestCoverageError lists all keyslots without digest found by VerifyDigestCoverage
+type DigestCoverageError []ErrKeyslotWithoutDigest
+
+func (e DigestCoverageError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// VerifyDigestCoverage checks that every keyslot is bound to a digest. It returns DigestCoverageError with
+// an entry per uncovered keyslot, erased keyslots are not checked. Management tools can use it to validate
+// metadata before unlocking fails with ErrKeyslotWithoutDigest.
+func (d *Device) VerifyDigestCoverage() error {
+	var missing DigestCoverageError
+	for idx, ks := range d.meta.Keyslots {
+		if ks.Type == erasedKeyslotType {
+			continue
+		}
+		if _, dig := d.findDigestForKeyslot(idx); dig == nil {
+			missing = append(missing, ErrKeyslotWithoutDigest{Index: idx})
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Index < missing[j].Index })
+	return missing
+}
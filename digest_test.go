@@ -0,0 +1,80 @@
+package luks
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDigestInfoVerify(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	_, d := fx.open(t)
+
+	info, err := d.DigestInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != "pbkdf2" || info.Hash != "sha256" || info.Iterations != fixtureIterations || len(info.Salt) == 0 {
+		t.Fatalf("unexpected digest info %+v", info)
+	}
+	if !reflect.DeepEqual(info.Keyslots, []int{0}) || !reflect.DeepEqual(info.Segments, []int{0}) {
+		t.Fatalf("unexpected digest keyslots %v and segments %v", info.Keyslots, info.Segments)
+	}
+
+	if ok, err := info.Verify(fx.volumeKey, info.Digest); err != nil || !ok {
+		t.Fatalf("volume key is expected to match the digest: %v %v", ok, err)
+	}
+	if ok, err := info.Verify(randomBytes(t, 64), info.Digest); err != nil || ok {
+		t.Fatalf("random key is expected to not match the digest: %v %v", ok, err)
+	}
+
+	// the comparison checks whole digest: mismatches at the first and the last byte, and a truncated digest
+	expected, err := base64.StdEncoding.DecodeString(info.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, modify := range []func(b []byte) []byte{
+		func(b []byte) []byte { b[0] ^= 1; return b },
+		func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+		func(b []byte) []byte { return b[:len(b)-1] },
+	} {
+		modified := base64.StdEncoding.EncodeToString(modify(append([]byte(nil), expected...)))
+		if ok, err := info.Verify(fx.volumeKey, modified); err != nil || ok {
+			t.Fatalf("modified digest is expected to not match: %v %v", ok, err)
+		}
+	}
+
+	if _, err := info.Verify(fx.volumeKey, "not base64!"); err == nil {
+		t.Fatal("invalid base64 digest is expected to fail")
+	}
+	if _, err := d.DigestInfo(3); err == nil {
+		t.Fatal("missing digest is expected to fail")
+	}
+}
+
+func TestVerifyDigestCoverage(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	for i := 0; i < 3; i++ {
+		fx.addKeyslot(t, i, "foobar", "aes-xts-plain64")
+	}
+	_, d := fx.open(t)
+
+	if err := d.VerifyDigestCoverage(); err != nil {
+		t.Fatal(err)
+	}
+
+	dig := d.meta.Digests[0]
+	dig.Keyslots = []jsonNumber{"1"}
+	d.meta.Digests[0] = dig
+
+	err := d.VerifyDigestCoverage()
+	var coverage DigestCoverageError
+	if !errors.As(err, &coverage) {
+		t.Fatalf("expected DigestCoverageError, got %v", err)
+	}
+	if !reflect.DeepEqual(coverage, DigestCoverageError{{Index: 0}, {Index: 2}}) {
+		t.Fatalf("unexpected uncovered keyslots %v", coverage)
+	}
+}
@@ -0,0 +1,298 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrDeviceNotActive indicates that there is no active dm-crypt device with the given name
+var ErrDeviceNotActive = fmt.Errorf("dm-crypt device is not active")
+
+// ActiveInfo describes parameters of an active dm-crypt mapping
+type ActiveInfo struct {
+	DevicePath string   // underlying block device, e.g. /dev/loop0
+	CipherSpec string   // kernel cipher spec, e.g. aes-xts-plain64
+	KeySize    int      // volume key size in bytes
+	Offset     uint64   // offset of the encrypted data at the underlying device, in sectors
+	Sectors    uint64   // size of the mapping, in sectors
+	Flags      []string // optional dm-crypt parameters, e.g. allow_discards
+}
+
+// ActiveDeviceInfo returns parameters of the active dm-crypt mapping `dmName`
+func ActiveDeviceInfo(dmName string) (*ActiveInfo, error) {
+	controlFile, err := os.Open("/dev/mapper/control")
+	if err != nil {
+		return nil, err
+	}
+	defer controlFile.Close()
+
+	targets, err := dmTableStatus(controlFile, dmName)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.targetType == "crypt" {
+			return parseCryptTable(t.length, []byte(t.args))
+		}
+	}
+	return nil, ErrDeviceNotActive
+}
+
+// MappingInfo describes an active dm-crypt mapping
+type MappingInfo struct {
+	Name  string
+	UUID  string // device mapper UUID, e.g. 'CRYPT-LUKS2-<luks uuid>-<name>' for devices opened by cryptsetup
+	Table *ActiveInfo
+}
+
+// sysfs directory with block devices that are not backed by hardware, device mapper devices among them
+const sysVirtualBlockDir = "/sys/devices/virtual/block"
+
+// ListActiveMappings returns active device mapper devices with a crypt target, no matter what tool activated
+// them, sorted by name. Devices that are removed while being enumerated are skipped.
+func ListActiveMappings() ([]MappingInfo, error) {
+	dirs, err := filepath.Glob(filepath.Join(sysVirtualBlockDir, "dm-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []MappingInfo
+	for _, dir := range dirs {
+		name, err := ioutil.ReadFile(filepath.Join(dir, "dm", "name"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		uuid, err := ioutil.ReadFile(filepath.Join(dir, "dm", "uuid"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		mapping := MappingInfo{
+			Name: strings.TrimSpace(string(name)),
+			UUID: strings.TrimSpace(string(uuid)),
+		}
+		mapping.Table, err = ActiveDeviceInfo(mapping.Name)
+		if err == ErrDeviceNotActive {
+			continue // not a crypt target or already removed
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", mapping.Name, err)
+		}
+		result = append(result, mapping)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// dmTableStatus returns the table of an active device mapper device. The volume key is removed from
+// crypt targets arguments.
+func dmTableStatus(controlFile *os.File, dmName string) ([]targetSpec, error) {
+	const outSize = 16 * 1024
+	data, err := dmIoctlData(controlFile, unix.DM_TABLE_STATUS, unix.DM_STATUS_TABLE_FLAG|unix.DM_SECURE_DATA_FLAG, dmName, "", nil, outSize)
+	if errors.Is(err, unix.ENXIO) {
+		return nil, ErrDeviceNotActive
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(data) // crypt table contains the volume key
+
+	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+	if ioctlData.Flags&unix.DM_BUFFER_FULL_FLAG != 0 {
+		return nil, fmt.Errorf("dm table of %v does not fit into %v bytes", dmName, outSize)
+	}
+
+	// spec.Next is an offset relative to the start of the data area, see retrieve_status() in the kernel
+	out := data[ioctlData.Data_start:]
+	var targets []targetSpec
+	var next uint32
+	for i := 0; i < int(ioctlData.Target_count); i++ {
+		if int(next)+unix.SizeofDmTargetSpec > len(out) {
+			return nil, fmt.Errorf("malformed dm table status output")
+		}
+		spec := (*unix.DmTargetSpec)(unsafe.Pointer(&out[next]))
+		params := out[int(next)+unix.SizeofDmTargetSpec:]
+		if idx := bytes.IndexByte(params, 0); idx != -1 {
+			params = params[:idx]
+		}
+
+		targetType := fixedArrayToString(spec.Target_type[:])
+		if targetType == "crypt" {
+			params = hideCryptKey(params)
+		}
+		targets = append(targets, targetSpec{
+			sectorStart: spec.Sector_start,
+			length:      spec.Length,
+			targetType:  targetType,
+			args:        string(params),
+		})
+		next = spec.Next
+	}
+	return targets, nil
+}
+
+// SuspendDevice suspends the dm-crypt device `dmName` and wipes its volume key from the kernel memory, similar to
+// `cryptsetup luksSuspend`. All I/O to the device is blocked until it is resumed with ResumeDevice.
+func SuspendDevice(dmName string) error {
+	controlFile, err := os.Open("/dev/mapper/control")
+	if err != nil {
+		return err
+	}
+	defer controlFile.Close()
+
+	_, err = dmIoctlData(controlFile, unix.DM_DEV_SUSPEND, unix.DM_SUSPEND_FLAG|unix.DM_NOFLUSH_FLAG, dmName, "", nil, 0)
+	if errors.Is(err, unix.ENXIO) {
+		return ErrDeviceNotActive
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := dmTargetMessage(controlFile, dmName, "key wipe"); err != nil {
+		// do not leave the device blocked if the key cannot be wiped
+		_ = dmIoctl(controlFile, unix.DM_DEV_SUSPEND, dmName, "", nil)
+		return err
+	}
+	return nil
+}
+
+// ResumeDevice resumes the dm-crypt device suspended with SuspendDevice. As the volume key was wiped at suspend
+// it has to be provided again with `volume`, the volume key is wiped from `volume` afterwards.
+// `volume` can be nil for devices that were suspended without wiping the key.
+func ResumeDevice(dmName string, volume *VolumeInfo) error {
+	controlFile, err := os.Open("/dev/mapper/control")
+	if err != nil {
+		return err
+	}
+	defer controlFile.Close()
+
+	if volume != nil {
+		keyname := fmt.Sprintf("cryptsetup:%s-d%d", dmName, volume.digestId)
+		kid, err := unix.AddKey("logon", keyname, volume.key, unix.KEY_SPEC_THREAD_KEYRING)
+		if err != nil {
+			return err
+		}
+		clearSlice(volume.key)
+		defer unlinkKey(kid)
+
+		if err := dmTargetMessage(controlFile, dmName, fmt.Sprintf("key set :%v:logon:%v", len(volume.key), keyname)); err != nil {
+			return err
+		}
+	}
+
+	err = dmIoctl(controlFile, unix.DM_DEV_SUSPEND, dmName, "", nil)
+	if errors.Is(err, unix.ENXIO) {
+		return ErrDeviceNotActive
+	}
+	return err
+}
+
+// dmTargetMessage sends a message to the target of the device mapper device, e.g. 'key wipe' to dm-crypt.
+// See the TARGET_MSG ioctl in the kernel.
+func dmTargetMessage(controlFile *os.File, dmName string, message string) error {
+	const alignment = 8
+	const sizeofDmTargetMsg = 8 // struct dm_target_msg header, the message follows it
+
+	length := unix.SizeofDmIoctl + sizeofDmTargetMsg + roundUp(len(message)+1, alignment)
+	data := make([]byte, length)
+	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+	ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
+	copy(ioctlData.Name[:], dmName)
+	ioctlData.Data_size = uint32(length)
+	ioctlData.Data_start = unix.SizeofDmIoctl
+
+	msg := (*unix.DmTargetMsg)(unsafe.Pointer(&data[unix.SizeofDmIoctl]))
+	msg.Sector = 0
+	copy(data[unix.SizeofDmIoctl+sizeofDmTargetMsg:], message)
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, controlFile.Fd(), unix.DM_TARGET_MSG, uintptr(unsafe.Pointer(&data[0])))
+	if errno == syscall.ENXIO {
+		return ErrDeviceNotActive
+	}
+	if errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("dm ioctl (cmd=0x%x)", unix.DM_TARGET_MSG), errno)
+	}
+	return nil
+}
+
+// hideCryptKey replaces a hex encoded key in crypt target parameters with ':<size>:hidden:' form.
+// Keyring based keys (':<size>:<type>:<description>') are kept as is.
+func hideCryptKey(params []byte) []byte {
+	fields := bytes.Fields(params)
+	if len(fields) < 2 || bytes.HasPrefix(fields[1], []byte(":")) {
+		return append([]byte(nil), params...)
+	}
+	fields[1] = []byte(fmt.Sprintf(":%v:hidden:", len(fields[1])/2))
+	return bytes.Join(fields, []byte(" "))
+}
+
+// parseCryptTable parses dm-crypt target arguments:
+// <cipher> <key> <iv_offset> <device path> <offset> [<#opt_params> <opt_params>]
+// See https://www.kernel.org/doc/html/latest/admin-guide/device-mapper/dm-crypt.html
+func parseCryptTable(length uint64, params []byte) (*ActiveInfo, error) {
+	fields := bytes.Fields(params)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("invalid dm-crypt table: %q", params)
+	}
+
+	info := &ActiveInfo{
+		CipherSpec: string(fields[0]),
+		Sectors:    length,
+	}
+
+	key := fields[1]
+	if bytes.HasPrefix(key, []byte(":")) {
+		// key is stored in a keyring, format is :<key_size>:<key_type>:<key_description>
+		parts := bytes.SplitN(key[1:], []byte(":"), 2)
+		size, err := strconv.Atoi(string(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dm-crypt key size: %v", err)
+		}
+		info.KeySize = size
+	} else if !bytes.Equal(key, []byte("-")) {
+		info.KeySize = len(key) / 2 // hex encoded key
+	}
+
+	info.DevicePath = resolveBlockDevice(string(fields[3]))
+
+	offset, err := strconv.ParseUint(string(fields[4]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dm-crypt offset: %v", err)
+	}
+	info.Offset = offset
+
+	if len(fields) > 5 {
+		num, err := strconv.Atoi(string(fields[5]))
+		if err != nil || num < 0 || num > len(fields)-6 {
+			return nil, fmt.Errorf("invalid dm-crypt optional parameters: %q", params)
+		}
+		for _, f := range fields[6 : 6+num] {
+			info.Flags = append(info.Flags, string(f))
+		}
+	}
+
+	return info, nil
+}
+
+// resolveBlockDevice converts kernel 'major:minor' device reference into a /dev path if possible
+func resolveBlockDevice(dev string) string {
+	link, err := os.Readlink("/sys/dev/block/" + dev)
+	if err != nil {
+		return dev
+	}
+	return "/dev/" + filepath.Base(link)
+}
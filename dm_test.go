@@ -0,0 +1,187 @@
+package luks
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseCryptTable(t *testing.T) {
+	info, err := parseCryptTable(1953125, []byte("aes-xts-plain64 :64:logon:cryptsetup:8a7ba2d6-d0 0 7:0 32768 2 allow_discards same_cpu_crypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ActiveInfo{
+		DevicePath: info.DevicePath, // depends on the host /sys content
+		CipherSpec: "aes-xts-plain64",
+		KeySize:    64,
+		Offset:     32768,
+		Sectors:    1953125,
+		Flags:      []string{"allow_discards", "same_cpu_crypt"},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, info)
+	}
+
+	info, err = parseCryptTable(100, []byte("aes-xts-plain64 :32:logon:cryptsetup:8a7ba2d6-d0 0 7:0 32768 1 allow_discards"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CipherSpec != "aes-xts-plain64" || info.KeySize != 32 || info.Offset != 32768 || info.Sectors != 100 {
+		t.Fatalf("unexpected parsed info %+v", info)
+	}
+	if !reflect.DeepEqual(info.Flags, []string{"allow_discards"}) {
+		t.Fatalf("unexpected flags %v", info.Flags)
+	}
+
+	if _, err := parseCryptTable(100, []byte("aes-xts-plain64 :64:logon:desc 0 7:0 32768 3 allow_discards")); err == nil {
+		t.Fatal("table with missing optional parameters is expected to fail")
+	}
+	if _, err := parseCryptTable(100, []byte("aes-xts-plain64 :64:logon:desc 0 7:0 32768 -1 allow_discards")); err == nil {
+		t.Fatal("table with negative number of optional parameters is expected to fail")
+	}
+}
+
+func TestHideCryptKey(t *testing.T) {
+	params := hideCryptKey([]byte("aes-xts-plain64 00112233445566778899aabbccddeeff 0 7:0 4096"))
+	if string(params) != "aes-xts-plain64 :16:hidden: 0 7:0 4096" {
+		t.Fatalf("unexpected params %q", params)
+	}
+
+	info, err := parseCryptTable(10, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.KeySize != 16 {
+		t.Fatalf("unexpected key size %v", info.KeySize)
+	}
+}
+
+func TestActivateDMCrypt(t *testing.T) {
+	if _, err := os.Stat("/dev/mapper/control"); err != nil || os.Geteuid() != 0 {
+		t.Skip("device mapper is not available, the test requires root")
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopPath, detach, err := LoopDeviceAttach(disk.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detach()
+
+	const name = "luksgo-activate-test"
+	if err := ActivateDMCrypt(loopPath, volume, name); err != nil {
+		t.Fatal(err)
+	}
+	defer DeactivateDMCrypt(name)
+
+	info, err := ActiveDeviceInfo(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CipherSpec != "aes-xts-plain64" || info.KeySize != 64 || info.Offset != volume.storageOffset {
+		t.Fatalf("unexpected dm-crypt mapping parameters: %+v", info)
+	}
+
+	if err := DeactivateDMCrypt(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ActiveDeviceInfo(name); err != ErrDeviceNotActive {
+		t.Fatalf("expected ErrDeviceNotActive after deactivation, got %v", err)
+	}
+}
+
+func TestListActiveMappings(t *testing.T) {
+	if _, err := os.Stat("/dev/mapper/control"); err != nil || os.Geteuid() != 0 {
+		t.Skip("device mapper is not available, the test requires root")
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopPath, detach, err := LoopDeviceAttach(disk.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detach()
+
+	const name = "luksgo-list-test"
+	if err := ActivateDMCrypt(loopPath, volume, name); err != nil {
+		t.Fatal(err)
+	}
+	defer DeactivateDMCrypt(name)
+
+	mappings, err := ListActiveMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *MappingInfo
+	for i := range mappings {
+		if mappings[i].Name == name {
+			found = &mappings[i]
+		}
+	}
+	if found == nil {
+		t.Fatalf("mapping %v is not listed: %+v", name, mappings)
+	}
+	if found.Table.CipherSpec != "aes-xts-plain64" || found.Table.KeySize != 64 {
+		t.Fatalf("unexpected mapping parameters: %+v", found.Table)
+	}
+}
+
+func TestSuspendResumeDevice(t *testing.T) {
+	if _, err := os.Stat("/dev/mapper/control"); err != nil || os.Geteuid() != 0 {
+		t.Skip("device mapper is not available, the test requires root")
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopPath, detach, err := LoopDeviceAttach(disk.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detach()
+
+	const name = "luksgo-suspend-test"
+	if err := ActivateDMCrypt(loopPath, volume, name); err != nil {
+		t.Fatal(err)
+	}
+	defer DeactivateDMCrypt(name)
+
+	if err := SuspendDevice(name); err != nil {
+		t.Fatal(err)
+	}
+
+	volume, err = d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ResumeDevice(name, volume); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SuspendDevice("luksgo-not-existing"); err != ErrDeviceNotActive {
+		t.Fatalf("expected ErrDeviceNotActive, got %v", err)
+	}
+}
@@ -113,6 +113,14 @@ func luksTestCase(t *testing.T, name string, formatArgs ...string) {
 		}
 		defer luks.Close(name)
 
+		info, err := luks.ActiveDeviceInfo(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.CipherSpec != "aes-xts-plain64" || info.DevicePath != loopDev.Path() {
+			t.Fatalf("unexpected active device info %+v", info)
+		}
+
 		// dm-crypt mount is an asynchronous process, we need to wait a bit until /dev/mapper/ file appears
 		time.Sleep(200 * time.Millisecond)
 
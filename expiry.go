@@ -0,0 +1,126 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// type of the LUKS2 token that stores the keyslot expiry time
+const expiryTokenType = "luks2-expiry"
+
+// ErrKeyslotExpired is returned by UnlockWithExpiryCheck together with the unlocked volume if the passphrase
+// matches a keyslot whose expiry time has passed. It is a warning, the volume is usable.
+type ErrKeyslotExpired struct {
+	Index  int
+	Expiry time.Time
+}
+
+func (e ErrKeyslotExpired) Error() string {
+	return fmt.Sprintf("keyslot %v expired at %v", e.Index, e.Expiry.Format(time.RFC3339))
+}
+
+// ExpireKeyslot sets the expiry time of the keyslot and writes the updated header. The time is stored in
+// a "luks2-expiry" token in RFC 3339 format, an existing expiry of the keyslot is replaced. The keyslot keeps
+// working after the expiry, see CheckKeyslotExpiry and UnlockWithExpiryCheck.
+func ExpireKeyslot(f *os.File, idx int, expiry time.Time) error {
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.meta.Keyslots[idx]; !ok {
+		return fmt.Errorf("keyslot %d is not found", idx)
+	}
+
+	tokenIdx, _, err := d.keyslotExpiry(idx)
+	if err != nil {
+		return err
+	}
+	if tokenIdx == -1 {
+		if tokenIdx, err = d.meta.freeTokenIndex(); err != nil {
+			return err
+		}
+	}
+	d.meta.Tokens[tokenIdx] = token{
+		"type":     expiryTokenType,
+		"keyslots": []interface{}{strconv.Itoa(idx)},
+		"expiry":   expiry.UTC().Format(time.RFC3339),
+	}
+	return d.UpdateHeader(f)
+}
+
+// keyslotExpiry returns the index of the expiry token of the keyslot and the expiry time. The token index
+// is -1 if the keyslot does not expire.
+func (d *Device) keyslotExpiry(keyslotIdx int) (int, time.Time, error) {
+	for idx, tok := range d.meta.Tokens {
+		if tok["type"] != expiryTokenType {
+			continue
+		}
+		keyslots, err := tokenKeyslots(tok)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("token %v: %v", idx, err)
+		}
+		if len(keyslots) != 1 || keyslots[0] != keyslotIdx {
+			continue
+		}
+		value, _ := tok["expiry"].(string)
+		expiry, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("token %v has invalid expiry %q: %v", idx, value, err)
+		}
+		return idx, expiry, nil
+	}
+	return -1, time.Time{}, nil
+}
+
+// CheckKeyslotExpiry returns sorted indexes of keyslots whose expiry time set by ExpireKeyslot has passed
+func CheckKeyslotExpiry(d *Device) ([]int, error) {
+	now := time.Now()
+	var expired []int
+	for idx := range d.meta.Keyslots {
+		tokenIdx, expiry, err := d.keyslotExpiry(idx)
+		if err != nil {
+			return nil, err
+		}
+		if tokenIdx != -1 && !now.Before(expiry) {
+			expired = append(expired, idx)
+		}
+	}
+	sort.Ints(expired)
+	return expired, nil
+}
+
+// UnlockWithExpiryCheck unlocks the volume with the passphrase trying keyslots in the same order as AnyKeyslot.
+// If the matching keyslot is expired the volume is returned together with ErrKeyslotExpired, so the caller may
+// ask the user to change the passphrase. The options are applied the same way as by Unlock.
+func UnlockWithExpiryCheck(f *os.File, passphrase []byte, opts ...Option) (*VolumeInfo, error) {
+	d, err := luks2OpenDevice(f, opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := buildOptions(opts)
+	if err := d.applyOptions(o); err != nil {
+		return nil, err
+	}
+	passphrase, wipe := o.normalizePassphrase(passphrase)
+	defer wipe()
+
+	highPrio, normPrio, _ := d.keyslotsByPriority()
+	volume, k, err := unlockKeyslots(f, d, append(highPrio, normPrio...), passphrase, o)
+	if err != nil {
+		return nil, err
+	}
+	o.warnVolume(volume)
+
+	tokenIdx, expiry, err := d.keyslotExpiry(k)
+	if err != nil {
+		volume.Destroy()
+		return nil, err
+	}
+	if tokenIdx != -1 && !time.Now().Before(expiry) {
+		return volume, ErrKeyslotExpired{Index: k, Expiry: expiry}
+	}
+	return volume, nil
+}
@@ -0,0 +1,105 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyslotExpiry(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	fx.addKeyslot(t, 2, "bazbaz", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := ExpireKeyslot(disk, 0, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// the expiry is replaced
+	if err := ExpireKeyslot(disk, 0, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpireKeyslot(disk, 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpireKeyslot(disk, 5, past); err == nil {
+		t.Fatal("expiry of a missing keyslot is expected to fail")
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.meta.Tokens) != 2 {
+		t.Fatalf("expected 2 expiry tokens, got %v", d.meta.Tokens)
+	}
+	expired, err := CheckKeyslotExpiry(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expired, []int{0}) {
+		t.Fatalf("expected keyslot 0 to be expired, got %v", expired)
+	}
+
+	volume, err := UnlockWithExpiryCheck(disk, []byte("foobar"))
+	expiredErr, ok := err.(ErrKeyslotExpired)
+	if !ok || expiredErr.Index != 0 || !expiredErr.Expiry.Equal(past) {
+		t.Fatalf("expected ErrKeyslotExpired for keyslot 0, got %v", err)
+	}
+	if volume == nil || !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("expired keyslot is expected to unlock the volume")
+	}
+
+	for _, passphrase := range []string{"barfoo", "bazbaz"} {
+		volume, err := UnlockWithExpiryCheck(disk, []byte(passphrase))
+		if err != nil {
+			t.Fatalf("%v: %v", passphrase, err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatal("unlocked volume key does not match")
+		}
+	}
+
+	if _, err := UnlockWithExpiryCheck(disk, []byte("wrong")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+}
+
+func TestUnlockWithExpiryCheckOptions(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "caf\u00e9", "aes-xts-plain64") // composed form
+	fx.addKeyslot(t, 1, "caf\u00e9", "aes-xts-plain64")
+
+	// corrupt keyslot 0 area reference, it points to the data segment now
+	ks := fx.meta.Keyslots[0]
+	ks.Area.Offset = jsonNumber(strconv.Itoa(fixtureDataOffset))
+	fx.meta.Keyslots[0] = ks
+	disk := fx.writeDisk(t)
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := ExpireKeyslot(disk, 1, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UnlockWithExpiryCheck(disk, []byte("caf\u00e9")); err == nil || errors.As(err, &ErrKeyslotExpired{}) {
+		t.Fatalf("corrupted keyslot is expected to abort the unlock by default, got %v", err)
+	}
+	decomposed := []byte("cafe\u0301")
+	if _, err := UnlockWithExpiryCheck(disk, decomposed, WithContinueOnKeyslotError()); errors.As(err, &ErrKeyslotExpired{}) {
+		t.Fatal("decomposed passphrase is not expected to match without normalization")
+	}
+
+	volume, err := UnlockWithExpiryCheck(disk, decomposed, WithContinueOnKeyslotError(), WithPassphraseNormalization(composeAcute{}))
+	expiredErr, ok := err.(ErrKeyslotExpired)
+	if !ok || expiredErr.Index != 1 || !expiredErr.Expiry.Equal(past) {
+		t.Fatalf("expected ErrKeyslotExpired for keyslot 1, got %v", err)
+	}
+	if volume == nil || !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("expired keyslot is expected to unlock the volume")
+	}
+}
@@ -0,0 +1,207 @@
+package luks
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// luks2Fixture builds LUKS2 images in pure Go. It allows to test the unlock path without `cryptsetup`
+// and to craft headers with unusual or corrupted metadata.
+type luks2Fixture struct {
+	hdr         headerV2
+	meta        metadata
+	volumeKey   []byte
+	areas       map[int][]byte // encrypted keyslot areas
+	diskSize    int64
+	nextAreaOff int64
+}
+
+const (
+	fixtureHeaderSize = 16384
+	fixtureDataOffset = 1024 * 1024
+	fixtureIterations = 1000
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newLuks2Fixture(t *testing.T, keySize int) *luks2Fixture {
+	fx := &luks2Fixture{
+		volumeKey:   randomBytes(t, keySize),
+		areas:       make(map[int][]byte),
+		diskSize:    2 * fixtureDataOffset,
+		nextAreaOff: 2 * fixtureHeaderSize,
+	}
+
+	copy(fx.hdr.Magic[:], "LUKS\xba\xbe")
+	fx.hdr.Version = 2
+	fx.hdr.HeaderSize = fixtureHeaderSize
+	fx.hdr.SequenceId = 1
+	copy(fx.hdr.ChecksumAlgorithm[:], "sha256")
+	copy(fx.hdr.UUID[:], "8a7ba2d6-6b5b-4a4b-9b4f-1b1c4aa2f4c3")
+
+	digSalt := randomBytes(t, 32)
+	dig := pbkdf2.Key(fx.volumeKey, digSalt, fixtureIterations, sha256.Size, sha256.New)
+
+	fx.meta = metadata{
+		Keyslots: map[int]keyslot{},
+		Tokens:   map[int]token{},
+		Segments: map[int]segment{
+			0: {
+				Type:       "crypt",
+				Offset:     jsonNumber(strconv.Itoa(fixtureDataOffset)),
+				IvTweak:    "0",
+				Size:       "dynamic",
+				Encryption: "aes-xts-plain64",
+				SectorSize: 512,
+			},
+		},
+		Digests: map[int]digest{
+			0: {
+				Type:       "pbkdf2",
+				Segments:   []jsonNumber{"0"},
+				Hash:       "sha256",
+				Iterations: fixtureIterations,
+				Salt:       base64.StdEncoding.EncodeToString(digSalt),
+				Digest:     base64.StdEncoding.EncodeToString(dig),
+			},
+		},
+		Config: config{
+			JsonSize:     jsonNumber(strconv.Itoa(fixtureHeaderSize - 4096)),
+			KeyslotsSize: jsonNumber(strconv.Itoa(fixtureDataOffset - 2*fixtureHeaderSize)),
+		},
+	}
+
+	return fx
+}
+
+// addKeyslot adds a pbkdf2 based keyslot that stores the fixture volume key encrypted with `encryption` spec
+func (fx *luks2Fixture) addKeyslot(t *testing.T, idx int, passphrase string, encryption string) {
+	keySize := len(fx.volumeKey)
+	salt := randomBytes(t, 32)
+	afKey := pbkdf2.Key([]byte(passphrase), salt, fixtureIterations, keySize, sha256.New)
+
+	split, err := afSplit(fx.volumeKey, stripesNum, sha256.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	areaSize := roundUp(len(split), 4096)
+	areaData := make([]byte, areaSize)
+	copy(areaData, split)
+
+	ciph, err := buildLuks2AfCipher(encryption, afKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < roundUp(len(split), storageSectorSize)/storageSectorSize; i++ {
+		block := areaData[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(block, block, uint64(i))
+	}
+
+	offset := fx.nextAreaOff
+	fx.nextAreaOff += int64(areaSize)
+	fx.areas[idx] = areaData
+
+	fx.meta.Keyslots[idx] = keyslot{
+		Type:    "luks2",
+		KeySize: uint(keySize),
+		Af: antiForensic{
+			Type:    "luks1",
+			Stripes: stripesNum,
+			Hash:    "sha256",
+		},
+		Area: area{
+			Type:       "raw",
+			Encryption: encryption,
+			KeySize:    uint(keySize),
+			Offset:     jsonNumber(strconv.FormatInt(offset, 10)),
+			Size:       jsonNumber(strconv.Itoa(areaSize)),
+		},
+		Kdf: kdf{
+			Type:       "pbkdf2",
+			Salt:       base64.StdEncoding.EncodeToString(salt),
+			Hash:       "sha256",
+			Iterations: fixtureIterations,
+		},
+	}
+
+	dig := fx.meta.Digests[0]
+	dig.Keyslots = append(dig.Keyslots, jsonNumber(strconv.Itoa(idx)))
+	fx.meta.Digests[0] = dig
+}
+
+// headerBytes serializes the binary header followed by the JSON metadata area and computes its checksum
+func (fx *luks2Fixture) headerBytes(t *testing.T, headerOffset uint64) []byte {
+	jsonData, err := json.Marshal(&fx.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := fx.hdr
+	hdr.HeaderOffset = headerOffset
+	data, err := luks2HeaderBytes(&hdr, jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeDisk writes the fixture to a temporary file. The file is closed and removed when the test finishes.
+func (fx *luks2Fixture) writeDisk(t *testing.T) *os.File {
+	disk, err := ioutil.TempFile("", "luksv2.go.fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		disk.Close()
+		os.Remove(disk.Name())
+	})
+
+	if err := disk.Truncate(fx.diskSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := disk.WriteAt(fx.headerBytes(t, 0), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.WriteAt(fx.headerBytes(t, fx.hdr.HeaderSize), int64(fx.hdr.HeaderSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, data := range fx.areas {
+		offset, err := fx.meta.Keyslots[idx].Area.Offset.Int64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := disk.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return disk
+}
+
+// open writes the fixture and opens it as a LUKS2 device
+func (fx *luks2Fixture) open(t *testing.T) (*os.File, *Device) {
+	disk := fx.writeDisk(t)
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return disk, d
+}
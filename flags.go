@@ -0,0 +1,107 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+)
+
+// LUKS2 persistent flag that allows discard (TRIM) requests to be passed through dm-crypt
+const flagAllowDiscards = "allow-discards"
+
+// persistent config.flags and the corresponding dm-crypt optional table parameters, see
+// LUKS2_config_get_flags() in cryptsetup
+var dmCryptFlagNames = map[string]string{
+	flagAllowDiscards:        "allow_discards",
+	"same-cpu-crypt":         "same_cpu_crypt",
+	"submit-from-crypt-cpus": "submit_from_crypt_cpus",
+	"no-read-workqueue":      "no_read_workqueue",
+	"no-write-workqueue":     "no_write_workqueue",
+}
+
+// ConfigInfo describes the LUKS2 'config' section
+type ConfigInfo struct {
+	JsonSize     uint64   // size of the JSON area in bytes
+	KeyslotsSize uint64   // size of the keyslots region in bytes
+	Flags        []string // persistent activation flags, e.g. 'allow-discards'
+	Requirements []string // mandatory requirements, see CheckRequirements
+}
+
+// ConfigInfo returns the parsed 'config' section. Flags known to dm-crypt are applied to the crypt table when
+// the device is activated, other flags (e.g. dm-integrity 'no-journal') are ignored.
+func (d *Device) ConfigInfo() (ConfigInfo, error) {
+	jsonSize, err := d.meta.Config.JsonSize.Int64()
+	if err != nil {
+		return ConfigInfo{}, fmt.Errorf("invalid config.json_size value: %v", err)
+	}
+	keyslotsSize, err := d.meta.Config.KeyslotsSize.Int64()
+	if err != nil {
+		return ConfigInfo{}, fmt.Errorf("invalid config.keyslots_size value: %v", err)
+	}
+
+	info := ConfigInfo{
+		JsonSize:     uint64(jsonSize),
+		KeyslotsSize: uint64(keyslotsSize),
+		Flags:        append([]string(nil), d.meta.Config.Flags...),
+	}
+	if r := d.meta.Config.Requirements; r != nil {
+		info.Requirements = append([]string(nil), r.Mandatory...)
+	}
+	return info, nil
+}
+
+// AllowDiscards reports whether the 'allow-discards' persistent flag is set. If it is set, devices activated by
+// this package pass discard requests to the underlying device.
+func (d *Device) AllowDiscards() bool {
+	return d.meta.hasConfigFlag(flagAllowDiscards)
+}
+
+// SetAllowDiscards sets or clears the 'allow-discards' persistent flag and writes the updated header. Active
+// mappings are not changed, the flag takes effect at the next activation.
+func (d *Device) SetAllowDiscards(f *os.File, allow bool) error {
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	if d.AllowDiscards() == allow {
+		return nil
+	}
+
+	oldFlags := d.meta.Config.Flags
+	var flags []string
+	for _, flag := range oldFlags {
+		if flag != flagAllowDiscards {
+			flags = append(flags, flag)
+		}
+	}
+	if allow {
+		flags = append(flags, flagAllowDiscards)
+	}
+
+	d.meta.Config.Flags = flags
+	if err := d.UpdateHeader(f); err != nil {
+		d.meta.Config.Flags = oldFlags
+		return fmt.Errorf("unable to update allow-discards flag: %v", err)
+	}
+	return nil
+}
+
+// hasConfigFlag checks whether the persistent activation flag is set in config.flags
+func (m *metadata) hasConfigFlag(flag string) bool {
+	for _, f := range m.Config.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// dmCryptFlags converts persistent config.flags to dm-crypt optional parameters in the order they are stored.
+// Flags that do not change the crypt table are skipped.
+func (m *metadata) dmCryptFlags() []string {
+	var result []string
+	for _, f := range m.Config.Flags {
+		if param, ok := dmCryptFlagNames[f]; ok {
+			result = append(result, param)
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetAllowDiscards(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Config.Flags = []string{"no-read-workqueue"}
+	disk, d := fx.open(t)
+
+	if d.AllowDiscards() {
+		t.Fatal("discards are not expected to be allowed")
+	}
+	if err := d.SetAllowDiscards(disk, true); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.AllowDiscards() {
+		t.Fatal("allow-discards flag is not persisted")
+	}
+	if !reflect.DeepEqual(d.meta.Config.Flags, []string{"no-read-workqueue", "allow-discards"}) {
+		t.Fatalf("unexpected flags %v", d.meta.Config.Flags)
+	}
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := cryptTableArgs("/dev/loop0", ":64:logon:key", volume); args != "aes-xts-plain64 :64:logon:key 0 /dev/loop0 2048 2 no_read_workqueue allow_discards" {
+		t.Fatalf("unexpected crypt table arguments %q", args)
+	}
+
+	if err := d.SetAllowDiscards(disk, false); err != nil {
+		t.Fatal(err)
+	}
+	d, err = luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.AllowDiscards() || !reflect.DeepEqual(d.meta.Config.Flags, []string{"no-read-workqueue"}) {
+		t.Fatalf("allow-discards flag is not cleared: %v", d.meta.Config.Flags)
+	}
+}
+
+func TestConfigFlagsToDmCryptOptions(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Config.Flags = []string{"allow-discards", "no-journal", "same-cpu-crypt", "no-write-workqueue"}
+	disk, d := fx.open(t)
+
+	config, err := d.ConfigInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Flags, fx.meta.Config.Flags) || config.KeyslotsSize != fixtureDataOffset-2*fixtureHeaderSize {
+		t.Fatalf("unexpected config info %+v", config)
+	}
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dm-integrity 'no-journal' flag does not belong to the crypt table
+	if !reflect.DeepEqual(volume.storageFlags, []string{"allow_discards", "same_cpu_crypt", "no_write_workqueue"}) {
+		t.Fatalf("unexpected dm-crypt options %v", volume.storageFlags)
+	}
+	if args := cryptTableArgs("/dev/loop0", ":64:logon:key", volume); args != "aes-xts-plain64 :64:logon:key 0 /dev/loop0 2048 3 allow_discards same_cpu_crypt no_write_workqueue" {
+		t.Fatalf("unexpected crypt table arguments %q", args)
+	}
+}
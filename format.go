@@ -0,0 +1,421 @@
+package luks
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/sys/unix"
+)
+
+// LUKS2 layout used by Format, it matches cryptsetup defaults: 16 KiB headers and 16 MiB header area
+const (
+	formatHeaderSize = 16384
+	formatDataOffset = 16 * 1024 * 1024
+	// the volume key digest protects against accidental key mismatch only, a brute force of the volume key is
+	// infeasible. This is the cryptsetup minimum.
+	formatDigestIterations = 1000
+	// keyslot areas are encrypted with AES-256 in XTS mode regardless of the data cipher, its key size
+	// does not have to be accepted by XTS
+	keyslotAreaEncryption = "aes-xts-plain64"
+	keyslotAreaKeySize    = 64
+)
+
+// FormatOptions specify parameters of a new LUKS2 device. Zero values are replaced with defaults.
+type FormatOptions struct {
+	Cipher     string // data encryption, default 'aes-xts-plain64'
+	KeySize    int    // volume key size in bytes, default 64
+	SectorSize int    // encryption sector size, default 512
+
+	KDF        string // keyslot KDF: 'pbkdf2', 'argon2i' or 'argon2id' (default)
+	Iterations uint   // pbkdf2 iterations (default 1000000) or argon2 time cost (default 4)
+	Memory     uint   // argon2 memory cost in KiB, default 1048576
+	Cpus       uint   // argon2 parallelism, default is number of CPUs up to 4
+
+	Label string
+	UUID  string // generated if empty
+
+	Rand io.Reader // source of the volume key, salts, UUID and keyslot area noise, default WithRandomSource or crypto/rand
+}
+
+func (o *FormatOptions) withDefaults() FormatOptions {
+	var res FormatOptions
+	if o != nil {
+		res = *o
+	}
+	if res.Cipher == "" {
+		res.Cipher = "aes-xts-plain64"
+	}
+	if res.KeySize == 0 {
+		res.KeySize = 64
+	}
+	if res.SectorSize == 0 {
+		res.SectorSize = storageSectorSize
+	}
+	if res.KDF == "" {
+		res.KDF = "argon2id"
+	}
+	if res.Iterations == 0 {
+		if res.KDF == "pbkdf2" {
+			res.Iterations = 1000000
+		} else {
+			res.Iterations = 4
+		}
+	}
+	if res.Memory == 0 {
+		res.Memory = 1024 * 1024
+	}
+	if res.Cpus == 0 {
+		res.Cpus = uint(runtime.NumCPU())
+		if res.Cpus > 4 {
+			res.Cpus = 4
+		}
+	}
+	if res.Rand == nil {
+		res.Rand = rand.Reader
+	}
+	return res
+}
+
+// recommended parameters used by WithDefaults, they follow current cryptsetup defaults
+const (
+	recommendedSectorSize   = 4096
+	recommendedArgon2Memory = 64 * 1024 // KiB
+	recommendedUnlockTime   = 2 * time.Second
+	minArgon2Time           = 4 // cryptsetup minimum of argon2 iterations
+)
+
+// WithDefaults returns a copy of the options with unset fields replaced with recommended secure settings:
+// AES-256 in XTS mode over 4096-byte sectors, Argon2id with 64 MiB of memory and the time cost calibrated to
+// take 2 seconds on this machine, and a random UUID. The volume key digest always uses SHA-256.
+// Unlike the zero value defaults used by Format the result is specific to the machine it is computed at.
+func (o *FormatOptions) WithDefaults() (FormatOptions, error) {
+	var res FormatOptions
+	if o != nil {
+		res = *o
+	}
+	if res.Cipher == "" {
+		res.Cipher = "aes-xts-plain64"
+	}
+	if res.KeySize == 0 {
+		res.KeySize = 64 // XTS splits the key in two, this is AES-256
+	}
+	if res.SectorSize == 0 {
+		res.SectorSize = recommendedSectorSize
+	}
+	if res.KDF == "" {
+		res.KDF = "argon2id"
+	}
+	if res.Memory == 0 && res.KDF != "pbkdf2" {
+		res.Memory = recommendedArgon2Memory
+	}
+	calibrate := res.Iterations == 0 && res.KDF != "pbkdf2"
+	res = res.withDefaults()
+	if res.KDF != "pbkdf2" {
+		if res.Cpus > maxArgon2Cpus {
+			return FormatOptions{}, fmt.Errorf("%w: argon2 cpus %v, maximum is %v", ErrKDFParamsTooLarge, res.Cpus, maxArgon2Cpus)
+		}
+		if res.Memory > math.MaxUint32 {
+			return FormatOptions{}, fmt.Errorf("%w: argon2 memory %v KiB, maximum is %v KiB", ErrKDFParamsTooLarge, res.Memory, uint64(math.MaxUint32))
+		}
+	}
+	if calibrate {
+		res.Iterations = calibrateArgon2(res.KDF, res.Memory, res.Cpus, recommendedUnlockTime)
+	}
+	if res.UUID == "" {
+		var err error
+		res.UUID, err = randomUUID(res.Rand)
+		if err != nil {
+			return FormatOptions{}, err
+		}
+	}
+	return res, nil
+}
+
+// calibrateArgon2 returns the Argon2 time cost that makes the key derivation take approximately `target`.
+// The parameters have to fit into the argon2 package types.
+func calibrateArgon2(kdfType string, memory, cpus uint, target time.Duration) uint {
+	password, salt := []byte("benchmark"), make([]byte, 32)
+	start := time.Now()
+	if kdfType == "argon2i" {
+		argon2.Key(password, salt, 1, uint32(memory), uint8(cpus), 32)
+	} else {
+		argon2.IDKey(password, salt, 1, uint32(memory), uint8(cpus), 32)
+	}
+	return argon2TimeCost(target, time.Since(start))
+}
+
+// argon2TimeCost scales the time cost of a single pass that took `elapsed` to `target`
+func argon2TimeCost(target, elapsed time.Duration) uint {
+	if elapsed <= 0 {
+		return minArgon2Time // the timer resolution is too coarse to tell
+	}
+
+	t := uint64(target / elapsed)
+	if t < minArgon2Time {
+		return minArgon2Time
+	}
+	if t > maxArgon2Time {
+		return maxArgon2Time
+	}
+	return uint(t)
+}
+
+// String describes the format parameters, e.g. for logging. Secrets are not part of the options.
+func (o FormatOptions) String() string {
+	kdf := fmt.Sprintf("%v (time %v, memory %v KiB, %v cpus)", o.KDF, o.Iterations, o.Memory, o.Cpus)
+	if o.KDF == "pbkdf2" {
+		kdf = fmt.Sprintf("pbkdf2-sha256 (%v iterations)", o.Iterations)
+	}
+	return fmt.Sprintf("cipher %v, key %v bits, sector size %v, kdf %v, digest pbkdf2-sha256, label %q, uuid %v",
+		o.Cipher, o.KeySize*8, o.SectorSize, kdf, o.Label, o.UUID)
+}
+
+// kdfOptions returns keyslot KDF parameters, the salt is not set
+func (o *FormatOptions) kdfOptions() (KDFOptions, error) {
+	switch o.KDF {
+	case "pbkdf2":
+		return KDFOptions{Type: o.KDF, Hash: "sha256", Iterations: o.Iterations}, nil
+	case "argon2i", "argon2id":
+		return KDFOptions{Type: o.KDF, Time: o.Iterations, Memory: o.Memory, Cpus: o.Cpus}, nil
+	default:
+		return KDFOptions{}, fmt.Errorf("Unknown kdf type: %v", o.KDF)
+	}
+}
+
+// Format creates a new LUKS2 device at `path`, equivalent of `cryptsetup luksFormat --type luks2`.
+// The passphrase is added to keyslot 0. Any existing content of the header area is overwritten, the keyslots region
+// is filled with random data unless WithKeyslotAreaWipe(false) is given.
+func Format(path string, passphrase []byte, opts *FormatOptions, extra ...Option) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return formatFile(f, passphrase, opts, extra...)
+}
+
+// formatFile writes a new LUKS2 header with keyslot 0 to the open device
+func formatFile(f *os.File, passphrase []byte, opts *FormatOptions, extra ...Option) error {
+	x := buildOptions(extra)
+	var fo FormatOptions
+	if opts != nil {
+		fo = *opts
+	}
+	if fo.Rand == nil {
+		fo.Rand = x.rand
+	}
+	o := fo.withDefaults()
+	if o.SectorSize < storageSectorSize || o.SectorSize > 4096 || !isPowerOfTwo(uint(o.SectorSize)) {
+		return fmt.Errorf("invalid sector size %v", o.SectorSize)
+	}
+	if o.KeySize <= 0 {
+		return fmt.Errorf("invalid key size: %v", o.KeySize)
+	}
+	if len(o.Label) >= 48 {
+		return fmt.Errorf("label is too long: %v", o.Label)
+	}
+
+	size, err := deviceSize(f)
+	if err != nil {
+		return err
+	}
+	if size < formatDataOffset+int64(o.SectorSize) {
+		return fmt.Errorf("device %v of size %v is too small for LUKS2, at least %v bytes are required", f.Name(), size, formatDataOffset+o.SectorSize)
+	}
+
+	volumeKey := make([]byte, o.KeySize)
+	if _, err := io.ReadFull(o.Rand, volumeKey); err != nil {
+		return err
+	}
+	defer clearSlice(volumeKey)
+
+	// verify the cipher spec before writing anything
+	if _, err := buildLuks2AfCipher(o.Cipher, volumeKey); err != nil {
+		return err
+	}
+
+	d, err := newLuks2Device(o, volumeKey)
+	if err != nil {
+		return err
+	}
+
+	kdfParams, err := o.kdfOptions()
+	if err != nil {
+		return err
+	}
+
+	if !x.skipKeyslotAreaWipe {
+		if err := wipeKeyslotsRegion(f, o.Rand); err != nil {
+			return err
+		}
+	}
+
+	if err := d.addKeyslot(f, 0, 0, passphrase, volumeKey, kdfParams, o.Rand); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// wipeKeyslotsRegion fills the keyslots region between the secondary header and the data with random bytes
+func wipeKeyslotsRegion(f *os.File, rnd io.Reader) error {
+	return fillRandom(f, 2*formatHeaderSize, formatDataOffset-2*formatHeaderSize, rnd)
+}
+
+// newLuks2Device creates in-memory header and metadata of a new device with a single data segment and
+// a volume key digest
+func newLuks2Device(o FormatOptions, volumeKey []byte) (*Device, error) {
+	var hdr headerV2
+	copy(hdr.Magic[:], "LUKS\xba\xbe")
+	hdr.Version = 2
+	hdr.HeaderSize = formatHeaderSize
+	copy(hdr.ChecksumAlgorithm[:], "sha256")
+	copy(hdr.Label[:], o.Label)
+	if _, err := io.ReadFull(o.Rand, hdr.Salt[:]); err != nil {
+		return nil, err
+	}
+	uuid := o.UUID
+	if uuid == "" {
+		var err error
+		uuid, err = randomUUID(o.Rand)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(uuid) >= len(hdr.UUID) {
+		return nil, fmt.Errorf("UUID is too long: %v", uuid)
+	}
+	copy(hdr.UUID[:], uuid)
+
+	digSalt := make([]byte, 32)
+	if _, err := io.ReadFull(o.Rand, digSalt); err != nil {
+		return nil, err
+	}
+	dig := digest{
+		Type:       "pbkdf2",
+		Keyslots:   []jsonNumber{},
+		Segments:   []jsonNumber{"0"},
+		Hash:       "sha256",
+		Iterations: formatDigestIterations,
+		Salt:       base64.StdEncoding.EncodeToString(digSalt),
+	}
+	digValue, err := computeDigestForKey(&dig, 0, volumeKey)
+	if err != nil {
+		return nil, err
+	}
+	dig.Digest = base64.StdEncoding.EncodeToString(digValue)
+
+	meta := &metadata{
+		Keyslots: map[int]keyslot{},
+		Tokens:   map[int]token{},
+		Segments: map[int]segment{
+			0: {
+				Type:       "crypt",
+				Offset:     jsonNumber(strconv.Itoa(formatDataOffset)),
+				IvTweak:    "0",
+				Size:       "dynamic",
+				Encryption: o.Cipher,
+				SectorSize: uint(o.SectorSize),
+			},
+		},
+		Digests: map[int]digest{0: dig},
+		Config: config{
+			JsonSize:     jsonNumber(strconv.FormatUint(JsonSizeFromHeaderSize(formatHeaderSize), 10)),
+			KeyslotsSize: jsonNumber(strconv.Itoa(formatDataOffset - 2*formatHeaderSize)),
+		},
+	}
+
+	return &Device{hdr: &hdr, meta: meta}, nil
+}
+
+// addKeyslot stores the volume key protected with the passphrase in keyslot `keyslotIdx`, binds the keyslot
+// to digest `digestIdx` and writes the updated header. `kdfParams` salt, the area noise and AF stripes are read from rnd.
+func (d *Device) addKeyslot(f *os.File, keyslotIdx int, digestIdx int, passphrase []byte, volumeKey []byte, kdfParams KDFOptions, rnd io.Reader) error {
+	if _, ok := d.meta.Keyslots[keyslotIdx]; ok {
+		return fmt.Errorf("keyslot %v is already in use", keyslotIdx)
+	}
+	dig, ok := d.meta.Digests[digestIdx]
+	if !ok {
+		return fmt.Errorf("No digest is found for the volume key")
+	}
+
+	offset, size, err := d.newKeyslotArea(f, uint(len(volumeKey)), keyslotAreaEncryption, rnd)
+	if err != nil {
+		return err
+	}
+	defer d.releaseKeyslotArea(offset, size)
+
+	kdfParams.Salt = make([]byte, 32)
+	if _, err := io.ReadFull(rnd, kdfParams.Salt); err != nil {
+		return err
+	}
+
+	ks, err := buildKeyslot(keyslotIdx, &kdfParams,
+		&AreaOptions{Encryption: keyslotAreaEncryption, KeySize: keyslotAreaKeySize, Offset: offset, Size: size},
+		&AFOptions{KeySize: uint(len(volumeKey)), Stripes: stripesNum, Hash: "sha256"})
+	if err != nil {
+		return err
+	}
+
+	afKey, err := deriveLuks2AfKey(ks.Kdf, keyslotIdx, passphrase, ks.Area.KeySize)
+	if err != nil {
+		return err
+	}
+	defer afKey.Destroy()
+
+	areaData, err := encryptLuks2VolumeKey(volumeKey, ks, afKey.Bytes(), int(size), rnd)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(areaData)
+	if _, err := f.WriteAt(areaData, int64(offset)); err != nil {
+		return err
+	}
+
+	d.meta.Keyslots[keyslotIdx] = ks
+	oldKeyslots := dig.Keyslots
+	dig.Keyslots = append(append([]jsonNumber(nil), oldKeyslots...), jsonNumber(strconv.Itoa(keyslotIdx)))
+	d.meta.Digests[digestIdx] = dig
+	if err := d.UpdateHeader(f); err != nil {
+		delete(d.meta.Keyslots, keyslotIdx)
+		dig.Keyslots = oldKeyslots
+		d.meta.Digests[digestIdx] = dig
+		return err
+	}
+	return nil
+}
+
+// deviceSize returns size of a block device or a regular file
+func deviceSize(f *os.File) (int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st.Mode()&os.ModeDevice == 0 {
+		return st.Size(), nil
+	}
+	s, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKGETSIZE64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(s), nil
+}
+
+// randomUUID generates a random (version 4) UUID
+func randomUUID(rnd io.Reader) (string, error) {
+	var u [16]byte
+	if _, err := io.ReadFull(rnd, u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
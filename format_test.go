@@ -0,0 +1,289 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFormatOptions uses cheap KDF parameters to keep the tests fast
+var testFormatOptions = &FormatOptions{KDF: "pbkdf2", Iterations: 1000}
+
+// tempDisk creates a sparse file of the given size, it is removed when the test finishes
+func tempDisk(t *testing.T, size int64) string {
+	disk, err := ioutil.TempFile("", "luks.go.format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(disk.Name()) })
+	defer disk.Close()
+	if err := disk.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return disk.Name()
+}
+
+func TestFormat(t *testing.T) {
+	path := tempDisk(t, 32*1024*1024)
+
+	opts := *testFormatOptions
+	opts.Label = "test label"
+	if err := Format(path, []byte("foobar"), &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	report, err := HeaderConsistency(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent {
+		t.Fatalf("formatted header copies are inconsistent: %+v", report)
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label, err := d.Label(); err != nil || label != "test label" {
+		t.Fatalf("unexpected label %q, %v", label, err)
+	}
+	if err := d.meta.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volume.key) != 64 || volume.storageEncryption != "aes-xts-plain64" || volume.storageOffset != formatDataOffset/512 {
+		t.Fatalf("unexpected volume parameters: %+v", volume)
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("wrong")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+}
+
+func TestFormatArgon2(t *testing.T) {
+	path := tempDisk(t, 32*1024*1024)
+
+	opts := &FormatOptions{KDF: "argon2id", Iterations: 1, Memory: 32, Cpus: 1, Cipher: "aes-cbc-essiv:sha256", KeySize: 32}
+	if err := Format(path, []byte("foobar"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.unlockAnyKeyslot(disk, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keyslot area uses XTS even if the data cipher key is not a valid XTS key
+func TestFormatCBCShortKey(t *testing.T) {
+	for _, keySize := range []int{16, 24} {
+		path := tempDisk(t, 32*1024*1024)
+
+		opts := *testFormatOptions
+		opts.Cipher = "aes-cbc-plain"
+		opts.KeySize = keySize
+		if err := Format(path, []byte("foobar"), &opts); err != nil {
+			t.Fatalf("key size %v: %v", keySize, err)
+		}
+
+		disk, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer disk.Close()
+		d, err := luks2OpenDevice(disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks := d.meta.Keyslots[0]; ks.Area.KeySize != keyslotAreaKeySize || ks.KeySize != uint(keySize) {
+			t.Fatalf("unexpected key sizes: area %v, volume %v", ks.Area.KeySize, ks.KeySize)
+		}
+		volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(volume.key) != keySize {
+			t.Fatalf("unexpected volume key size %v", len(volume.key))
+		}
+	}
+}
+
+func TestFormatInvalidParameters(t *testing.T) {
+	path := tempDisk(t, 1024*1024)
+
+	if err := Format(path, []byte("foobar"), testFormatOptions); err == nil {
+		t.Fatal("device smaller than the LUKS2 header area is expected to be rejected")
+	}
+
+	path = tempDisk(t, 32*1024*1024)
+	opts := *testFormatOptions
+	opts.Cipher = "foo-xts-plain64"
+	if err := Format(path, []byte("foobar"), &opts); err == nil {
+		t.Fatal("unknown cipher is expected to be rejected")
+	}
+}
+
+func TestFormatKeyslotAreaWipe(t *testing.T) {
+	for _, wipe := range []bool{true, false} {
+		path := tempDisk(t, 32*1024*1024)
+
+		if err := Format(path, []byte("foobar"), testFormatOptions, WithKeyslotAreaWipe(wipe)); err != nil {
+			t.Fatal(err)
+		}
+		disk, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer disk.Close()
+		d, err := luks2OpenDevice(disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the region past the keyslot 0 area is not used by any keyslot
+		offset, size, err := d.keyslotArea(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unused := make([]byte, formatDataOffset-offset-size)
+		if _, err := disk.ReadAt(unused, offset+size); err != nil {
+			t.Fatal(err)
+		}
+		if zeroed := bytes.Equal(unused, make([]byte, len(unused))); zeroed == wipe {
+			t.Fatalf("wipe=%v: unexpected content of the unused keyslots region, zeroed=%v", wipe, zeroed)
+		}
+	}
+}
+
+func TestFormatDeterministicRand(t *testing.T) {
+	format := func(option bool) ([]byte, *VolumeInfo) {
+		path := tempDisk(t, 32*1024*1024)
+
+		opts := *testFormatOptions
+		var extra []Option
+		if option {
+			extra = append(extra, WithRandomSource(mrand.New(mrand.NewSource(1))))
+		} else {
+			opts.Rand = mrand.New(mrand.NewSource(1))
+		}
+		if err := Format(path, []byte("foobar"), &opts, extra...); err != nil {
+			t.Fatal(err)
+		}
+		disk, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer disk.Close()
+		d, err := luks2OpenDevice(disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, formatDataOffset)
+		if _, err := disk.ReadAt(header, 0); err != nil {
+			t.Fatal(err)
+		}
+		return header, volume
+	}
+
+	header1, volume1 := format(false)
+	// WithRandomSource is used when FormatOptions.Rand is not set
+	header2, volume2 := format(true)
+	if !bytes.Equal(volume1.key, volume2.key) {
+		t.Fatal("the same random source is expected to generate the same volume key")
+	}
+	// UUID, salts, keyslot area and the noise of the keyslots region
+	if !bytes.Equal(header1, header2) {
+		t.Fatal("the same random source is expected to produce identical headers")
+	}
+
+	d, err := luks2OpenDevice(bytes.NewReader(header1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid := d.uuid(); uuid != "6325253f-ec73-4dd7-a9e2-8bf921119c16" {
+		t.Fatalf("unexpected UUID %v", uuid)
+	}
+}
+
+func TestFormatOptionsWithDefaults(t *testing.T) {
+	var opts *FormatOptions
+	o, err := opts.WithDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Cipher != "aes-xts-plain64" || o.KeySize != 64 || o.SectorSize != 4096 || o.KDF != "argon2id" || o.Memory != 64*1024 {
+		t.Fatalf("unexpected defaults: %v", o)
+	}
+	if o.Iterations < minArgon2Time || o.Cpus == 0 {
+		t.Fatalf("argon2 parameters are not set: %v", o)
+	}
+	if len(o.UUID) != 36 || o.UUID[14] != '4' {
+		t.Fatalf("expected a random version 4 UUID, got %q", o.UUID)
+	}
+	if s := o.String(); !strings.Contains(s, "argon2id") || !strings.Contains(s, o.UUID) {
+		t.Fatalf("unexpected description %q", s)
+	}
+
+	// explicitly set values are kept
+	o, err = (&FormatOptions{KDF: "pbkdf2", Iterations: 1000, SectorSize: 512, Label: "data"}).WithDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.KDF != "pbkdf2" || o.Iterations != 1000 || o.SectorSize != 512 || o.Label != "data" {
+		t.Fatalf("explicit options are overridden: %v", o)
+	}
+
+	// the UUID comes from the configured random source
+	o, err = (&FormatOptions{KDF: "pbkdf2", Iterations: 1000, Rand: mrand.New(mrand.NewSource(1))}).WithDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.UUID != "52fdfc07-2182-454f-963f-5f0f9a621d72" {
+		t.Fatalf("UUID is not generated from the random source: %v", o.UUID)
+	}
+
+	if _, err := (&FormatOptions{Cpus: 256}).WithDefaults(); !errors.Is(err, ErrKDFParamsTooLarge) {
+		t.Fatalf("expected ErrKDFParamsTooLarge for 256 cpus, got %v", err)
+	}
+}
+
+func TestArgon2TimeCost(t *testing.T) {
+	if c := argon2TimeCost(2*time.Second, 0); c != minArgon2Time {
+		t.Fatalf("unmeasurable pass is expected to use the minimum time cost, got %v", c)
+	}
+	if c := argon2TimeCost(2*time.Second, 100*time.Millisecond); c != 20 {
+		t.Fatalf("unexpected time cost %v", c)
+	}
+	if c := argon2TimeCost(2*time.Second, time.Second); c != minArgon2Time {
+		t.Fatalf("time cost is expected to be at least %v, got %v", minArgon2Time, c)
+	}
+	if c := argon2TimeCost(time.Hour, time.Nanosecond); c != maxArgon2Time {
+		t.Fatalf("time cost is expected to be at most %v, got %v", maxArgon2Time, c)
+	}
+}
@@ -0,0 +1,72 @@
+// Package hibp checks passphrases against the HaveIBeenPwned breach database. It is kept out of the luks package
+// so programs that do not use it, e.g. initramfs tools, do not link the HTTP client.
+package hibp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/anatol/luks.go"
+)
+
+// rangeURL is the HaveIBeenPwned range API endpoint, tests point it to a local server
+var rangeURL = "https://api.pwnedpasswords.com/range/"
+
+// Check checks whether the passphrase appears in the HaveIBeenPwned breach database. It uses the k-anonymity
+// range API: only the first 5 hex characters of the passphrase SHA-1 are sent over HTTPS, the match against
+// the returned suffixes is done locally. http.DefaultClient is used if client is nil, the request is bound
+// to ctx.
+func Check(ctx context.Context, client *http.Client, passphrase []byte) (bool, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	sum := sha1.Sum(passphrase)
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rangeURL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// the response is padded with fake entries so its size does not reveal the prefix
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HaveIBeenPwned request failed: %v", resp.Status)
+	}
+
+	// every line has format 'SUFFIX:COUNT', padding entries have zero count
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		// the suffix is derived from the passphrase
+		if subtle.ConstantTimeCompare([]byte(strings.ToUpper(parts[0])), []byte(suffix)) == 1 {
+			return parts[1] != "0", nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// UpdateReport sets report.IsBreached to the result of Check for the passphrase the report was computed for
+func UpdateReport(ctx context.Context, client *http.Client, passphrase []byte, report *luks.QualityReport) error {
+	breached, err := Check(ctx, client, passphrase)
+	if err != nil {
+		return err
+	}
+	report.IsBreached = breached
+	return nil
+}
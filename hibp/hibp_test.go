@@ -0,0 +1,74 @@
+package hibp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+func TestCheck(t *testing.T) {
+	// sha1("password") = 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		fmt.Fprint(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n")
+		fmt.Fprint(w, "2DC183F740EE76F27B78EB39C8AD972A757:0\r\n")
+	}))
+	defer server.Close()
+	defer func(url string) { rangeURL = url }(rangeURL)
+	rangeURL = server.URL + "/range/"
+
+	breached, err := Check(context.Background(), nil, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !breached {
+		t.Fatal("passphrase is expected to be found")
+	}
+	if requested != "/range/5BAA6" {
+		t.Fatalf("only the hash prefix is expected to be sent, got %v", requested)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	breached, err = Check(context.Background(), client, []byte("correct horse battery staple 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breached {
+		t.Fatal("passphrase is not expected to be found")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Check(ctx, nil, []byte("password")); err == nil {
+		t.Fatal("request with a canceled context is expected to fail")
+	}
+}
+
+func TestUpdateReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n")
+	}))
+	defer server.Close()
+	defer func(url string) { rangeURL = url }(rangeURL)
+	rangeURL = server.URL + "/range/"
+
+	report, err := luks.PasswordQualityCheck([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.IsBreached {
+		t.Fatal("offline quality check is not expected to report breaches")
+	}
+	if err := UpdateReport(context.Background(), nil, []byte("password"), report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsBreached {
+		t.Fatal("passphrase is expected to be reported as breached")
+	}
+}
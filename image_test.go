@@ -0,0 +1,87 @@
+package luks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNewLUKS2Image(t *testing.T) {
+	const size = 17 * 1024 * 1024
+	buf, err := NewLUKS2Image(size, []byte("foobar"), testFormatOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != size {
+		t.Fatalf("expected image of size %v, got %v", size, buf.Len())
+	}
+
+	img := NewImageFile(buf)
+	if version, ok := IsLUKS(img); !ok || version != 2 {
+		t.Fatalf("expected a LUKS2 image, got version %v", version)
+	}
+	d, err := luks2OpenDevice(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.meta.Keyslots) != 1 {
+		t.Fatalf("expected 1 keyslot, got %v", len(d.meta.Keyslots))
+	}
+
+	volume, err := Unlock(img, AnyKeyslot, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volume.key) != 64 {
+		t.Fatalf("unexpected volume key size %v", len(volume.key))
+	}
+	if volume.storageSize != (size-formatDataOffset)/storageSectorSize {
+		t.Fatalf("unexpected dynamic segment size %v", volume.storageSize)
+	}
+	r, err := NewReaderAt(img, volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(make([]byte, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unlock(img, AnyKeyslot, []byte("wrong")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+
+	if _, err := NewLUKS2Image(formatDataOffset, []byte("foobar"), testFormatOptions); err == nil {
+		t.Fatal("image without space for data is expected to fail")
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	img := NewImageFile(bytes.NewBuffer(make([]byte, 8)))
+
+	if _, err := img.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("xyz"), 6); err == nil {
+		t.Fatal("write beyond the end of the image is expected to fail")
+	}
+	if off, err := img.Seek(-2, io.SeekEnd); err != nil || off != 6 {
+		t.Fatalf("unexpected seek result %v: %v", off, err)
+	}
+	if _, err := img.Write([]byte("de")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("abc\x00\x00\x00de")) {
+		t.Fatalf("unexpected image content %q", data)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+package luks
+
+import (
+	"io"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// DeviceInfo contains non-sensitive information from a LUKS header
+type DeviceInfo struct {
+	Version int
+	UUID    string
+
+	// LUKS2 only fields, empty for LUKS1 devices
+	Label             string
+	SubsystemLabel    string
+	HeaderSize        uint64 // size of the binary header and JSON area, in bytes
+	SequenceId        uint64
+	ChecksumAlgorithm string
+
+	KeyslotCount   int   // number of keyslots in the metadata, including LUKS2 'reencrypt' keyslots
+	ActiveKeyslots []int // sorted indexes of keyslots that can be unlocked with a passphrase
+	SegmentCount   int
+	TokenCount     int
+	Encryption     string // data encryption spec of the first segment, e.g. 'aes-xts-plain64'
+}
+
+// LUKSInfo reads the LUKS header at `path` and returns information about the device, the file is closed before
+// the function returns. It is similar to `cryptsetup luksDump` without keyslot details.
+func LUKSInfo(path string) (*DeviceInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	version, err := readLuksVersion(f)
+	if err != nil {
+		return nil, err
+	}
+	luks, err := luksOpen(version, f)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d := luks.(type) {
+	case *luks1Device:
+		return d.info(), nil
+	case *Device:
+		return d.info()
+	default:
+		panic("unexpected LUKS device type")
+	}
+}
+
+func (d *luks1Device) info() *DeviceInfo {
+	info := &DeviceInfo{
+		Version:      1,
+		UUID:         d.uuid(),
+		SegmentCount: 1,
+		Encryption:   fixedArrayToString(d.hdr.CipherName[:]) + "-" + fixedArrayToString(d.hdr.CipherMode[:]),
+	}
+	for i, s := range d.hdr.KeySlots {
+		if s.Active == luksKeyEnabled {
+			info.ActiveKeyslots = append(info.ActiveKeyslots, i)
+		}
+	}
+	info.KeyslotCount = len(info.ActiveKeyslots)
+	return info
+}
+
+func (d *Device) info() (*DeviceInfo, error) {
+	label, err := d.Label()
+	if err != nil {
+		return nil, err
+	}
+	subsystem, err := d.SubsystemLabel()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DeviceInfo{
+		Version:           2,
+		UUID:              d.uuid(),
+		Label:             label,
+		SubsystemLabel:    subsystem,
+		HeaderSize:        d.hdr.HeaderSize,
+		SequenceId:        d.hdr.SequenceId,
+		ChecksumAlgorithm: fixedArrayToString(d.hdr.ChecksumAlgorithm[:]),
+		KeyslotCount:      len(d.meta.Keyslots),
+		SegmentCount:      len(d.meta.Segments),
+		TokenCount:        len(d.meta.Tokens),
+	}
+	for idx, ks := range d.meta.Keyslots {
+		if ks.Type == "luks2" {
+			info.ActiveKeyslots = append(info.ActiveKeyslots, idx)
+		}
+	}
+	sort.Ints(info.ActiveKeyslots)
+
+	first := -1
+	for idx := range d.meta.Segments {
+		if first == -1 || idx < first {
+			first = idx
+		}
+	}
+	if first != -1 {
+		info.Encryption = d.meta.Segments[first].Encryption
+	}
+	return info, nil
+}
+
+// ReadUUID returns the UUID stored in the LUKS header reading only the magic, the version and the UUID field.
+// The header checksum and metadata are not verified. LUKS1 and LUKS2 headers store the UUID at the same offset.
+// ErrNotLUKS is returned if the magic does not match.
+func ReadUUID(f *os.File) (string, error) {
+	if _, err := readLuksVersion(f); err != nil {
+		return "", err
+	}
+
+	var hdr headerV2
+	uuid := hdr.UUID[:]
+	if _, err := f.ReadAt(uuid, int64(unsafe.Offsetof(hdr.UUID))); err == io.EOF {
+		return "", ErrNotLUKS // device is too small to contain a header
+	} else if err != nil {
+		return "", err
+	}
+	return fixedArrayToString(uuid), nil
+}
@@ -0,0 +1,78 @@
+package luks
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestLUKSInfo(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 3, "barfoo", "aes-xts-plain64")
+	copy(fx.hdr.Label[:], "mylabel")
+	fx.meta.Tokens[0] = token{"type": "systemd-tpm2", "keyslots": []interface{}{"0"}}
+	disk := fx.writeDisk(t)
+	disk.Close()
+
+	info, err := LUKSInfo(disk.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &DeviceInfo{
+		Version:           2,
+		UUID:              fixedArrayToString(fx.hdr.UUID[:]),
+		Label:             "mylabel",
+		HeaderSize:        fixtureHeaderSize,
+		SequenceId:        fx.hdr.SequenceId,
+		ChecksumAlgorithm: "sha256",
+		KeyslotCount:      2,
+		ActiveKeyslots:    []int{0, 3},
+		SegmentCount:      1,
+		TokenCount:        1,
+		Encryption:        "aes-xts-plain64",
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("unexpected device info:\n  got %+v\n want %+v", info, expected)
+	}
+}
+
+func TestLUKSInfoNotLUKS(t *testing.T) {
+	disk := tempDisk(t, 4096)
+
+	if _, err := LUKSInfo(disk); err != ErrNotLUKS {
+		t.Fatalf("expected ErrNotLUKS, got %v", err)
+	}
+}
+
+func TestReadUUID(t *testing.T) {
+	var v1 headerV1
+	var v2 headerV2
+	if unsafe.Offsetof(v1.UUID) != unsafe.Offsetof(v2.UUID) {
+		t.Fatal("LUKS1 and LUKS2 headers store UUID at different offsets")
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	// the checksum is not verified
+	if _, err := disk.WriteAt(make([]byte, 64), int64(unsafe.Offsetof(v2.Checksum))); err != nil {
+		t.Fatal(err)
+	}
+
+	uuid, err := ReadUUID(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fixedArrayToString(fx.hdr.UUID[:]); uuid != expected {
+		t.Fatalf("expected UUID %v, got %v", expected, uuid)
+	}
+
+	if _, err := disk.WriteAt([]byte("SKUL"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadUUID(disk); err != ErrNotLUKS {
+		t.Fatalf("expected ErrNotLUKS, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+// Package crypto contains cryptographic primitives shared by the LUKS implementations
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+)
+
+// hash algorithms by their cryptsetup names
+var hashes = map[string]func() hash.Hash{
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// GetHashFunc returns the hash factory and digest size in bytes for the hash algorithm name used in LUKS
+// headers, e.g. 'sha256'
+func GetHashFunc(name string) (func() hash.Hash, int, error) {
+	h, ok := hashes[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown hash algorithm: %v", name)
+	}
+	return h, h().Size(), nil
+}
@@ -0,0 +1,20 @@
+package crypto
+
+import "testing"
+
+func TestGetHashFunc(t *testing.T) {
+	sizes := map[string]int{"sha224": 28, "sha256": 32, "sha384": 48, "sha512": 64}
+	for name, size := range sizes {
+		h, s, err := GetHashFunc(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != size || h().Size() != size {
+			t.Errorf("%v: expected digest size %v, got %v", name, size, s)
+		}
+	}
+
+	if _, _, err := GetHashFunc("md5"); err == nil {
+		t.Fatal("expected an error for an unknown hash")
+	}
+}
@@ -1,6 +1,150 @@
 package luks
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// jsonNumber is an integer encoded as a JSON string. LUKS2 stores offsets, sizes and indexes as strings
+// because JSON numbers cannot precisely represent 64-bit values. Unquoted numbers are accepted on input as well.
+type jsonNumber string
+
+func (n jsonNumber) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+func (n jsonNumber) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(n))
+}
+
+func (n *jsonNumber) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*n = jsonNumber(s)
+		return nil
+	}
+
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*n = jsonNumber(num)
+	return nil
+}
+
+// unmarshalMetadata parses LUKS2 JSON metadata. Keyslots, segments, digests and tokens are JSON objects keyed by
+// decimal strings that do not have to be contiguous. Unlike encoding/json the function rejects objects with
+// duplicate keys as otherwise one of the entries is silently dropped.
+func unmarshalMetadata(data []byte, meta *metadata) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := checkDuplicateKeys(dec, "metadata"); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return err
+	}
+	// the tokens object is optional, functions that add tokens expect the map to exist
+	if meta.Tokens == nil {
+		meta.Tokens = map[int]token{}
+	}
+	return nil
+}
+
+// JSON object keys used by pre-release LUKS2 implementations and their final names
+var legacyMetadataKeys = map[string]string{
+	"key_slots":      "keyslots",
+	"key_slots_size": "keyslots_size",
+}
+
+// convertLegacyMetadata renames keys of pre-release LUKS2 metadata to their final names at any nesting level.
+// A key present under both names is rejected as the entries could disagree.
+func convertLegacyMetadata(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keep unquoted numbers as they are
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	if err := renameLegacyKeys(tree); err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+func renameLegacyKeys(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for legacy, name := range legacyMetadataKeys {
+			val, ok := v[legacy]
+			if !ok {
+				continue
+			}
+			if _, ok := v[name]; ok {
+				return fmt.Errorf("JSON object has both %q and legacy %q keys", name, legacy)
+			}
+			delete(v, legacy)
+			v[name] = val
+		}
+		for _, val := range v {
+			if err := renameLegacyKeys(val); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if err := renameLegacyKeys(val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDuplicateKeys reads a JSON value from the decoder and returns an error if any object within it
+// has duplicate keys. `path` is used in the error message.
+func checkDuplicateKeys(dec *json.Decoder, path string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil // scalar value
+	}
+
+	switch delim {
+	case '{':
+		keys := make(map[string]bool)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+			if keys[key] {
+				return fmt.Errorf("duplicate key %q in JSON object %v", key, path)
+			}
+			keys[key] = true
+			if err := checkDuplicateKeys(dec, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			if err := checkDuplicateKeys(dec, fmt.Sprintf("%v[%v]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = dec.Token() // closing delimiter
+	return err
+}
 
 type keyslot struct {
 	Type     string       `json:"type"`
@@ -8,7 +152,11 @@ type keyslot struct {
 	Af       antiForensic `json:"af"`
 	Area     area         `json:"area"`
 	Kdf      kdf          `json:"kdf"`
-	Priority string       `json:"priority"` // it is actually a number, but we need to distinguish '0' (ignore), from absence of the field (normal priority)
+	Priority jsonNumber   `json:"priority,omitempty"` // empty if the field is absent (normal priority), we need to distinguish it from '0' (ignore)
+
+	// 'reencrypt' keyslot specific fields
+	Mode      string `json:"mode,omitempty"`
+	Direction string `json:"direction,omitempty"`
 }
 
 type antiForensic struct {
@@ -18,11 +166,11 @@ type antiForensic struct {
 }
 
 type area struct {
-	Type       string      `json:"type"`
-	Encryption string      `json:"encryption"`
-	KeySize    uint        `json:"key_size"`
-	Offset     json.Number `json:"offset"`
-	Size       json.Number `json:"size"`
+	Type       string     `json:"type"`
+	Encryption string     `json:"encryption"`
+	KeySize    uint       `json:"key_size"`
+	Offset     jsonNumber `json:"offset"`
+	Size       jsonNumber `json:"size"`
 }
 
 type kdf struct {
@@ -30,41 +178,56 @@ type kdf struct {
 	Salt string `json:"salt"`
 
 	// pbkdf2 specific fields
-	Hash       string `json:"hash"`
-	Iterations uint   `json:"iterations"`
+	Hash       string `json:"hash,omitempty"`
+	Iterations uint   `json:"iterations,omitempty"`
 
 	// argon2i fields
-	Time   uint `json:"time"`
-	Memory uint `json:"memory"`
-	Cpus   uint `json:"cpus"`
+	Time   uint `json:"time,omitempty"`
+	Memory uint `json:"memory,omitempty"`
+	Cpus   uint `json:"cpus,omitempty"`
 }
 
 type token map[string]interface{}
 
 type segment struct {
-	Type       string      `json:"type"`
-	Offset     json.Number `json:"offset"`
-	IvTweak    json.Number `json:"iv_tweak"`
-	Size       string      `json:"size"` // either 'dynamic' or uint
-	Encryption string      `json:"encryption"`
-	SectorSize uint        `json:"sector_size"`
+	Type       string     `json:"type"`
+	Offset     jsonNumber `json:"offset"`
+	IvTweak    jsonNumber `json:"iv_tweak"`
+	Size       string     `json:"size"` // either 'dynamic' or uint
+	Encryption string     `json:"encryption"`
+	SectorSize uint       `json:"sector_size"`
+	Flags      []string   `json:"flags,omitempty"` // e.g. 'in-reencryption' or 'backup-previous'
+
+	Integrity *segmentIntegrity `json:"integrity,omitempty"` // authenticated encryption with dm-integrity
+}
+
+type segmentIntegrity struct {
+	Type              string `json:"type"` // integrity algorithm, e.g. 'hmac(sha256)' or 'aead'
+	JournalEncryption string `json:"journal_encryption"`
+	JournalIntegrity  string `json:"journal_integrity"`
+	KeySize           uint   `json:"key_size,omitempty"` // integrity key size, written by cryptsetup 2.7+
+	TagSize           uint   `json:"tag_size,omitempty"`
 }
 
 type digest struct {
-	Type       string        `json:"type"`
-	Keyslots   []json.Number `json:"keyslots"`
-	Segments   []json.Number `json:"segments"`
-	Hash       string        `json:"hash"`
-	Iterations uint          `json:"iterations"`
-	Salt       string        `json:"salt"`
-	Digest     string        `json:"digest"`
+	Type       string       `json:"type"`
+	Keyslots   []jsonNumber `json:"keyslots"`
+	Segments   []jsonNumber `json:"segments"`
+	Hash       string       `json:"hash"`
+	Iterations uint         `json:"iterations"`
+	Salt       string       `json:"salt"`
+	Digest     string       `json:"digest"`
 }
 
 type config struct {
-	JsonSize     json.Number `json:"json_size"`
-	KeyslotsSize json.Number `json:"keyslots_size"`
-	Flags        []string    `json:"flags"`
-	Requirements []string    `json:"requirements"`
+	JsonSize     jsonNumber    `json:"json_size"`
+	KeyslotsSize jsonNumber    `json:"keyslots_size"`
+	Flags        []string      `json:"flags,omitempty"`
+	Requirements *requirements `json:"requirements,omitempty"`
+}
+
+type requirements struct {
+	Mandatory []string `json:"mandatory,omitempty"`
 }
 
 type metadata struct {
@@ -1,8 +1,11 @@
 package luks
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -27,3 +30,114 @@ func TestParseMetadata(t *testing.T) {
 	parseMetadata(t, "testdata/metadata/1.json")
 	parseMetadata(t, "testdata/metadata/2.json")
 }
+
+func TestParseMetadataNumericPriority(t *testing.T) {
+	data := []byte(`{
+		"keyslots": {
+			"0": {"type": "luks2", "key_size": 32, "priority": 0},
+			"1": {"type": "luks2", "key_size": 32, "priority": "2"},
+			"2": {"type": "luks2", "key_size": 32},
+			"3": {"type": "luks2", "key_size": 32, "priority": 2},
+			"4": {"type": "luks2", "key_size": 32, "priority": 1}
+		},
+		"tokens": {},
+		"segments": {},
+		"digests": {},
+		"config": {"json_size": "12288", "keyslots_size": "16744448"}
+	}`)
+
+	var meta metadata
+	if err := unmarshalMetadata(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	d := &Device{meta: &meta}
+	highPrio, normPrio, ignored := d.keyslotsByPriority()
+	if !reflect.DeepEqual(highPrio, []int{1, 3}) || !reflect.DeepEqual(normPrio, []int{2, 4}) || !reflect.DeepEqual(ignored, []int{0}) {
+		t.Fatalf("unexpected keyslot priorities: high %v, normal %v, ignored %v", highPrio, normPrio, ignored)
+	}
+}
+
+func TestParseMetadataNonContiguousKeys(t *testing.T) {
+	data := []byte(`{
+		"keyslots": {
+			"0": {"type": "luks2", "key_size": 32, "area": {"type": "raw", "offset": "32768", "size": "258048", "encryption": "aes-xts-plain64", "key_size": 32}},
+			"2": {"type": "luks2", "key_size": 64, "area": {"type": "raw", "offset": "290816", "size": "258048", "encryption": "aes-xts-plain64", "key_size": 64}},
+			"5": {"type": "luks2", "key_size": 16, "area": {"type": "raw", "offset": "548864", "size": "258048", "encryption": "aes-xts-plain64", "key_size": 16}}
+		},
+		"tokens": {},
+		"segments": {"3": {"type": "crypt", "offset": "16777216", "size": "dynamic", "iv_tweak": 0, "encryption": "aes-xts-plain64", "sector_size": 512}},
+		"digests": {"7": {"type": "pbkdf2", "keyslots": ["0", "2", "5"], "segment": ["3"], "hash": "sha256", "iterations": 1000, "salt": "", "digest": ""}},
+		"config": {"json_size": "12288", "keyslots_size": "16744448"}
+	}`)
+
+	var meta metadata
+	if err := unmarshalMetadata(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedKeySizes := map[int]uint{0: 32, 2: 64, 5: 16}
+	if len(meta.Keyslots) != len(expectedKeySizes) {
+		t.Fatalf("expected %v keyslots, got %v", len(expectedKeySizes), len(meta.Keyslots))
+	}
+	for idx, size := range expectedKeySizes {
+		k, ok := meta.Keyslots[idx]
+		if !ok {
+			t.Fatalf("keyslot %v is missing", idx)
+		}
+		if k.KeySize != size {
+			t.Fatalf("keyslot %v: expected key size %v, got %v", idx, size, k.KeySize)
+		}
+	}
+	if _, ok := meta.Segments[3]; !ok {
+		t.Fatal("segment 3 is missing")
+	}
+	if offset, err := meta.Segments[3].IvTweak.Int64(); err != nil || offset != 0 {
+		t.Fatalf("unquoted iv_tweak is expected to be parsed, got %v %v", offset, err)
+	}
+	if _, ok := meta.Digests[7]; !ok {
+		t.Fatal("digest 7 is missing")
+	}
+	if err := meta.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlockNonContiguousKeyslots(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	// layout after 'cryptsetup luksKillSlot 0' of a device with keyslots 0, 2 and 5
+	fx.addKeyslot(t, 2, "barfoo", "aes-xts-plain64")
+	fx.addKeyslot(t, 5, "bazbaz", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	for idx, passphrase := range map[int]string{2: "barfoo", 5: "bazbaz"} {
+		volume, err := d.unlockKeyslot(disk, idx, []byte(passphrase))
+		if err != nil {
+			t.Fatalf("keyslot %v: %v", idx, err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatalf("keyslot %v: unlocked volume key does not match", idx)
+		}
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("barfoo")); err == nil {
+		t.Fatal("unlocking a removed keyslot is expected to fail")
+	}
+}
+
+func TestParseMetadataDuplicateKeys(t *testing.T) {
+	data := []byte(`{
+		"keyslots": {
+			"0": {"type": "luks2", "key_size": 32},
+			"0": {"type": "luks2", "key_size": 64}
+		},
+		"tokens": {}, "segments": {}, "digests": {}, "config": {}
+	}`)
+
+	var meta metadata
+	err := unmarshalMetadata(data, &meta)
+	if err == nil {
+		t.Fatal("metadata with duplicate keyslot keys is expected to be rejected")
+	}
+	if !strings.Contains(err.Error(), "metadata.keyslots") {
+		t.Fatalf("error is expected to point to the duplicate key location: %v", err)
+	}
+}
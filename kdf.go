@@ -0,0 +1,121 @@
+package luks
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrKDFParamsTooLarge indicates that keyslot KDF parameters exceed the configured limits. Such parameters either
+// come from a maliciously crafted header or require more resources than the process is allowed to use.
+var ErrKDFParamsTooLarge = fmt.Errorf("KDF parameters are too large")
+
+// ErrKDFMemoryExceedsAvailable indicates that the Argon2 memory cost of a keyslot is larger than the memory
+// currently available in the system. The derivation is refused as it would likely end up with an OOM kill.
+var ErrKDFMemoryExceedsAvailable = fmt.Errorf("KDF memory cost exceeds available memory")
+
+// maximum number of CPUs Argon2 KDF is allowed to use, zero means no limit. Accessed atomically as the limits
+// may be changed while UnlockAll workers derive keys.
+var maxKDFCPUs uint64
+
+// maximum Argon2 memory cost in KiB, zero means no limit. Accessed atomically.
+var maxArgon2Memory uint64 = 1024 * 1024
+
+const (
+	maxArgon2Time = 1 << 24
+	// golang.org/x/crypto/argon2 takes parallelism as uint8
+	maxArgon2Cpus = 255
+)
+
+// SetMaxKDFCPUs limits the number of CPUs Argon2 key derivation may use when unlocking a keyslot. A value
+// less or equal to zero removes the limit.
+//
+// Argon2 parallelism (the 'cpus' keyslot parameter) is an input of the algorithm: deriving the key with a lower
+// number of lanes produces a different key. Thus keyslots that request more CPUs than the limit are refused
+// with an error instead of being silently derived with a lower parallelism. The stored metadata is not changed.
+func SetMaxKDFCPUs(n int) {
+	if n <= 0 {
+		atomic.StoreUint64(&maxKDFCPUs, 0)
+	} else {
+		atomic.StoreUint64(&maxKDFCPUs, uint64(n))
+	}
+}
+
+// SetMaxArgon2Memory limits the memory Argon2 key derivation may allocate when unlocking a keyslot, it protects
+// against out-of-memory with crafted headers. Keyslots that request more memory are refused with
+// ErrKDFParamsTooLarge. The default limit is 1024 MiB, zero removes the limit.
+func SetMaxArgon2Memory(maxMiB uint64) {
+	atomic.StoreUint64(&maxArgon2Memory, maxMiB*1024)
+}
+
+// checkArgon2Params verifies that Argon2 parameters of the keyslot are within the configured limits
+func checkArgon2Params(kdf kdf, keyslotIdx int) error {
+	if maxCPUs := atomic.LoadUint64(&maxKDFCPUs); maxCPUs != 0 && uint64(kdf.Cpus) > maxCPUs {
+		return fmt.Errorf("%w: keyslotIdx[%v].kdf.cpus %v exceeds the configured limit of %v CPUs", ErrKDFParamsTooLarge, keyslotIdx, kdf.Cpus, maxCPUs)
+	}
+	if kdf.Cpus > maxArgon2Cpus {
+		return fmt.Errorf("%w: keyslotIdx[%v].kdf.cpus %v, maximum is %v", ErrKDFParamsTooLarge, keyslotIdx, kdf.Cpus, maxArgon2Cpus)
+	}
+	if kdf.Time > maxArgon2Time {
+		return fmt.Errorf("%w: keyslotIdx[%v].kdf.time %v, maximum is %v", ErrKDFParamsTooLarge, keyslotIdx, kdf.Time, maxArgon2Time)
+	}
+	memoryLimit := uint64(math.MaxUint32) // argon2 takes the memory cost as uint32
+	if maxMemory := atomic.LoadUint64(&maxArgon2Memory); maxMemory != 0 && maxMemory < memoryLimit {
+		memoryLimit = maxMemory
+	}
+	if uint64(kdf.Memory) > memoryLimit {
+		return fmt.Errorf("%w: keyslotIdx[%v].kdf.memory %v KiB, maximum is %v KiB", ErrKDFParamsTooLarge, keyslotIdx, kdf.Memory, memoryLimit)
+	}
+	// if the available memory cannot be determined let the kernel decide
+	if available, err := availableMemory(); err == nil && uint64(kdf.Memory)*1024 > available {
+		return fmt.Errorf("%w: keyslotIdx[%v].kdf.memory %v KiB, available %v KiB", ErrKDFMemoryExceedsAvailable, keyslotIdx, kdf.Memory, available/1024)
+	}
+	return nil
+}
+
+// availableMemory returns the amount of memory in bytes that can be allocated without swapping. It is a variable
+// so tests can simulate low memory systems.
+var availableMemory = func() (uint64, error) {
+	if available, err := readMemAvailable("/proc/meminfo"); err == nil {
+		return available, nil
+	}
+
+	// kernels older than 3.14 do not report MemAvailable
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	return (uint64(info.Freeram) + uint64(info.Bufferram)) * uint64(info.Unit), nil
+}
+
+// readMemAvailable parses 'MemAvailable' field of /proc/meminfo
+func readMemAvailable(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemAvailable:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%v: invalid MemAvailable value %q", path, fields[1])
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%v: MemAvailable is not found", path)
+}
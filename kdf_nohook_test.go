@@ -0,0 +1,30 @@
+//go:build !luks_test
+// +build !luks_test
+
+package luks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestProductionBuildIgnoresTestKDF(t *testing.T) {
+	if _, ok := testKDFOverride([]byte("foobar"), []byte("salt"), 32); ok {
+		t.Fatal("KDF override is enabled in a production build")
+	}
+
+	salt := []byte("0123456789abcdef")
+	k := kdf{Type: "pbkdf2", Hash: "sha256", Iterations: 1000, Salt: base64.StdEncoding.EncodeToString(salt)}
+	key, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Destroy()
+	if !bytes.Equal(key.Bytes(), pbkdf2.Key([]byte("foobar"), salt, 1000, 32, sha256.New)) {
+		t.Fatal("keyslot key is not derived with the keyslot KDF")
+	}
+}
@@ -0,0 +1,169 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetMaxKDFCPUs(t *testing.T) {
+	defer SetMaxKDFCPUs(0)
+
+	k := kdf{
+		Type:   "argon2id",
+		Salt:   base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		Time:   1,
+		Memory: 32,
+		Cpus:   4,
+	}
+
+	SetMaxKDFCPUs(2)
+	if _, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32); !errors.Is(err, ErrKDFParamsTooLarge) {
+		t.Fatalf("keyslot requesting more CPUs than the limit is expected to fail with ErrKDFParamsTooLarge, got %v", err)
+	}
+
+	SetMaxKDFCPUs(4)
+	if _, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32); err != nil {
+		t.Fatal(err)
+	}
+
+	SetMaxKDFCPUs(0)
+	if _, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// limits may be changed while other goroutines derive keys, run with -race
+func TestKDFLimitsConcurrentAccess(t *testing.T) {
+	defer SetMaxKDFCPUs(0)
+	defer SetMaxArgon2Memory(1024)
+
+	k := kdf{Type: "argon2id", Time: 1, Memory: 32, Cpus: 1}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			SetMaxKDFCPUs(i % 4)
+			SetMaxArgon2Memory(uint64(1024 + i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := checkArgon2Params(k, 0); err != nil && !errors.Is(err, ErrKDFMemoryExceedsAvailable) {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestArgon2ParamsLimits(t *testing.T) {
+	defer SetMaxArgon2Memory(1024)
+
+	salt := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name string
+		kdf  kdf
+	}{
+		{"memory", kdf{Type: "argon2id", Salt: salt, Time: 1, Memory: 2 * 1024 * 1024, Cpus: 1}},
+		{"memory overflow", kdf{Type: "argon2i", Salt: salt, Time: 1, Memory: 1<<32 + 32, Cpus: 1}},
+		{"time", kdf{Type: "argon2id", Salt: salt, Time: 1<<24 + 1, Memory: 32, Cpus: 1}},
+		{"cpus", kdf{Type: "argon2i", Salt: salt, Time: 1, Memory: 32 * 1024, Cpus: 256}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := deriveLuks2AfKey(test.kdf, 0, []byte("foobar"), 32); !errors.Is(err, ErrKDFParamsTooLarge) {
+				t.Fatalf("expected ErrKDFParamsTooLarge, got %v", err)
+			}
+		})
+	}
+
+	k := kdf{Type: "argon2id", Salt: salt, Time: 1, Memory: 64, Cpus: 1}
+	SetMaxArgon2Memory(0)
+	if _, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32); err != nil {
+		t.Fatal(err)
+	}
+	// without the guard the limit is the maximum argon2 memory cost
+	if err := checkArgon2Params(tests[1].kdf, 0); err == nil || !strings.Contains(err.Error(), "maximum is 4294967295 KiB") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestArgon2MemoryExceedsAvailable(t *testing.T) {
+	if _, err := readMemAvailable("/proc/meminfo"); err != nil {
+		t.Skipf("/proc/meminfo does not report available memory: %v", err)
+	}
+
+	defer func(f func() (uint64, error)) { availableMemory = f }(availableMemory)
+	availableMemory = func() (uint64, error) { return 128 * 1024, nil } // 128 KiB
+
+	salt := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	k := kdf{Type: "argon2id", Salt: salt, Time: 1, Memory: 256, Cpus: 1}
+	if _, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32); !errors.Is(err, ErrKDFMemoryExceedsAvailable) {
+		t.Fatalf("expected ErrKDFMemoryExceedsAvailable, got %v", err)
+	}
+
+	k.Memory = 64
+	if _, err := deriveLuks2AfKey(k, 0, []byte("foobar"), 32); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArgon2ParallelismOverride(t *testing.T) {
+	path := tempDisk(t, 32*1024*1024)
+
+	opts := &FormatOptions{KDF: "argon2id", Iterations: 1, Memory: 32, Cpus: 2}
+	if err := Format(path, []byte("foobar"), opts); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := d.meta.Keyslots[0]
+	stored, err := deriveLuks2AfKey(d.keyslotKdf(ks), 0, []byte("foobar"), ks.Area.KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Destroy()
+
+	if err := d.applyOptions(buildOptions([]Option{WithArgon2Parallelism(1)})); err != nil {
+		t.Fatal(err)
+	}
+	overridden, err := deriveLuks2AfKey(d.keyslotKdf(ks), 0, []byte("foobar"), ks.Area.KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overridden.Destroy()
+	if bytes.Equal(stored.Bytes(), overridden.Bytes()) {
+		t.Fatal("parallelism override is expected to change the derived key")
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("wrong parallelism is expected to cause a digest mismatch, got %v", err)
+	}
+	if diag, err := d.VerifyKeyslotArea(disk, 0, []byte("foobar")); err != nil || diag.DigestMatch {
+		t.Fatalf("verification is expected to use the overridden parallelism, got %+v, %v", diag, err)
+	}
+
+	// the stored parallelism is the correct one
+	if err := d.applyOptions(buildOptions([]Option{WithArgon2Parallelism(2)})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+	if diag, err := d.VerifyKeyslotArea(disk, 0, []byte("foobar")); err != nil || !diag.DigestMatch {
+		t.Fatalf("keyslot that unlocks is expected to verify, got %+v, %v", diag, err)
+	}
+
+	if err := d.applyOptions(buildOptions([]Option{WithArgon2Parallelism(1000)})); !errors.Is(err, ErrKDFParamsTooLarge) {
+		t.Fatalf("expected ErrKDFParamsTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build luks_test
+// +build luks_test
+
+package luks
+
+import "sync/atomic"
+
+// TestKDFFunc derives a keyslot key from the passphrase and the keyslot salt
+type TestKDFFunc func(passphrase, salt []byte, keyLength uint) []byte
+
+var testKDF atomic.Value // TestKDFFunc
+
+// SetTestKDF replaces the keyslot KDF with `f` for all keyslots, both on unlock and when keyslots are added.
+// It lets test suites use fixtures with expensive Argon2 parameters without paying the derivation cost.
+// A nil `f` restores the real KDF. The function is available only in builds with 'luks_test' tag, keyslots
+// created with a test KDF cannot be unlocked by other LUKS implementations.
+func SetTestKDF(f TestKDFFunc) {
+	testKDF.Store(f)
+}
+
+func testKDFOverride(passphrase, salt []byte, keyLength uint) ([]byte, bool) {
+	f, _ := testKDF.Load().(TestKDFFunc)
+	if f == nil {
+		return nil, false
+	}
+	return f(passphrase, salt, keyLength), true
+}
@@ -0,0 +1,50 @@
+//go:build luks_test
+// +build luks_test
+
+package luks
+
+import (
+	"crypto/sha256"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestSetTestKDF(t *testing.T) {
+	SetTestKDF(func(passphrase, salt []byte, keyLength uint) []byte {
+		return pbkdf2.Key(passphrase, salt, 1, int(keyLength), sha256.New)
+	})
+	defer SetTestKDF(nil)
+
+	disk := tempDisk(t, 17*1024*1024)
+
+	// default Argon2 parameters take seconds and 1 GiB of memory per derivation without the hook
+	start := time.Now()
+	if err := Format(disk, []byte("foobar"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.meta.Keyslots[0].Kdf.Type != "argon2id" {
+		t.Fatalf("unexpected kdf %v", d.meta.Keyslots[0].Kdf.Type)
+	}
+	if _, err := d.unlockKeyslot(f, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.unlockKeyslot(f, 0, []byte("wrong")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("test KDF is expected to be fast, took %v", elapsed)
+	}
+}
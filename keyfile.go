@@ -0,0 +1,28 @@
+package luks
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadKeyFromFD reads key material from the file descriptor fd, an equivalent of `cryptsetup --key-fd`.
+// At most maxLen bytes are read, if maxLen <= 0 then the key is read until EOF.
+// The descriptor is left open, the caller stays responsible for it.
+func ReadKeyFromFD(fd int, maxLen int) ([]byte, error) {
+	// os.File closes its descriptor when garbage collected, work with a duplicate to keep `fd` open
+	dupFd, err := unix.Dup(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	f := os.NewFile(uintptr(dupFd), "keyfd")
+	defer f.Close()
+
+	var r io.Reader = f
+	if maxLen > 0 {
+		r = io.LimitReader(f, int64(maxLen))
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,38 @@
+package luks
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReadKeyFromFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := w.Write([]byte("secret key material")); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ReadKeyFromFD(int(r.Fd()), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, []byte("secret")) {
+		t.Fatalf("unexpected key %q", key)
+	}
+
+	w.Close()
+
+	// descriptor is still open and the rest of the data is read until EOF
+	key, err = ReadKeyFromFD(int(r.Fd()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, []byte(" key material")) {
+		t.Fatalf("unexpected key %q", key)
+	}
+}
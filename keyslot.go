@@ -0,0 +1,546 @@
+package luks
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anatol/luks.go/internal/crypto"
+)
+
+// encryptLuks2VolumeKey splits the volume key into anti-forensic stripes and encrypts them with the keyslot
+// area cipher. It is the reverse operation of decryptLuks2VolumeKey. The result is padded to areaSize.
+// Random stripes are read from rnd, crypto/rand is used if rnd is nil.
+func encryptLuks2VolumeKey(volumeKey []byte, keyslot keyslot, afKey []byte, areaSize int, rnd io.Reader) ([]byte, error) {
+	af := keyslot.Af
+	if err := af.validate(); err != nil {
+		return nil, err
+	}
+	afHash, err := luks2AfHash(af.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	split, err := afSplit(volumeKey, int(af.Stripes), afHash, rnd)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(split)
+
+	// the material is padded to the sector boundary, the same way as cryptsetup does
+	keyslotSize := roundUp(len(split), storageSectorSize)
+	if keyslotSize > areaSize {
+		return nil, fmt.Errorf("keyslot area size too small, given %v expected at least %v", areaSize, keyslotSize)
+	}
+
+	ciph, err := buildLuks2AfCipher(keyslot.Area.Encryption, afKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, areaSize)
+	copy(data, split)
+	for i := 0; i < keyslotSize/storageSectorSize; i++ {
+		block := data[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(block, block, uint64(i))
+	}
+	return data, nil
+}
+
+// ChangeKeyslotEncryption re-encrypts the keyslot key material with a different cipher spec, e.g. from
+// 'aes-xts-plain64' to 'aes-xts-essiv:sha256'. The key material is written to a newly allocated area with
+// a fresh KDF salt, then the metadata is updated and the old area is overwritten with random data.
+// The area key keeps its size unless WithKeyslotKeySize is given, the new cipher must accept keys of that size.
+// The random source for the salt, the area noise and the AF stripes can be set with WithRandomSource.
+func (d *Device) ChangeKeyslotEncryption(f *os.File, keyslotIdx int, passphrase []byte, newEncryption string, opts ...Option) error {
+	o := buildOptions(opts)
+	rnd := o.randomSource()
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	keySize := ks.Area.KeySize
+	if o.keyslotKeySize > 0 {
+		keySize = uint(o.keyslotKeySize)
+	}
+	// check the cipher accepts the key size before anything is written
+	if _, err := buildLuks2AfCipher(newEncryption, make([]byte, keySize)); err != nil {
+		return fmt.Errorf("keyslot encryption %v with %v bytes key: %v", newEncryption, keySize, err)
+	}
+
+	volume, err := d.unlockKeyslot(f, keyslotIdx, passphrase)
+	if err != nil {
+		return err
+	}
+	defer volume.Destroy()
+
+	oldOffset, oldSize, err := d.keyslotArea(keyslotIdx)
+	if err != nil {
+		return err
+	}
+
+	// the area holds the anti-forensic split volume key, it has to fit the area key size as well
+	areaKeySize := ks.KeySize
+	if keySize > areaKeySize {
+		areaKeySize = keySize
+	}
+	offset, size, err := d.newKeyslotArea(f, areaKeySize, newEncryption, rnd)
+	if err != nil {
+		return err
+	}
+	defer d.releaseKeyslotArea(offset, size)
+
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rnd, salt); err != nil {
+		return err
+	}
+
+	// deep copy the keyslot so the in-memory metadata stays intact until the area is written
+	var newKs keyslot
+	ksData, err := json.Marshal(ks)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(ksData, &newKs); err != nil {
+		return err
+	}
+	newKs.Kdf.Salt = base64.StdEncoding.EncodeToString(salt)
+	newKs.Area.Encryption = newEncryption
+	newKs.Area.KeySize = keySize
+	newKs.Area.Offset = jsonNumber(strconv.FormatUint(offset, 10))
+	newKs.Area.Size = jsonNumber(strconv.FormatUint(size, 10))
+
+	afKey, err := deriveLuks2AfKey(newKs.Kdf, keyslotIdx, passphrase, newKs.Area.KeySize)
+	if err != nil {
+		return err
+	}
+	defer afKey.Destroy()
+
+	areaData, err := encryptLuks2VolumeKey(volume.key, newKs, afKey.Bytes(), int(size), rnd)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(areaData)
+
+	// verify the new area before switching the metadata to it
+	check, err := decryptLuks2VolumeKey(append([]byte(nil), areaData...), keyslotIdx, newKs, afKey.Bytes())
+	if err != nil {
+		return err
+	}
+	defer clearSlice(check)
+	if subtle.ConstantTimeCompare(check, volume.key) != 1 {
+		return fmt.Errorf("keyslot %v verification with the new encryption failed", keyslotIdx)
+	}
+
+	if _, err := f.WriteAt(areaData, int64(offset)); err != nil {
+		return err
+	}
+
+	d.meta.Keyslots[keyslotIdx] = newKs
+	if err := d.UpdateHeader(f); err != nil {
+		d.meta.Keyslots[keyslotIdx] = ks
+		return err
+	}
+
+	if err := fillRandom(f, uint64(oldOffset), uint64(oldSize), rnd); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// maximum number of LUKS2 keyslots, see LUKS2_KEYSLOTS_MAX in cryptsetup
+const maxKeyslots = 32
+
+// AddKeyslotOptions specify parameters of a keyslot added with AddKeyslotWithKey. Zero KDF values are replaced with
+// the same defaults as in FormatOptions.
+type AddKeyslotOptions struct {
+	KDF        string // 'pbkdf2', 'argon2i' or 'argon2id' (default)
+	Iterations uint   // pbkdf2 iterations or argon2 time cost
+	Memory     uint   // argon2 memory cost in KiB
+	Cpus       uint   // argon2 parallelism
+
+	ClearKey bool // zero the volume key passed to AddKeyslotWithKey on return
+
+	Rand io.Reader // source of the KDF salt, keyslot area noise and AF stripes, default WithRandomSource or crypto/rand
+}
+
+// AddKeyslotWithKey adds a keyslot for `newPassphrase` to the first free keyslot index using the volume key
+// of an already unlocked device, see VolumeInfo.VolumeKey, thus no existing passphrase is needed. The key is verified against the device
+// digests before anything is written. It returns the index of the new keyslot.
+func (d *Device) AddKeyslotWithKey(f *os.File, volumeKey, newPassphrase []byte, opts *AddKeyslotOptions, extra ...Option) (int, error) {
+	if opts != nil && opts.ClearKey {
+		defer clearSlice(volumeKey)
+	}
+	if err := d.CheckRequirements(); err != nil {
+		return 0, err
+	}
+
+	digestIdx := -1
+	for idx := range d.meta.Digests {
+		info, err := d.DigestInfo(idx)
+		if err != nil {
+			return 0, err
+		}
+		match, err := info.Verify(volumeKey, info.Digest)
+		if err != nil {
+			return 0, fmt.Errorf("digest[%v]: %v", idx, err)
+		}
+		if match {
+			digestIdx = idx
+			break
+		}
+	}
+	if digestIdx == -1 {
+		return 0, fmt.Errorf("volume key does not match any digest")
+	}
+
+	keyslotIdx := -1
+	for i := 0; i < maxKeyslots; i++ {
+		if _, ok := d.meta.Keyslots[i]; !ok {
+			keyslotIdx = i
+			break
+		}
+	}
+	if keyslotIdx == -1 {
+		return 0, fmt.Errorf("all %v keyslots are in use", maxKeyslots)
+	}
+
+	var fo FormatOptions
+	if opts != nil {
+		fo = FormatOptions{KDF: opts.KDF, Iterations: opts.Iterations, Memory: opts.Memory, Cpus: opts.Cpus, Rand: opts.Rand}
+	}
+	if fo.Rand == nil {
+		fo.Rand = buildOptions(extra).rand
+	}
+	o := fo.withDefaults()
+	kdfParams, err := o.kdfOptions()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.addKeyslot(f, keyslotIdx, digestIdx, newPassphrase, volumeKey, kdfParams, o.Rand); err != nil {
+		return 0, err
+	}
+	return keyslotIdx, nil
+}
+
+// type of a keyslot erased with EraseKeyslotArea
+const erasedKeyslotType = "luks2-invalid"
+
+// EraseKeyslotArea destroys the keyslot key material by overwriting its area with random bytes and marks
+// the keyslot as erased with "luks2-invalid" type. Unlike removing the keyslot the JSON entry is preserved
+// for accounting, the keyslot index stays occupied and the keyslot cannot be unlocked anymore.
+// The random source can be set with WithRandomSource.
+func (d *Device) EraseKeyslotArea(f *os.File, keyslotIdx int, opts ...Option) error {
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	if ks.Type == erasedKeyslotType {
+		return fmt.Errorf("keyslot %d is already erased", keyslotIdx)
+	}
+	offset, size, err := d.keyslotArea(keyslotIdx)
+	if err != nil {
+		return err
+	}
+
+	if err := fillRandom(f, uint64(offset), uint64(size), buildOptions(opts).randomSource()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	erased := ks
+	erased.Type = erasedKeyslotType
+	d.meta.Keyslots[keyslotIdx] = erased
+	if err := d.UpdateHeader(f); err != nil {
+		d.meta.Keyslots[keyslotIdx] = ks
+		return err
+	}
+	return nil
+}
+
+// KeyslotAfHash returns the hash algorithm used by the anti-forensic splitter of the keyslot
+func (d *Device) KeyslotAfHash(keyslotIdx int) (string, error) {
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return "", fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	return ks.Af.Hash, nil
+}
+
+// ValidateHashConsistency checks that the anti-forensic hash of every keyslot matches the hash of the digest
+// the keyslot is bound to. Tools create both with the same hash, a mismatch usually comes from manually edited
+// metadata. An error is returned per inconsistent keyslot, nil means the metadata is consistent.
+func (d *Device) ValidateHashConsistency() []error {
+	indexes := make([]int, 0, len(d.meta.Keyslots))
+	for idx := range d.meta.Keyslots {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	var errs []error
+	for _, idx := range indexes {
+		ks := d.meta.Keyslots[idx]
+		digIdx, dig := d.findDigestForKeyslot(idx)
+		if dig == nil {
+			continue // a keyslot without digest (e.g. reencryption keyslot) has nothing to compare with
+		}
+		if !strings.EqualFold(ks.Af.Hash, dig.Hash) {
+			errs = append(errs, fmt.Errorf("keyslot %v af hash %v does not match digest %v hash %v", idx, ks.Af.Hash, digIdx, dig.Hash))
+		}
+	}
+	return errs
+}
+
+// KeyslotEncryption returns cipher, chaining mode and IV generator of the keyslot area encryption
+func (d *Device) KeyslotEncryption(keyslotIdx int) (cipher, mode, iv string, err error) {
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return "", "", "", fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	return ParseEncryption(ks.Area.Encryption)
+}
+
+// KeyslotPriority is the LUKS2 keyslot 'priority' field. Keyslots are tried in the order of priority when
+// unlocking with AnyKeyslot, disabled keyslots are used only when requested explicitly.
+type KeyslotPriority int
+
+// LUKS2 keyslot priorities, the values are stored in JSON as numeric strings "0", "1" and "2"
+const (
+	KeyslotPriorityDisabled KeyslotPriority = 0
+	KeyslotPriorityNormal   KeyslotPriority = 1
+	KeyslotPriorityHigh     KeyslotPriority = 2
+)
+
+// names of the priorities as printed by `cryptsetup luksDump`
+var keyslotPriorityNames = map[KeyslotPriority]string{
+	KeyslotPriorityDisabled: "ignore",
+	KeyslotPriorityNormal:   "normal",
+	KeyslotPriorityHigh:     "prefer",
+}
+
+// String returns "ignore", "normal" or "prefer"
+func (p KeyslotPriority) String() string {
+	return KeyslotPriorityString(p)
+}
+
+// KeyslotPriorityString returns the cryptsetup name of the priority: "ignore", "normal" or "prefer"
+func KeyslotPriorityString(p KeyslotPriority) string {
+	if name, ok := keyslotPriorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyslotPriority(%d)", int(p))
+}
+
+// ParseKeyslotPriority parses the priority in its LUKS2 JSON form ("0", "1" or "2") or a name returned by String
+func ParseKeyslotPriority(s string) (KeyslotPriority, error) {
+	for p, name := range keyslotPriorityNames {
+		if s == strconv.Itoa(int(p)) || s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid keyslot priority %q", s)
+}
+
+// keyslotPriority returns priority of the keyslot, a missing 'priority' field means normal priority
+func (d *Device) keyslotPriority(keyslotIdx int) (KeyslotPriority, error) {
+	ks, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return 0, fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	if ks.Priority == "" {
+		return KeyslotPriorityNormal, nil
+	}
+	prio, err := ParseKeyslotPriority(string(ks.Priority))
+	if err != nil {
+		return 0, fmt.Errorf("keyslot %d has invalid priority %q", keyslotIdx, ks.Priority)
+	}
+	return prio, nil
+}
+
+// IsKeyslotHighPriority reports whether the keyslot is tried before normal priority keyslots
+func (d *Device) IsKeyslotHighPriority(keyslotIdx int) (bool, error) {
+	prio, err := d.keyslotPriority(keyslotIdx)
+	return err == nil && prio == KeyslotPriorityHigh, err
+}
+
+// IsKeyslotNormalPriority reports whether the keyslot has normal priority, it is the default
+func (d *Device) IsKeyslotNormalPriority(keyslotIdx int) (bool, error) {
+	prio, err := d.keyslotPriority(keyslotIdx)
+	return err == nil && prio == KeyslotPriorityNormal, err
+}
+
+// IsKeyslotDisabled reports whether the keyslot has "ignore" priority, such keyslot is skipped when unlocking
+// with AnyKeyslot
+func (d *Device) IsKeyslotDisabled(keyslotIdx int) (bool, error) {
+	prio, err := d.keyslotPriority(keyslotIdx)
+	return err == nil && prio == KeyslotPriorityDisabled, err
+}
+
+// KeyslotInfo describes a LUKS2 keyslot, it does not contain any key material
+type KeyslotInfo struct {
+	Type       string // 'luks2' or 'reencrypt'
+	Priority   KeyslotPriority
+	KeySize    uint // size of the stored key in bytes
+	KDF        string
+	Encryption string // keyslot area encryption
+	AreaOffset uint64 // in bytes
+	AreaSize   uint64 // in bytes
+}
+
+// IterKeyslots calls `yield` for every keyslot in the order the keyslots are tried when unlocking with
+// AnyKeyslot: high priority keyslots first, then normal ones, each group ordered by index. Keyslots with
+// "ignore" priority are passed last. The iteration stops when `yield` returns false.
+func (d *Device) IterKeyslots(yield func(idx int, info KeyslotInfo) bool) {
+	highPrio, normPrio, ignored := d.keyslotsByPriority()
+	for _, group := range [][]int{highPrio, normPrio, ignored} {
+		for _, idx := range group {
+			if !yield(idx, d.keyslotInfo(idx)) {
+				return
+			}
+		}
+	}
+}
+
+func (d *Device) keyslotInfo(keyslotIdx int) KeyslotInfo {
+	ks := d.meta.Keyslots[keyslotIdx]
+	info := KeyslotInfo{
+		Type:       ks.Type,
+		KeySize:    ks.KeySize,
+		KDF:        ks.Kdf.Type,
+		Encryption: ks.Area.Encryption,
+	}
+	info.Priority, _ = d.keyslotPriority(keyslotIdx)
+	// the offsets are validated when the metadata is loaded
+	if offset, err := ks.Area.Offset.Int64(); err == nil {
+		info.AreaOffset = uint64(offset)
+	}
+	if size, err := ks.Area.Size.Int64(); err == nil {
+		info.AreaSize = uint64(size)
+	}
+	return info
+}
+
+// KDFOptions specify the key derivation function of a keyslot
+type KDFOptions struct {
+	Type string // 'pbkdf2', 'argon2i' or 'argon2id'
+	Salt []byte
+
+	// pbkdf2 parameters
+	Hash       string
+	Iterations uint
+
+	// argon2 parameters
+	Time   uint
+	Memory uint // in KiB
+	Cpus   uint
+}
+
+// AreaOptions specify the keyslot area that stores encrypted anti-forensic material
+type AreaOptions struct {
+	Encryption string // cipher spec, e.g. 'aes-xts-plain64'
+	KeySize    uint   // area encryption key size in bytes
+	Offset     uint64 // offset of the area at the device, in bytes
+	Size       uint64 // size of the area in bytes
+}
+
+// AFOptions specify the anti-forensic splitter of a keyslot
+type AFOptions struct {
+	KeySize uint // size of the split volume key in bytes
+	Stripes uint
+	Hash    string
+}
+
+// BuildKeyslotJSON builds JSON metadata of a 'luks2' keyslot `idx`. The parameters are validated the same way
+// they are checked on unlock, base64 encoding of the salt is done by the function.
+func BuildKeyslotJSON(idx int, kdf *KDFOptions, area *AreaOptions, af *AFOptions) (json.RawMessage, error) {
+	ks, err := buildKeyslot(idx, kdf, area, af)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ks)
+}
+
+func buildKeyslot(idx int, kdfOpts *KDFOptions, areaOpts *AreaOptions, afOpts *AFOptions) (keyslot, error) {
+	if idx < 0 {
+		return keyslot{}, fmt.Errorf("invalid keyslot index %v", idx)
+	}
+	if kdfOpts == nil || areaOpts == nil || afOpts == nil {
+		return keyslot{}, fmt.Errorf("keyslotIdx[%v]: kdf, area and af parameters are required", idx)
+	}
+
+	if len(kdfOpts.Salt) == 0 {
+		return keyslot{}, fmt.Errorf("keyslotIdx[%v].kdf.salt is empty", idx)
+	}
+	k := kdf{Type: kdfOpts.Type, Salt: base64.StdEncoding.EncodeToString(kdfOpts.Salt)}
+	switch kdfOpts.Type {
+	case "pbkdf2":
+		if _, _, err := crypto.GetHashFunc(kdfOpts.Hash); err != nil {
+			return keyslot{}, fmt.Errorf("Unknown keyslotIdx[%v].kdf.hash algorithm: %v", idx, kdfOpts.Hash)
+		}
+		if kdfOpts.Iterations == 0 {
+			return keyslot{}, fmt.Errorf("keyslotIdx[%v].kdf.iterations must be positive", idx)
+		}
+		k.Hash, k.Iterations = kdfOpts.Hash, kdfOpts.Iterations
+	case "argon2i", "argon2id":
+		if kdfOpts.Time == 0 || kdfOpts.Memory == 0 || kdfOpts.Cpus == 0 {
+			return keyslot{}, fmt.Errorf("keyslotIdx[%v].kdf time, memory and cpus must be positive", idx)
+		}
+		k.Time, k.Memory, k.Cpus = kdfOpts.Time, kdfOpts.Memory, kdfOpts.Cpus
+		if err := checkArgon2Params(k, idx); err != nil {
+			return keyslot{}, err
+		}
+	default:
+		return keyslot{}, fmt.Errorf("Unknown kdf type: %v", kdfOpts.Type)
+	}
+
+	if afOpts.Stripes != stripesNum {
+		return keyslot{}, fmt.Errorf("LUKS currently supports only af with 4000 stripes")
+	}
+	if _, err := luks2AfHash(afOpts.Hash); err != nil {
+		return keyslot{}, err
+	}
+	if afOpts.KeySize == 0 {
+		return keyslot{}, fmt.Errorf("keyslotIdx[%v].key_size must be positive", idx)
+	}
+
+	// check the cipher spec and that it accepts keys of the area key size
+	areaKey := make([]byte, areaOpts.KeySize)
+	if _, err := buildLuks2AfCipher(areaOpts.Encryption, areaKey); err != nil {
+		return keyslot{}, fmt.Errorf("keyslotIdx[%v].area: %v", idx, err)
+	}
+	if areaOpts.Offset%storageSectorSize != 0 {
+		return keyslot{}, fmt.Errorf("keyslotIdx[%v].area.offset %v is not aligned to the sector size", idx, areaOpts.Offset)
+	}
+	if minSize := uint64(roundUp(int(afOpts.KeySize*afOpts.Stripes), storageSectorSize)); areaOpts.Size < minSize {
+		return keyslot{}, fmt.Errorf("keyslot area size too small, given %v expected at least %v", areaOpts.Size, minSize)
+	}
+
+	return keyslot{
+		Type:    "luks2",
+		KeySize: afOpts.KeySize,
+		Af:      antiForensic{Type: "luks1", Stripes: afOpts.Stripes, Hash: afOpts.Hash},
+		Area: area{
+			Type:       "raw",
+			Encryption: areaOpts.Encryption,
+			KeySize:    areaOpts.KeySize,
+			Offset:     jsonNumber(strconv.FormatUint(areaOpts.Offset, 10)),
+			Size:       jsonNumber(strconv.FormatUint(areaOpts.Size, 10)),
+		},
+		Kdf: k,
+	}, nil
+}
@@ -0,0 +1,480 @@
+package luks
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyslot areas are aligned to 4096 bytes, see LUKS2_keyslot_find_area() in cryptsetup
+const keyslotAreaAlignment = 4096
+
+// NewKeyslotArea allocates a new keyslot area large enough to store anti-forensic material of a key with
+// the given size. The area is filled with random bytes. It returns offset and size of the area in bytes.
+// The area is not referenced by the metadata until a keyslot that uses it is written, this is the first step
+// of adding a new keyslot. Until then the area stays reserved in `d`: it is not returned by another call and it is
+// not overwritten by WipeFreeSpace. The random source can be set with WithRandomSource.
+func NewKeyslotArea(f *os.File, d *Device, keySize uint, encryption string, opts ...Option) (uint64, uint64, error) {
+	return d.newKeyslotArea(f, keySize, encryption, buildOptions(opts).randomSource())
+}
+
+// newKeyslotArea is NewKeyslotArea that fills the area with data read from rnd
+func (d *Device) newKeyslotArea(f *os.File, keySize uint, encryption string, rnd io.Reader) (uint64, uint64, error) {
+	if err := d.CheckRequirements(); err != nil {
+		return 0, 0, err
+	}
+	if _, _, _, err := ParseEncryption(encryption); err != nil {
+		return 0, 0, err
+	}
+	if keySize == 0 {
+		return 0, 0, fmt.Errorf("invalid key size: %v", keySize)
+	}
+
+	size := uint64(roundUp(int(keySize)*stripesNum, keyslotAreaAlignment))
+	offset, err := d.findFreeKeyslotArea(size, d.reservedAreas...)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := fillRandom(f, offset, size, rnd); err != nil {
+		return 0, 0, err
+	}
+
+	d.reservedAreas = append(d.reservedAreas, region{offset, offset + size})
+	return offset, size, nil
+}
+
+// releaseKeyslotArea drops the reservation of an area allocated by newKeyslotArea
+func (d *Device) releaseKeyslotArea(offset, size uint64) {
+	for i, r := range d.reservedAreas {
+		if r.start == offset && r.end == offset+size {
+			d.reservedAreas = append(d.reservedAreas[:i], d.reservedAreas[i+1:]...)
+			return
+		}
+	}
+}
+
+// releaseUsedKeyslotAreas drops reservations of areas that are used by keyslots, it is called once
+// the metadata is written
+func (d *Device) releaseUsedKeyslotAreas() {
+	var pending []region
+	for _, r := range d.reservedAreas {
+		used := false
+		for _, ks := range d.meta.Keyslots {
+			offset, err := ks.Area.Offset.Int64()
+			if err == nil && uint64(offset) == r.start {
+				used = true
+				break
+			}
+		}
+		if !used {
+			pending = append(pending, r)
+		}
+	}
+	d.reservedAreas = pending
+}
+
+// keyslotsRegion returns the byte range [start, end) reserved for keyslot areas. The region starts right after
+// the primary and secondary binary headers and its size is specified by config.keyslots_size.
+func (d *Device) keyslotsRegion() (uint64, uint64, error) {
+	keyslotsSize, err := d.meta.Config.KeyslotsSize.Int64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid config.keyslots_size value: %v", err)
+	}
+	start := 2 * d.hdr.HeaderSize
+	return start, start + uint64(keyslotsSize), nil
+}
+
+// keyslotArea returns offset and size of the area for the given keyslot, the area is validated to be
+// sector aligned and to lie within the keyslots region
+func (d *Device) keyslotArea(keyslotIdx int) (int64, int64, error) {
+	keyslot, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return 0, 0, fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	area := keyslot.Area
+
+	areaSize, err := area.Size.Int64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid keyslotIdx[%v] size value: %v. %v", ErrKeyslotCorrupt, keyslotIdx, area.Size, err)
+	}
+	if areaSize < 0 {
+		return 0, 0, fmt.Errorf("%w: keyslot[%v] area size %v is negative", ErrKeyslotCorrupt, keyslotIdx, areaSize)
+	}
+	if areaSize%storageSectorSize != 0 {
+		return 0, 0, fmt.Errorf("%w: keyslot[%v] area size %v is not multiple of the sector size %v", ErrKeyslotCorrupt, keyslotIdx, areaSize, storageSectorSize)
+	}
+
+	keyslotOffset, err := area.Offset.Int64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid keyslotIdx[%v] offset: %v. %v", ErrKeyslotCorrupt, keyslotIdx, area.Offset, err)
+	}
+	if keyslotOffset%storageSectorSize != 0 {
+		return 0, 0, fmt.Errorf("%w: keyslot[%v] offset %v is not aligned to sector size %v", ErrKeyslotCorrupt, keyslotIdx, keyslotOffset, storageSectorSize)
+	}
+
+	keyslotsStart, keyslotsEnd, err := d.keyslotsRegion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if keyslotOffset < int64(keyslotsStart) || keyslotOffset > int64(keyslotsEnd)-areaSize {
+		return 0, 0, fmt.Errorf("%w: keyslot[%v] area [%v, %v) is outside of the keyslots region [%v, %v)", ErrKeyslotCorrupt, keyslotIdx, keyslotOffset, keyslotOffset+areaSize, keyslotsStart, keyslotsEnd)
+	}
+
+	return keyslotOffset, areaSize, nil
+}
+
+// KeyslotAreaRead reads the raw (encrypted) content of the keyslot area
+func (d *Device) KeyslotAreaRead(f io.ReaderAt, keyslotIdx int) ([]byte, error) {
+	offset, size, err := d.keyslotArea(keyslotIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := newAlignedReaderAt(f, d.physicalBlockSize).ReadAt(data, offset); err != nil {
+		clearSlice(data)
+		return nil, err
+	}
+	return data, nil
+}
+
+// KeyslotAreaWrite overwrites the keyslot area with the given (already encrypted) content.
+// The data length must match the area size.
+func (d *Device) KeyslotAreaWrite(f *os.File, keyslotIdx int, data []byte) error {
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	offset, size, err := d.keyslotArea(keyslotIdx)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("keyslot[%v] data size %v does not match area size %v", keyslotIdx, len(data), size)
+	}
+
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+// adviseKeyslotReadahead tells the kernel that the keyslot area is going to be read sequentially and starts
+// prefetching up to `sectors` sectors of it. AnyKeyslot covers areas of all keyslots.
+func (d *Device) adviseKeyslotReadahead(f *os.File, keyslotIdx int, sectors int) error {
+	keyslots := []int{keyslotIdx}
+	if keyslotIdx == AnyKeyslot {
+		keyslots = nil
+		for idx := range d.meta.Keyslots {
+			keyslots = append(keyslots, idx)
+		}
+		sort.Ints(keyslots)
+	}
+
+	for _, idx := range keyslots {
+		offset, size, err := d.keyslotArea(idx)
+		if err != nil {
+			return err
+		}
+		if err := unix.Fadvise(int(f.Fd()), offset, size, unix.FADV_SEQUENTIAL); err != nil {
+			return err
+		}
+		length := int64(sectors) * storageSectorSize
+		if length > size {
+			length = size
+		}
+		if err := unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_WILLNEED); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findFreeKeyslotArea finds the first gap in the keyslots region that fits `size` bytes. The `reserved` regions
+// are treated as used in addition to the keyslot areas.
+func (d *Device) findFreeKeyslotArea(size uint64, reserved ...region) (uint64, error) {
+	start, end, err := d.keyslotsRegion()
+	if err != nil {
+		return 0, err
+	}
+
+	used, err := d.usedKeyslotAreas()
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range reserved {
+		used = append(used, r.clamp(start, end))
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+
+	candidate := start
+	for _, r := range used {
+		if candidate+size <= r.start {
+			break
+		}
+		if r.end > candidate {
+			candidate = uint64(roundUp(int(r.end), keyslotAreaAlignment))
+		}
+	}
+	if candidate+size > end {
+		return 0, fmt.Errorf("no free space for a keyslot area of size %v", size)
+	}
+	return candidate, nil
+}
+
+type region struct{ start, end uint64 }
+
+// usedKeyslotAreas returns areas of all keyslots sorted by offset, every area is checked to lie within
+// the keyslots region
+func (d *Device) usedKeyslotAreas() ([]region, error) {
+	var used []region
+	for idx := range d.meta.Keyslots {
+		offset, size, err := d.keyslotArea(idx)
+		if err != nil {
+			return nil, err
+		}
+		used = append(used, region{uint64(offset), uint64(offset + size)})
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+	return used, nil
+}
+
+// clamp returns the part of the region that lies within [start, end)
+func (r region) clamp(start, end uint64) region {
+	if r.start < start {
+		r.start = start
+	}
+	if r.end > end {
+		r.end = end
+	}
+	if r.end < r.start {
+		r.end = r.start
+	}
+	return r
+}
+
+// WipeFreeSpace overwrites with random data all parts of the keyslots region that are not used by a keyslot area,
+// e.g. leftovers of removed keyslots. Areas reserved by NewKeyslotArea are kept. Both header copies are not touched, the JSON area is always written
+// in whole with zero padding and its content is protected by the header checksum. Nothing is written outside
+// of the keyslots region, an area that does not fit into the region is reported as an error.
+// The random source can be set with WithRandomSource.
+func WipeFreeSpace(f *os.File, d *Device, opts ...Option) error {
+	rnd := buildOptions(opts).randomSource()
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	start, end, err := d.keyslotsRegion()
+	if err != nil {
+		return err
+	}
+	used, err := d.usedKeyslotAreas()
+	if err != nil {
+		return err
+	}
+	used = append(used, d.reservedAreas...)
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+
+	offset := start
+	for _, r := range append(used, region{end, end}) {
+		r = r.clamp(start, end)
+		if r.start > offset {
+			if err := fillRandom(f, offset, r.start-offset, rnd); err != nil {
+				return err
+			}
+		}
+		if r.end > offset {
+			offset = r.end
+		}
+	}
+	return f.Sync()
+}
+
+// fillRandom overwrites the given region of the file with random data read from rnd
+func fillRandom(f *os.File, offset, size uint64, rnd io.Reader) error {
+	const chunkSize = 64 * 1024
+	buff := make([]byte, chunkSize)
+
+	for size > 0 {
+		n := uint64(chunkSize)
+		if size < n {
+			n = size
+		}
+		if _, err := io.ReadFull(rnd, buff[:n]); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buff[:n], int64(offset)); err != nil {
+			return err
+		}
+		offset += n
+		size -= n
+	}
+	return nil
+}
+
+// ErrKeyslotCorrupted indicates that subsequent reads of a keyslot area return different data
+type ErrKeyslotCorrupted struct {
+	Keyslot int
+	Offset  int64 // absolute offset of the first differing byte
+	Length  int64 // length of the range that covers all differing bytes
+}
+
+func (e ErrKeyslotCorrupted) Error() string {
+	return fmt.Sprintf("keyslot %v area is unstable, reads differ in range [%v, %v)", e.Keyslot, e.Offset, e.Offset+e.Length)
+}
+
+// Unwrap makes the error match ErrKeyslotCorrupt
+func (e ErrKeyslotCorrupted) Unwrap() error {
+	return ErrKeyslotCorrupt
+}
+
+// number of reads used to detect intermittent keyslot area read errors
+const keyslotAreaVerifyReads = 3
+
+// VerifyKeyslotAreaIntegrity checks whether the keyslot can be unlocked with the passphrase. If the digest does
+// not match then the keyslot area is read several times to detect intermittent errors (e.g. failing media),
+// in this case ErrKeyslotCorrupted with the differing byte range is returned. If the reads are stable the
+// function returns false, meaning either the passphrase is wrong or the corruption is persistent.
+// For files the cached pages of the area are dropped before every read, so the reads reach the device.
+func (d *Device) VerifyKeyslotAreaIntegrity(f io.ReaderAt, keyslotIdx int, passphrase []byte) (bool, error) {
+	volume, err := d.unlockKeyslot(f, keyslotIdx, passphrase)
+	if err == nil {
+		volume.Destroy()
+		return true, nil
+	}
+	if err != ErrPassphraseDoesNotMatch {
+		return false, err
+	}
+
+	if err := d.verifyKeyslotAreaReads(f, keyslotIdx, keyslotAreaVerifyReads); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// verifyKeyslotAreaReads reads the keyslot area `count` times and compares the results
+func (d *Device) verifyKeyslotAreaReads(r io.ReaderAt, keyslotIdx int, count int) error {
+	offset, size, err := d.keyslotArea(keyslotIdx)
+	if err != nil {
+		return err
+	}
+
+	dropCachedRange(r, offset, size)
+	first, err := d.KeyslotAreaRead(r, keyslotIdx)
+	if err != nil {
+		return err
+	}
+
+	start, end := -1, -1
+	for i := 1; i < count; i++ {
+		dropCachedRange(r, offset, size)
+		data, err := d.KeyslotAreaRead(r, keyslotIdx)
+		if err != nil {
+			return err
+		}
+		for j := range data {
+			if data[j] == first[j] {
+				continue
+			}
+			if start == -1 || j < start {
+				start = j
+			}
+			if j+1 > end {
+				end = j + 1
+			}
+		}
+	}
+
+	if start != -1 {
+		return ErrKeyslotCorrupted{
+			Keyslot: keyslotIdx,
+			Offset:  offset + int64(start),
+			Length:  int64(end - start),
+		}
+	}
+	return nil
+}
+
+// dropCachedRange asks the kernel to evict cached pages of the range if `r` is a file. Otherwise repeated reads
+// are served from the page cache and return the same data regardless of the device state. It is a hint,
+// pages that are dirty or mapped elsewhere stay in the cache.
+func dropCachedRange(r io.ReaderAt, offset, size int64) {
+	if f, ok := r.(*os.File); ok {
+		_ = unix.Fadvise(int(f.Fd()), offset, size, unix.FADV_DONTNEED)
+	}
+}
+
+// KeyslotAreaDiagnostics reports intermediate results of a keyslot area verification
+type KeyslotAreaDiagnostics struct {
+	Keyslot         int
+	AreaOffset      int64  // offset of the keyslot area, in bytes
+	AreaSize        int64  // size of the keyslot area, in bytes
+	KDF             string // KDF type used to derive the area key
+	AreaKeyLength   int    // length of the derived area key
+	AfStripes       uint   // number of anti-forensic stripes merged
+	VolumeKeyLength int    // length of the merged key candidate
+	Digest          int    // index of the digest the keyslot is verified with, -1 if there is none
+	DigestMatch     bool   // whether the merged key matches the digest
+}
+
+// VerifyKeyslotArea decrypts and merges the anti-forensic material of the keyslot and checks it against the
+// digest. Unlike unlocking it reports results of the intermediate stages and never returns the key itself, it is
+// intended for diagnosing keyslot corruption. A wrong passphrase and a corrupted area are both reported
+// as DigestMatch == false, an error is returned if a stage cannot be performed at all.
+func (d *Device) VerifyKeyslotArea(f io.ReaderAt, keyslotIdx int, passphrase []byte) (*KeyslotAreaDiagnostics, error) {
+	offset, size, err := d.keyslotArea(keyslotIdx)
+	if err != nil {
+		return nil, err
+	}
+	keyslot := d.meta.Keyslots[keyslotIdx]
+
+	diag := &KeyslotAreaDiagnostics{
+		Keyslot:    keyslotIdx,
+		AreaOffset: offset,
+		AreaSize:   size,
+		KDF:        keyslot.Kdf.Type,
+		AfStripes:  keyslot.Af.Stripes,
+		Digest:     -1,
+	}
+
+	afKey, err := deriveLuks2AfKey(d.keyslotKdf(keyslot), keyslotIdx, passphrase, keyslot.Area.KeySize)
+	if err != nil {
+		return diag, err
+	}
+	defer afKey.Destroy()
+	diag.AreaKeyLength = len(afKey.Bytes())
+
+	keyData, err := d.KeyslotAreaRead(f, keyslotIdx)
+	if err != nil {
+		return diag, err
+	}
+	defer clearSlice(keyData)
+
+	candidate, err := decryptLuks2VolumeKey(keyData, keyslotIdx, keyslot, afKey.Bytes())
+	if err != nil {
+		return diag, err
+	}
+	defer clearSlice(candidate)
+	diag.VolumeKeyLength = len(candidate)
+
+	digIdx, digInfo := d.findDigestForKeyslot(keyslotIdx)
+	if digInfo == nil {
+		return diag, ErrKeyslotWithoutDigest{Index: keyslotIdx}
+	}
+	diag.Digest = digIdx
+
+	generatedDigest, err := computeDigestForKey(digInfo, keyslotIdx, candidate)
+	if err != nil {
+		return diag, err
+	}
+	defer clearSlice(generatedDigest)
+	expectedDigest, err := base64.StdEncoding.DecodeString(digInfo.Digest)
+	if err != nil {
+		return diag, fmt.Errorf("%w: keyslotIdx[%v].digest.Digest base64 parsing failed: %v", ErrKeyslotCorrupt, keyslotIdx, err)
+	}
+	diag.DigestMatch = subtle.ConstantTimeCompare(generatedDigest, expectedDigest) == 1
+
+	return diag, nil
+}
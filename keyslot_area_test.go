@@ -0,0 +1,443 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestNewKeyslotArea(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	offset, size, err := NewKeyslotArea(disk, d, 64, "aes-xts-plain64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first area occupies [32768, 32768+258048)
+	if offset != 32768+258048 {
+		t.Fatalf("unexpected area offset %v", offset)
+	}
+	if size != 258048 {
+		t.Fatalf("unexpected area size %v", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := disk.ReadAt(data, int64(offset)); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, make([]byte, size)) {
+		t.Fatal("keyslot area is expected to be filled with random data")
+	}
+
+	// the area stays reserved until a keyslot uses it
+	offset2, _, err := NewKeyslotArea(disk, d, 64, "aes-xts-plain64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset2 != offset+size {
+		t.Fatalf("second area at %v overlaps the reserved area at %v", offset2, offset)
+	}
+	if err := WipeFreeSpace(disk, d); err != nil {
+		t.Fatal(err)
+	}
+	wiped := make([]byte, size)
+	if _, err := disk.ReadAt(wiped, int64(offset)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, wiped) {
+		t.Fatal("reserved keyslot area is overwritten by WipeFreeSpace")
+	}
+
+	// existing keyslot should still be usable
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewKeyslotAreaReleasedByKeyslot(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	if err := d.ChangeKeyslotEncryption(disk, 0, []byte("foobar"), "aes-xts-essiv:sha256"); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.reservedAreas) != 0 {
+		t.Fatalf("areas used by keyslots are expected to be released, got %v", d.reservedAreas)
+	}
+
+	offset, size, err := NewKeyslotArea(disk, d, 64, "aes-xts-plain64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := buildKeyslot(1, &KDFOptions{Type: "pbkdf2", Salt: []byte("salt"), Hash: "sha256", Iterations: 1000},
+		&AreaOptions{Encryption: "aes-xts-plain64", KeySize: 64, Offset: offset, Size: size},
+		&AFOptions{KeySize: 64, Stripes: stripesNum, Hash: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.meta.Keyslots[1] = ks
+	if err := d.UpdateHeader(disk); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.reservedAreas) != 0 {
+		t.Fatalf("area written to the header is expected to be released, got %v", d.reservedAreas)
+	}
+}
+
+func TestNewKeyslotAreaNoSpace(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Config.KeyslotsSize = jsonNumber(strconv.Itoa(300000))
+	disk, d := fx.open(t)
+
+	if _, _, err := NewKeyslotArea(disk, d, 64, "aes-xts-plain64"); err == nil {
+		t.Fatal("expected an error when keyslots region is full")
+	}
+}
+
+func TestWipeFreeSpace(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	removed := d.meta.Keyslots[1]
+	delete(d.meta.Keyslots, 1) // the keyslot is removed but its area still contains the key material
+
+	offset, _ := removed.Area.Offset.Int64()
+	size, _ := removed.Area.Size.Int64()
+	before := make([]byte, size)
+	if _, err := disk.ReadAt(before, offset); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := d.KeyslotAreaRead(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WipeFreeSpace(disk, d); err != nil {
+		t.Fatal(err)
+	}
+
+	after := make([]byte, size)
+	if _, err := disk.ReadAt(after, offset); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Fatal("area of the removed keyslot is not wiped")
+	}
+	// the space after the last area is never used by the fixture and must not stay zeroed
+	tail := make([]byte, 4096)
+	if _, err := disk.ReadAt(tail, fixtureDataOffset-int64(len(tail))); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(tail, make([]byte, len(tail))) {
+		t.Fatal("free space at the end of the keyslots region is not wiped")
+	}
+
+	data, err := d.KeyslotAreaRead(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept, data) {
+		t.Fatal("area of an active keyslot is modified")
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWipeFreeSpaceAreaOutsideRegion(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	pattern := bytes.Repeat([]byte{0x5a}, 64*1024)
+	if _, err := disk.WriteAt(pattern, fixtureDataOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	areas := []struct{ offset, size jsonNumber }{
+		{jsonNumber(strconv.Itoa(fixtureDataOffset)), "4096"},             // past the region end
+		{jsonNumber(strconv.Itoa(fixtureDataOffset - 4096)), "8192"},      // crosses the region end
+		{jsonNumber(strconv.Itoa(fixtureDataOffset + 32*1024)), "-65536"}, // negative size
+	}
+	for _, a := range areas {
+		ks := d.meta.Keyslots[1]
+		ks.Area.Offset = a.offset
+		ks.Area.Size = a.size
+		d.meta.Keyslots[1] = ks
+
+		if err := WipeFreeSpace(disk, d); !errors.Is(err, ErrKeyslotCorrupt) {
+			t.Fatalf("area [%v, +%v): expected ErrKeyslotCorrupt, got %v", a.offset, a.size, err)
+		}
+		data := make([]byte, len(pattern))
+		if _, err := disk.ReadAt(data, fixtureDataOffset); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, pattern) {
+			t.Fatalf("area [%v, +%v): data segment is modified", a.offset, a.size)
+		}
+	}
+}
+
+func TestKeyslotAreaReadWrite(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	ks := fx.meta.Keyslots[1]
+	ks.Area.Offset = "290817" // the area is at 290816
+	fx.meta.Keyslots[1] = ks
+	disk, d := fx.open(t)
+
+	data, err := d.KeyslotAreaRead(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, fx.areas[0]) {
+		t.Fatal("keyslot area content does not match")
+	}
+
+	if err := d.KeyslotAreaWrite(disk, 0, data[:len(data)-512]); err == nil {
+		t.Fatal("write with mismatched data size is expected to fail")
+	}
+
+	// write the same data back, the keyslot should stay usable
+	if err := d.KeyslotAreaWrite(disk, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.KeyslotAreaRead(disk, 1); err == nil {
+		t.Fatal("read of a non-aligned keyslot area is expected to fail")
+	}
+	if err := d.KeyslotAreaWrite(disk, 1, data); err == nil {
+		t.Fatal("write to a non-aligned keyslot area is expected to fail")
+	}
+}
+
+// flakyReaderAt flips a byte at the given offset on every other read, starting with the first one
+type flakyReaderAt struct {
+	r      *os.File
+	offset int64
+	reads  int
+}
+
+func (f *flakyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.r.ReadAt(p, off)
+	f.reads++
+	if f.reads%2 == 1 && f.offset >= off && f.offset < off+int64(n) {
+		p[f.offset-off] ^= 0xff
+	}
+	return n, err
+}
+
+func TestVerifyKeyslotAreaIntegrity(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	ok, err := d.VerifyKeyslotAreaIntegrity(disk, 0, []byte("foobar"))
+	if err != nil || !ok {
+		t.Fatalf("healthy keyslot verification failed: %v %v", ok, err)
+	}
+
+	ok, err = d.VerifyKeyslotAreaIntegrity(disk, 0, []byte("wrong"))
+	if err != nil || ok {
+		t.Fatalf("wrong passphrase with stable reads is expected to return false, got %v %v", ok, err)
+	}
+
+	flaky := &flakyReaderAt{r: disk, offset: 32768 + 1000}
+	err = d.verifyKeyslotAreaReads(flaky, 0, 3)
+	corrupted, isCorrupted := err.(ErrKeyslotCorrupted)
+	if !isCorrupted {
+		t.Fatalf("expected ErrKeyslotCorrupted, got %v", err)
+	}
+	if corrupted.Offset != 32768+1000 || corrupted.Length != 1 {
+		t.Fatalf("unexpected corrupted range %+v", corrupted)
+	}
+}
+
+func TestVerifyKeyslotAreaIntegrityFlakyReads(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	// the unlock reads corrupted data, the following verification reads differ
+	flaky := &flakyReaderAt{r: disk, offset: 32768 + 5000}
+	ok, err := d.VerifyKeyslotAreaIntegrity(flaky, 0, []byte("foobar"))
+	if ok {
+		t.Fatal("unlock with a corrupted read is expected to fail")
+	}
+	var corrupted ErrKeyslotCorrupted
+	if !errors.As(err, &corrupted) {
+		t.Fatalf("expected ErrKeyslotCorrupted, got %v", err)
+	}
+	if corrupted.Keyslot != 0 || corrupted.Offset != 32768+5000 || corrupted.Length != 1 {
+		t.Fatalf("unexpected corrupted range %+v", corrupted)
+	}
+}
+
+func TestAdviseKeyslotReadahead(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	if err := d.adviseKeyslotReadahead(disk, AnyKeyslot, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.adviseKeyslotReadahead(disk, 1, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.adviseKeyslotReadahead(disk, 5, 64); err == nil {
+		t.Fatal("readahead of a non-existent keyslot is expected to fail")
+	}
+
+	if _, err := d.unlockKeyslot(disk, 1, []byte("barfoo")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyKeyslotArea(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	diag, err := d.VerifyKeyslotArea(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := KeyslotAreaDiagnostics{
+		Keyslot:         0,
+		AreaOffset:      32768,
+		AreaSize:        258048,
+		KDF:             "pbkdf2",
+		AreaKeyLength:   64,
+		AfStripes:       4000,
+		VolumeKeyLength: 64,
+		Digest:          0,
+		DigestMatch:     true,
+	}
+	if *diag != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *diag)
+	}
+
+	// corrupt the AF material of keyslot 1
+	offset, _, err := d.keyslotArea(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.WriteAt(make([]byte, 512), offset+4096); err != nil {
+		t.Fatal(err)
+	}
+	diag, err = d.VerifyKeyslotArea(disk, 1, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diag.DigestMatch {
+		t.Fatal("corrupted keyslot area is expected to fail digest verification")
+	}
+	if diag.VolumeKeyLength != 64 || diag.AreaKeyLength != 64 || diag.Digest != 0 {
+		t.Fatalf("unexpected diagnostics of the corrupted keyslot: %+v", *diag)
+	}
+
+	// in-memory image
+	image := make([]byte, fx.diskSize)
+	if _, err := disk.ReadAt(image, 0); err != nil {
+		t.Fatal(err)
+	}
+	diag, err = d.VerifyKeyslotArea(bytes.NewReader(image), 0, []byte("foobar"))
+	if err != nil || !diag.DigestMatch {
+		t.Fatalf("verification of an in-memory image failed: %+v, %v", diag, err)
+	}
+
+	dig := d.meta.Digests[0]
+	dig.Digest = "invalid base64!"
+	d.meta.Digests[0] = dig
+	if _, err := d.VerifyKeyslotArea(disk, 0, []byte("foobar")); !errors.Is(err, ErrKeyslotCorrupt) {
+		t.Fatalf("expected ErrKeyslotCorrupt for an invalid digest, got %v", err)
+	}
+}
+
+// patternReader returns an endless sequence of the same byte
+type patternReader byte
+
+func (r patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+type failingReader struct{}
+
+var errRandomSource = errors.New("random source failure")
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errRandomSource
+}
+
+func TestWithRandomSource(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	isPattern := func(offset, size int64) bool {
+		data := make([]byte, size)
+		if _, err := disk.ReadAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Equal(data, bytes.Repeat([]byte{0xa5}, int(size)))
+	}
+
+	err := d.ChangeKeyslotEncryption(disk, 1, []byte("barfoo"), "aes-xts-essiv:sha256", WithRandomSource(failingReader{}))
+	if !errors.Is(err, errRandomSource) {
+		t.Fatalf("expected the random source error, got %v", err)
+	}
+	_, err = d.AddKeyslotWithKey(disk, fx.volumeKey, []byte("newpass"), &AddKeyslotOptions{KDF: "pbkdf2", Iterations: 1000}, WithRandomSource(failingReader{}))
+	if !errors.Is(err, errRandomSource) {
+		t.Fatalf("expected the random source error, got %v", err)
+	}
+
+	offset, size, err := NewKeyslotArea(disk, d, 64, "aes-xts-plain64", WithRandomSource(patternReader(0xa5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPattern(int64(offset), int64(size)) {
+		t.Fatal("new keyslot area is not filled from the random source")
+	}
+
+	if err := WipeFreeSpace(disk, d, WithRandomSource(patternReader(0xa5))); err != nil {
+		t.Fatal(err)
+	}
+	_, end, err := d.keyslotsRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPattern(int64(end)-4096, 4096) {
+		t.Fatal("free space is not wiped from the random source")
+	}
+
+	if err := d.EraseKeyslotArea(disk, 0, WithRandomSource(patternReader(0xa5))); err != nil {
+		t.Fatal(err)
+	}
+	offset0, size0, err := d.keyslotArea(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPattern(offset0, size0) {
+		t.Fatal("erased keyslot area is not filled from the random source")
+	}
+}
@@ -0,0 +1,415 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestChangeKeyslotEncryption(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	oldOffset, oldSize, err := d.keyslotArea(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldData := make([]byte, oldSize)
+	if _, err := disk.ReadAt(oldData, oldOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.ChangeKeyslotEncryption(disk, 0, []byte("foobar"), "aes-xts-essiv:sha256"); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the device from disk
+	d, err = luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.hdr.SequenceId != 2 {
+		t.Fatalf("expected sequence id 2, got %v", d.hdr.SequenceId)
+	}
+	if enc := d.meta.Keyslots[0].Area.Encryption; enc != "aes-xts-essiv:sha256" {
+		t.Fatalf("unexpected keyslot encryption %v", enc)
+	}
+
+	for k, password := range []string{"foobar", "barfoo"} {
+		volume, err := d.unlockKeyslot(disk, k, []byte(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatalf("keyslot %v: unlocked volume key does not match", k)
+		}
+	}
+
+	oldArea := make([]byte, oldSize)
+	if _, err := disk.ReadAt(oldArea, oldOffset); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(oldArea); i += storageSectorSize {
+		if bytes.Equal(oldArea[i:i+storageSectorSize], oldData[i:i+storageSectorSize]) {
+			t.Fatalf("old keyslot area sector %v is expected to be overwritten", i/storageSectorSize)
+		}
+	}
+
+	// secondary header must be valid as well
+	secondary := make([]byte, d.hdr.HeaderSize)
+	if _, err := disk.ReadAt(secondary, int64(d.hdr.HeaderSize)); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := luks2HeaderChecksum(secondary, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secondary[448:448+32], checksum) {
+		t.Fatal("secondary header checksum is invalid")
+	}
+
+	if err := d.ChangeKeyslotEncryption(disk, 1, []byte("wrong"), "aes-xts-essiv:sha256"); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+}
+
+func TestChangeKeyslotEncryptionKeySize(t *testing.T) {
+	fx := newLuks2Fixture(t, 32)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	// 256-bit to 512-bit aes-xts-plain64
+	if err := d.ChangeKeyslotEncryption(disk, 0, []byte("foobar"), "aes-xts-plain64", WithKeyslotKeySize(64)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := d.meta.Keyslots[0]
+	if ks.Area.KeySize != 64 || ks.KeySize != 32 {
+		t.Fatalf("unexpected key sizes: area %v, volume %v", ks.Area.KeySize, ks.KeySize)
+	}
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+
+	// xts does not accept 24 bytes keys, nothing is written
+	if err := d.ChangeKeyslotEncryption(disk, 0, []byte("foobar"), "aes-xts-plain64", WithKeyslotKeySize(24)); err == nil {
+		t.Fatal("invalid key size for the keyslot cipher is expected to fail")
+	}
+	if d.hdr.SequenceId != 2 || len(d.reservedAreas) != 0 {
+		t.Fatalf("failed change is not expected to modify the device, sequence id %v", d.hdr.SequenceId)
+	}
+}
+
+func TestAddKeyslotWithUnlockedVolumeKey(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	volume, err := Unlock(disk, AnyKeyslot, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := volume.VolumeKey()
+	if err := volume.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if volume.VolumeKey() != nil {
+		t.Fatal("destroyed volume is not expected to return a key")
+	}
+
+	idx, err := d.AddKeyslotWithKey(disk, key, []byte("newpass"), &AddKeyslotOptions{KDF: "pbkdf2", Iterations: 1000, ClearKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume, err = Unlock(disk, idx, []byte("newpass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer volume.Destroy()
+	if !bytes.Equal(volume.VolumeKey(), fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+}
+
+func TestBuildKeyslotJSON(t *testing.T) {
+	salt := []byte("0123456789abcdef0123456789abcdef")
+	kdfOpts := &KDFOptions{Type: "argon2id", Salt: salt, Time: 4, Memory: 65536, Cpus: 2}
+	areaOpts := &AreaOptions{Encryption: "aes-xts-plain64", KeySize: 64, Offset: 32768, Size: 258048}
+	afOpts := &AFOptions{KeySize: 64, Stripes: 4000, Hash: "sha256"}
+
+	data, err := BuildKeyslotJSON(0, kdfOpts, areaOpts, afOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ks keyslot
+	if err := json.Unmarshal(data, &ks); err != nil {
+		t.Fatal(err)
+	}
+	if ks.Type != "luks2" || ks.KeySize != 64 || ks.Af.Type != "luks1" || ks.Area.Type != "raw" {
+		t.Fatalf("unexpected keyslot: %+v", ks)
+	}
+	if ks.Area.Offset != "32768" || ks.Area.Size != "258048" {
+		t.Fatalf("unexpected keyslot area: %+v", ks.Area)
+	}
+	decodedSalt, err := base64.StdEncoding.DecodeString(ks.Kdf.Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedSalt, salt) || ks.Kdf.Hash != "" || ks.Kdf.Iterations != 0 {
+		t.Fatalf("unexpected kdf: %+v", ks.Kdf)
+	}
+
+	invalid := []struct {
+		name string
+		kdf  KDFOptions
+		area AreaOptions
+		af   AFOptions
+	}{
+		{"empty salt", KDFOptions{Type: "pbkdf2", Hash: "sha256", Iterations: 1000}, *areaOpts, *afOpts},
+		{"unknown kdf", KDFOptions{Type: "scrypt", Salt: salt}, *areaOpts, *afOpts},
+		{"unknown pbkdf2 hash", KDFOptions{Type: "pbkdf2", Salt: salt, Hash: "md4", Iterations: 1000}, *areaOpts, *afOpts},
+		{"zero argon2 memory", KDFOptions{Type: "argon2i", Salt: salt, Time: 4, Cpus: 1}, *areaOpts, *afOpts},
+		{"invalid cipher", *kdfOpts, AreaOptions{Encryption: "aes-xts", KeySize: 64, Offset: 32768, Size: 258048}, *afOpts},
+		{"invalid area key size", *kdfOpts, AreaOptions{Encryption: "aes-xts-plain64", KeySize: 20, Offset: 32768, Size: 258048}, *afOpts},
+		{"unaligned area", *kdfOpts, AreaOptions{Encryption: "aes-xts-plain64", KeySize: 64, Offset: 100, Size: 258048}, *afOpts},
+		{"small area", *kdfOpts, AreaOptions{Encryption: "aes-xts-plain64", KeySize: 64, Offset: 32768, Size: 4096}, *afOpts},
+		{"unsupported stripes", *kdfOpts, *areaOpts, AFOptions{KeySize: 64, Stripes: 100, Hash: "sha256"}},
+	}
+	for _, tc := range invalid {
+		if _, err := BuildKeyslotJSON(0, &tc.kdf, &tc.area, &tc.af); err == nil {
+			t.Errorf("%v: expected an error", tc.name)
+		}
+	}
+}
+
+func TestIterKeyslots(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	for i := 0; i < 4; i++ {
+		fx.addKeyslot(t, i, "foobar", "aes-xts-plain64")
+	}
+	setPriority := func(idx int, prio string) {
+		ks := fx.meta.Keyslots[idx]
+		ks.Priority = jsonNumber(prio)
+		fx.meta.Keyslots[idx] = ks
+	}
+	setPriority(0, "0")
+	setPriority(2, "2")
+	setPriority(3, "1")
+	_, d := fx.open(t)
+
+	var order []int
+	var priorities []KeyslotPriority
+	d.IterKeyslots(func(idx int, info KeyslotInfo) bool {
+		order = append(order, idx)
+		priorities = append(priorities, info.Priority)
+		if info.Type != "luks2" || info.KDF != "pbkdf2" || info.KeySize != 64 || info.AreaSize == 0 {
+			t.Errorf("unexpected keyslot %v info: %+v", idx, info)
+		}
+		return true
+	})
+
+	// the same order as unlockAnyKeyslot tries, followed by the ignored keyslot
+	highPrio, normPrio, _ := d.keyslotsByPriority()
+	unlockOrder := append(highPrio, normPrio...)
+	if !reflect.DeepEqual(order, append(unlockOrder, 0)) || !reflect.DeepEqual(order, []int{2, 1, 3, 0}) {
+		t.Fatalf("unexpected iteration order %v, unlock order %v", order, unlockOrder)
+	}
+	if !reflect.DeepEqual(priorities, []KeyslotPriority{KeyslotPriorityHigh, KeyslotPriorityNormal, KeyslotPriorityNormal, KeyslotPriorityDisabled}) {
+		t.Fatalf("unexpected priorities %v", priorities)
+	}
+
+	var visited int
+	d.IterKeyslots(func(idx int, info KeyslotInfo) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("iteration is expected to stop after the first keyslot, visited %v", visited)
+	}
+}
+
+func TestKeyslotPriorityAccessors(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	for i := 0; i < 4; i++ {
+		fx.addKeyslot(t, i, "foobar", "aes-xts-plain64")
+	}
+	for idx, prio := range map[int]string{0: "0", 1: "1", 2: "2"} {
+		ks := fx.meta.Keyslots[idx]
+		ks.Priority = jsonNumber(prio)
+		fx.meta.Keyslots[idx] = ks
+	}
+	_, d := fx.open(t)
+
+	// keyslot 3 has no priority field, it means normal priority
+	for idx, want := range []KeyslotPriority{KeyslotPriorityDisabled, KeyslotPriorityNormal, KeyslotPriorityHigh, KeyslotPriorityNormal} {
+		high, err := d.IsKeyslotHighPriority(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		normal, err := d.IsKeyslotNormalPriority(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disabled, err := d.IsKeyslotDisabled(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if high != (want == KeyslotPriorityHigh) || normal != (want == KeyslotPriorityNormal) || disabled != (want == KeyslotPriorityDisabled) {
+			t.Errorf("keyslot %v: expected priority %v, got high=%v normal=%v disabled=%v", idx, want, high, normal, disabled)
+		}
+	}
+
+	if _, err := d.IsKeyslotDisabled(5); err == nil {
+		t.Fatal("missing keyslot is expected to fail")
+	}
+}
+
+func TestParseKeyslotPriority(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected KeyslotPriority
+		name     string
+	}{
+		{"0", KeyslotPriorityDisabled, "ignore"},
+		{"1", KeyslotPriorityNormal, "normal"},
+		{"2", KeyslotPriorityHigh, "prefer"},
+		{"prefer", KeyslotPriorityHigh, "prefer"},
+		{"ignore", KeyslotPriorityDisabled, "ignore"},
+	} {
+		prio, err := ParseKeyslotPriority(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prio != test.expected || prio.String() != test.name || KeyslotPriorityString(prio) != test.name {
+			t.Fatalf("%q: expected %v (%v), got %v", test.input, test.expected, test.name, prio)
+		}
+	}
+
+	for _, input := range []string{"", "3", "-1", "high", "01"} {
+		if _, err := ParseKeyslotPriority(input); err == nil {
+			t.Fatalf("%q: expected an error", input)
+		}
+	}
+	if s := KeyslotPriority(7).String(); s != "KeyslotPriority(7)" {
+		t.Fatalf("unexpected name of an unknown priority %q", s)
+	}
+}
+
+func TestAddKeyslotWithKey(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	if _, err := d.AddKeyslotWithKey(disk, randomBytes(t, 64), []byte("newpass"), nil); err == nil {
+		t.Fatal("a key that does not match the digest is expected to fail")
+	}
+
+	key := append([]byte(nil), fx.volumeKey...)
+	idx, err := d.AddKeyslotWithKey(disk, key, []byte("newpass"), &AddKeyslotOptions{KDF: "pbkdf2", Iterations: 1000, ClearKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 1 {
+		t.Fatalf("expected the first free keyslot 1, got %v", idx)
+	}
+	if !bytes.Equal(key, make([]byte, 64)) {
+		t.Fatal("the volume key is expected to be cleared")
+	}
+
+	// the new keyslot is stored on disk
+	d, err = luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume, err := d.unlockKeyslot(disk, 1, []byte("newpass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateHashConsistency(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "foobar", "aes-xts-plain64")
+	_, d := fx.open(t)
+
+	if errs := d.ValidateHashConsistency(); errs != nil {
+		t.Fatalf("consistent metadata is reported as inconsistent: %v", errs)
+	}
+
+	ks := d.meta.Keyslots[1]
+	ks.Af.Hash = "sha512"
+	d.meta.Keyslots[1] = ks
+	if hash, err := d.KeyslotAfHash(1); err != nil || hash != "sha512" {
+		t.Fatalf("unexpected af hash %v, %v", hash, err)
+	}
+	if errs := d.ValidateHashConsistency(); len(errs) != 1 {
+		t.Fatalf("expected a single inconsistency, got %v", errs)
+	}
+	if _, err := d.KeyslotAfHash(5); err == nil {
+		t.Fatal("missing keyslot is expected to fail")
+	}
+}
+
+func TestEraseKeyslotArea(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	before, err := d.KeyslotAreaRead(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.EraseKeyslotArea(disk, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.EraseKeyslotArea(disk, 0); err == nil {
+		t.Fatal("erasing the keyslot twice is expected to fail")
+	}
+
+	// the tombstone is stored on disk
+	d, err = luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, ok := d.meta.Keyslots[0]
+	if !ok || ks.Type != "luks2-invalid" {
+		t.Fatalf("erased keyslot entry is expected to be preserved with luks2-invalid type: %+v", ks)
+	}
+	after, err := d.KeyslotAreaRead(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Fatal("keyslot area is not overwritten")
+	}
+
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err == nil {
+		t.Fatal("erased keyslot is expected to fail unlocking")
+	}
+	if _, err := d.unlockAnyKeyslot(disk, []byte("foobar")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+	if _, err := d.unlockAnyKeyslot(disk, []byte("barfoo")); err != nil {
+		t.Fatal(err)
+	}
+}
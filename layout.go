@@ -0,0 +1,44 @@
+package luks
+
+// LayoutInfo is the on-disk map of a LUKS2 device, all values are in bytes
+type LayoutInfo struct {
+	HeaderSize     uint64 // size of one header copy: binary header and JSON area
+	KeyslotsOffset uint64 // keyslots region follows both header copies
+	KeyslotsSize   uint64
+	DataOffset     uint64 // first byte of the data segments
+	DataSize       uint64 // total size of the data segments, zero if DynamicData is set
+	DynamicData    bool   // the data spans till the end of the device
+}
+
+// Layout returns position of the header copies, keyslots region and data segments. It is computed from the
+// header and metadata only, the device size is not checked.
+func (d *Device) Layout() LayoutInfo {
+	layout := LayoutInfo{
+		HeaderSize: d.hdr.HeaderSize,
+	}
+	// keyslots_size is validated when the metadata is loaded
+	if start, end, err := d.keyslotsRegion(); err == nil {
+		layout.KeyslotsOffset = start
+		layout.KeyslotsSize = end - start
+	}
+
+	first := true
+	for idx := range d.meta.Segments {
+		seg, err := d.segmentInfo(idx)
+		if err != nil || seg.IsBackup() {
+			continue
+		}
+		if first || seg.Offset < layout.DataOffset {
+			layout.DataOffset = seg.Offset
+		}
+		first = false
+		if seg.Dynamic {
+			layout.DynamicData = true
+		}
+		layout.DataSize += seg.Size
+	}
+	if layout.DynamicData {
+		layout.DataSize = 0
+	}
+	return layout
+}
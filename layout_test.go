@@ -0,0 +1,46 @@
+package luks
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	disk := tempDisk(t, 20*1024*1024)
+	if err := Format(disk, []byte("foobar"), testFormatOptions); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// default layout of `cryptsetup luksFormat --type luks2`
+	expected := LayoutInfo{
+		HeaderSize:     16384,
+		KeyslotsOffset: 32768,
+		KeyslotsSize:   16744448,
+		DataOffset:     16777216,
+		DynamicData:    true,
+	}
+	if layout := d.Layout(); layout != expected {
+		t.Fatalf("unexpected layout:\n  got %+v\n want %+v", layout, expected)
+	}
+}
+
+func TestLayoutFixedSegments(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.meta.Segments[0] = segment{Type: "crypt", Offset: "1114112", IvTweak: "128", Size: "1048576", Encryption: "aes-xts-plain64", SectorSize: 512}
+	fx.meta.Segments[1] = segment{Type: "crypt", Offset: "1048576", IvTweak: "0", Size: "65536", Encryption: "aes-xts-plain64", SectorSize: 4096}
+	_, d := fx.open(t)
+
+	layout := d.Layout()
+	if layout.DataOffset != 1048576 || layout.DataSize != 1048576+65536 || layout.DynamicData {
+		t.Fatalf("unexpected data layout: %+v", layout)
+	}
+}
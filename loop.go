@@ -0,0 +1,138 @@
+package luks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// number of attempts to grab a free loop device, another process might take the device returned
+// by LOOP_CTL_GET_FREE before we attach our file to it
+const loopAttachAttempts = 5
+
+// LoopDeviceAttach attaches the image file to a free loop device. It returns the loop device path
+// (e.g. /dev/loop7) and a function that detaches the device.
+func LoopDeviceAttach(imagePath string) (string, func() error, error) {
+	image, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	defer image.Close() // the loop device keeps its own reference to the file
+
+	control, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	defer control.Close()
+
+	for i := 0; i < loopAttachAttempts; i++ {
+		num, _, errno := syscall.Syscall(syscall.SYS_IOCTL, control.Fd(), unix.LOOP_CTL_GET_FREE, 0)
+		if errno != 0 {
+			return "", nil, os.NewSyscallError("loop ioctl (LOOP_CTL_GET_FREE)", errno)
+		}
+
+		loopPath := fmt.Sprintf("/dev/loop%d", num)
+		loop, err := os.OpenFile(loopPath, os.O_RDWR, 0)
+		if err != nil {
+			return "", nil, err
+		}
+
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), unix.LOOP_SET_FD, image.Fd())
+		if errno == syscall.EBUSY {
+			loop.Close()
+			continue
+		}
+		if errno != 0 {
+			loop.Close()
+			return "", nil, os.NewSyscallError("loop ioctl (LOOP_SET_FD)", errno)
+		}
+
+		info := unix.LoopInfo64{
+			Offset:    0,
+			Sizelimit: 0, // use the whole file
+		}
+		copy(info.File_name[:len(info.File_name)-1], imagePath)
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info)))
+		if errno != 0 {
+			_, _, _ = syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return "", nil, os.NewSyscallError("loop ioctl (LOOP_SET_STATUS64)", errno)
+		}
+		loop.Close()
+
+		closer := func() error {
+			return DetachLoopDevice(loopPath)
+		}
+		return loopPath, closer, nil
+	}
+
+	return "", nil, fmt.Errorf("unable to find a free loop device after %v attempts", loopAttachAttempts)
+}
+
+// DetachLoopDevice detaches the backing file from the loop device
+func DetachLoopDevice(loopPath string) error {
+	loop, err := os.OpenFile(loopPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), unix.LOOP_CLR_FD, 0)
+	if errno != 0 {
+		return os.NewSyscallError("loop ioctl (LOOP_CLR_FD)", errno)
+	}
+	return nil
+}
+
+// ListLUKSLoopDevices returns paths of attached loop devices that contain a LUKS header
+func ListLUKSLoopDevices() ([]string, error) {
+	paths, err := filepath.Glob("/dev/loop[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, p := range paths {
+		isLuks, err := isLUKSLoopDevice(p)
+		if err != nil {
+			return nil, err
+		}
+		if isLuks {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// isLUKSLoopDevice checks whether the loop device has a backing file and the file starts with LUKS magic
+func isLUKSLoopDevice(loopPath string) (bool, error) {
+	loop, err := os.Open(loopPath)
+	if err != nil {
+		return false, err
+	}
+	defer loop.Close()
+
+	var info unix.LoopInfo64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), unix.LOOP_GET_STATUS64, uintptr(unsafe.Pointer(&info)))
+	if errno == syscall.ENXIO {
+		return false, nil // no backing file attached
+	}
+	if errno != 0 {
+		return false, os.NewSyscallError("loop ioctl (LOOP_GET_STATUS64)", errno)
+	}
+
+	// lo_file_name is truncated to 64 bytes, read the magic through the loop device itself
+	magic := make([]byte, 6)
+	if _, err := loop.ReadAt(magic, 0); err == io.EOF {
+		return false, nil // empty backing file
+	} else if err != nil {
+		return false, fmt.Errorf("%v (backing file %v): %v", loopPath, fixedArrayToString(info.File_name[:]), err)
+	}
+	return bytes.Equal(magic, []byte("LUKS\xba\xbe")), nil
+}
@@ -0,0 +1,82 @@
+package luks
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoopDeviceAttach(t *testing.T) {
+	if _, err := os.Stat("/dev/loop-control"); err != nil || os.Geteuid() != 0 {
+		t.Skip("loop devices are not available, the test requires root")
+	}
+
+	image, err := ioutil.TempFile("", "luks.go.loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(image.Name())
+	if err := image.Truncate(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	image.Close()
+
+	loopPath, closer, err := LoopDeviceAttach(image.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(loopPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := closer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListLUKSLoopDevices(t *testing.T) {
+	if _, err := os.Stat("/dev/loop-control"); err != nil || os.Geteuid() != 0 {
+		t.Skip("loop devices are not available, the test requires root")
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+	disk.Close()
+
+	plain, err := ioutil.TempFile("", "luks.go.loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(plain.Name())
+	if err := plain.Truncate(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+
+	luksLoop, _, err := LoopDeviceAttach(disk.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DetachLoopDevice(luksLoop)
+	plainLoop, _, err := LoopDeviceAttach(plain.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DetachLoopDevice(plainLoop)
+
+	devices, err := ListLUKSLoopDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var foundLuks, foundPlain bool
+	for _, d := range devices {
+		foundLuks = foundLuks || d == luksLoop
+		foundPlain = foundPlain || d == plainLoop
+	}
+	if !foundLuks {
+		t.Fatalf("loop device %v with LUKS image is not listed: %v", luksLoop, devices)
+	}
+	if foundPlain {
+		t.Fatalf("loop device %v without LUKS header is listed", plainLoop)
+	}
+}
@@ -2,7 +2,10 @@ package luks
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"syscall"
@@ -14,23 +17,75 @@ import (
 // error that indicates provided passphrase does not match
 var ErrPassphraseDoesNotMatch = fmt.Errorf("Passphrase does not match")
 
+// ErrKeyslotCorrupt indicates a keyslot with malformed or inconsistent metadata, e.g. invalid base64 salt or
+// an area outside of the keyslots region. Retrying the keyslot with another passphrase does not help.
+var ErrKeyslotCorrupt = fmt.Errorf("keyslot is corrupt")
+
+// ErrKeyslotUnsupported indicates a keyslot that uses a keyslot type, KDF, hash, cipher or anti-forensic
+// splitter that is not implemented. Other keyslots of the device may still be usable.
+var ErrKeyslotUnsupported = fmt.Errorf("keyslot is not supported")
+
+// ErrNotLUKS indicates that the device does not start with LUKS header magic
+var ErrNotLUKS = fmt.Errorf("Device is not a LUKS device")
+
 // a parameter that indicates passphrase should be tried with all active slots
 const AnyKeyslot = -1
 
-type volumeInfo struct {
-	key               []byte
-	digestId          int // id of the digest that matches the key
+// VolumeInfo describes an unlocked volume: the volume key and parameters of the encrypted storage segment
+type VolumeInfo struct {
+	key               []byte        // volume key, it points to keySecret memory if the key is set with setKey
+	keySecret         *SecretBuffer // locked memory that holds the volume key
+	digestId          int           // id of the digest that matches the key
 	luksType          string
 	storageEncryption string
 	storageIvTweak    uint64
 	storageSectorSize uint64
-	storageOffset     uint64 // offset of underlying storage in sectors
-	storageSize       uint64 // length of underlying device in sectors, zero means that size should be calculated using `diskSize` function
+	storageOffset     uint64        // offset of underlying storage in sectors
+	storageSize       uint64        // length of underlying device in sectors, zero means that size should be calculated using `diskSize` function
+	storageIntegrity  string        // dm-integrity algorithm of the segment, empty if the segment has no integrity protection
+	storageFlags      []string      // optional dm-crypt table parameters, e.g. allow_discards
+	segments          []SegmentInfo // all LUKS2 segments encrypted with the key ordered by offset, the storage* fields describe the first one
+}
+
+// Segments returns geometry of the data segments encrypted with the volume key. A volume has several segments
+// only while it is being reencrypted, segments may differ in sector size then.
+func (v *VolumeInfo) Segments() []SegmentInfo {
+	return v.segments
+}
+
+// setKey moves the volume key into locked memory, `key` is zeroed
+func (v *VolumeInfo) setKey(key []byte) {
+	v.keySecret = secretFromBytes(key)
+	v.key = v.keySecret.Bytes()
+}
+
+// VolumeKey returns a copy of the volume (master) key, e.g. to add a keyslot with AddKeyslotWithKey without knowing
+// any passphrase. The copy lives in the Go heap: clear it once it is not needed or pass it with
+// AddKeyslotOptions.ClearKey. It returns nil after Destroy.
+func (v *VolumeInfo) VolumeKey() []byte {
+	if v.key == nil {
+		return nil
+	}
+	return append([]byte(nil), v.key...)
+}
+
+// Destroy zeroes the volume key and releases the locked memory it is stored in. The volume cannot be activated
+// or read afterwards. Volumes returned by the unlock functions should be destroyed once they are not needed,
+// otherwise the locked memory is held until the process exits.
+func (v *VolumeInfo) Destroy() error {
+	if v.keySecret == nil {
+		clearSlice(v.key)
+		v.key = nil
+		return nil
+	}
+	err := v.keySecret.Destroy()
+	v.key, v.keySecret = nil, nil
+	return err
 }
 
 type luksDevice interface {
-	unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byte) (*volumeInfo, error)
-	unlockAnyKeyslot(f *os.File, passphrase []byte) (*volumeInfo, error)
+	unlockKeyslot(f io.ReaderAt, keyslotIdx int, passphrase []byte) (*VolumeInfo, error)
+	unlockAnyKeyslot(f io.ReaderAt, passphrase []byte, opts ...Option) (*VolumeInfo, error)
 	uuid() string
 }
 
@@ -40,64 +95,217 @@ const storageSectorSize = 512
 // default number of anti-forensic stripes
 const stripesNum = 4000
 
-func Open(dev string, name string, keyslot int, passphrase []byte) error {
+func Open(dev string, name string, keyslot int, passphrase []byte, opts ...Option) error {
+	o := buildOptions(opts)
+	return openDevice(dev, name, func(f *os.File, luks luksDevice) (*VolumeInfo, error) {
+		if d, ok := luks.(*Device); ok && o.readaheadSectors > 0 {
+			_ = d.adviseKeyslotReadahead(f, keyslot, o.readaheadSectors) // it is just a hint, ignore errors
+		}
+		return unlockDevice(f, luks, keyslot, passphrase, opts...)
+	}, opts...)
+}
+
+// Unlock recovers the volume key of the LUKS device stored at `r` without creating a dm-crypt mapping, e.g. to read
+// an image file or an in-memory image from NewImageFile with NewReaderAt. `keyslot` may be AnyKeyslot.
+func Unlock(r io.ReaderAt, keyslot int, passphrase []byte, opts ...Option) (*VolumeInfo, error) {
+	version, err := readLuksVersion(r)
+	if err != nil {
+		return nil, err
+	}
+	luks, err := luksOpen(version, r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return unlockDevice(r, luks, keyslot, passphrase, opts...)
+}
+
+// unlockDevice unlocks the keyslot, or any keyslot, with the passphrase normalized according to the options
+func unlockDevice(f io.ReaderAt, luks luksDevice, keyslot int, passphrase []byte, opts ...Option) (*VolumeInfo, error) {
+	o := buildOptions(opts)
+	if d, ok := luks.(*Device); ok {
+		if err := d.applyOptions(o); err != nil {
+			return nil, err
+		}
+	}
+	passphrase, wipe := o.normalizePassphrase(passphrase)
+	defer wipe()
+	var volume *VolumeInfo
+	var err error
+	if keyslot == AnyKeyslot {
+		volume, err = luks.unlockAnyKeyslot(f, passphrase, opts...)
+	} else {
+		volume, err = luks.unlockKeyslot(f, keyslot, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.warnVolume(volume)
+	return volume, nil
+}
+
+// unlockKeyslots tries the passphrase with the given keyslots in order and returns the volume together with
+// the index of the matching keyslot. Unsupported keyslots are always skipped, other keyslot errors abort
+// the unlock unless continueOnKeyslotError is set.
+func unlockKeyslots(f io.ReaderAt, luks luksDevice, keyslots []int, passphrase []byte, opts *options) (*VolumeInfo, int, error) {
+	var keyslotErr error
+	for _, k := range keyslots {
+		volumeKey, err := luks.unlockKeyslot(f, k, passphrase)
+		if err == nil {
+			return volumeKey, k, nil
+		} else if errors.Is(err, ErrPassphraseDoesNotMatch) {
+			continue
+		} else if opts.continueOnKeyslotError || errors.Is(err, ErrKeyslotUnsupported) {
+			if keyslotErr == nil {
+				keyslotErr = fmt.Errorf("keyslot %v: %w", k, err)
+			}
+			continue
+		} else {
+			return nil, 0, err
+		}
+	}
+	if keyslotErr != nil {
+		return nil, 0, fmt.Errorf("Passphrase does not match any readable keyslot, first keyslot error: %w", keyslotErr)
+	}
+	return nil, 0, ErrPassphraseDoesNotMatch
+}
+
+// OpenWithToken unlocks the device using passphrase provided by the token handler for LUKS2 token tokenIdx.
+// The options are applied the same way as by Open.
+func OpenWithToken(dev string, name string, tokenIdx int, h TokenHandler, opts ...Option) error {
+	return openDevice(dev, name, func(f *os.File, luks luksDevice) (*VolumeInfo, error) {
+		d, ok := luks.(*Device)
+		if !ok {
+			return nil, fmt.Errorf("tokens are supported by LUKS2 devices only")
+		}
+		return d.unlockWithToken(f, tokenIdx, h, opts...)
+	}, opts...)
+}
+
+func openDevice(dev string, name string, unlock func(f *os.File, luks luksDevice) (*VolumeInfo, error), opts ...Option) error {
 	f, err := os.Open(dev)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	// LUKS Magic and versions are stored in the first 8 bytes of the LUKS header
-	header := make([]byte, 8)
-	if _, err := f.ReadAt(header[:], 0); err != nil {
+	version, err := readLuksVersion(f)
+	if err != nil {
 		return err
 	}
 
-	// verify header magic
-	if !bytes.Equal(header[0:6], []byte("LUKS\xba\xbe")) {
-		return fmt.Errorf("invalid LUKS header")
+	luks, err := luksOpen(version, f, opts...)
+	if err != nil {
+		return err
 	}
 
-	luks, err := luksOpen(header, f)
+	volume, err := unlock(f, luks)
 	if err != nil {
 		return err
 	}
+	defer volume.Destroy()
 
-	var volume *volumeInfo
-	if keyslot == AnyKeyslot {
-		volume, err = luks.unlockAnyKeyslot(f, passphrase)
-	} else {
-		volume, err = luks.unlockKeyslot(f, keyslot, passphrase)
+	return activateVolume(f, dev, name, luks.uuid(), volume)
+}
+
+// ActivateDMCrypt creates dm-crypt mapping `dmName` for the unlocked volume stored at `dev`, e.g. a loop device.
+// The crypt target is loaded with the kernel cipher spec, IV offset and storage offset from `info`, the volume key
+// is passed via the kernel keyring and it is wiped from `info` afterwards.
+func ActivateDMCrypt(dev string, info *VolumeInfo, dmName string) error {
+	f, err := os.Open(dev)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	version, err := readLuksVersion(f)
+	if err != nil {
+		return err
 	}
+	luks, err := luksOpen(version, f)
 	if err != nil {
 		return err
 	}
-	defer clearSlice(volume.key)
+
+	return activateVolume(f, dev, dmName, luks.uuid(), info)
+}
+
+// DeactivateDMCrypt removes the dm-crypt mapping created with ActivateDMCrypt, it is the same as Close
+func DeactivateDMCrypt(dmName string) error {
+	return Close(dmName)
+}
+
+func activateVolume(f *os.File, dev string, name string, uuid string, volume *VolumeInfo) error {
+	if volume.storageIntegrity != "" {
+		return fmt.Errorf("%w: segment uses %v", ErrIntegrityUnsupported, volume.storageIntegrity)
+	}
+	if len(volume.segments) > 1 {
+		return fmt.Errorf("activation of a volume with %v segments is not supported, the reencryption needs to be finished first", len(volume.segments))
+	}
 
 	if volume.storageSize == 0 {
+		var err error
 		volume.storageSize, err = calculatePartitionSize(f, volume)
 		if err != nil {
 			return err
 		}
 	}
 
-	return createDmDevice(dev, name, luks.uuid(), volume)
+	return createDmDevice(dev, name, uuid, volume)
 }
 
-func luksOpen(header []byte, f *os.File) (luksDevice, error) {
-	version := int(header[6])<<8 + int(header[7])
+// IsLUKS checks whether the device starts with a LUKS header, it is an equivalent of `cryptsetup isLuks`.
+// Only the header magic and version are read, the header checksum and metadata are not verified.
+// It returns the header version (1 or 2) for LUKS devices.
+func IsLUKS(f io.ReaderAt) (int, bool) {
+	version, err := readLuksVersion(f)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
 
+// readLuksVersion verifies LUKS header magic and returns the header version. ErrNotLUKS is returned if the magic
+// does not match, e.g. for unformatted or BitLocker devices.
+func readLuksVersion(r io.ReaderAt) (int, error) {
+	version, err := ReadVersionFromMagic(io.NewSectionReader(r, 0, 8))
+	return int(version), err
+}
+
+// ReadVersionFromMagic reads the first 8 bytes of a LUKS header, the magic and the version, from `r` and returns
+// the header version (1 or 2). It reads exactly 8 bytes thus works with streams like pipes or network connections.
+// ErrNotLUKS is returned if the magic does not match or the stream is shorter than 8 bytes.
+func ReadVersionFromMagic(r io.Reader) (uint16, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, ErrNotLUKS // too small to contain a header
+	} else if err != nil {
+		return 0, err
+	}
+
+	// LUKS1 and LUKS2 share the same magic, the version field tells them apart
+	if !bytes.Equal(header[0:6], []byte("LUKS\xba\xbe")) {
+		return 0, ErrNotLUKS
+	}
+
+	version := binary.BigEndian.Uint16(header[6:8])
+	if version != 1 && version != 2 {
+		return 0, fmt.Errorf("invalid LUKS version %v", version)
+	}
+	return version, nil
+}
+
+func luksOpen(version int, f io.ReaderAt, opts ...Option) (luksDevice, error) {
 	switch version {
 	case 1:
 		return luks1OpenDevice(f)
 	case 2:
-		return luks2OpenDevice(f)
+		return luks2OpenDevice(f, opts...)
 	default:
 		return nil, fmt.Errorf("invalid LUKS version %v", version)
 	}
 }
 
-func createDmDevice(dev string, dmName string, partitionUuid string, volume *volumeInfo) error {
+func createDmDevice(dev string, dmName string, partitionUuid string, volume *VolumeInfo) error {
 	// load key into keyring
 	keyname := fmt.Sprintf("cryptsetup:%s-d%d", partitionUuid, volume.digestId) // get_key_description_by_digest
 	kid, err := unix.AddKey("logon", keyname, volume.key, unix.KEY_SPEC_THREAD_KEYRING)
@@ -124,7 +332,7 @@ func createDmDevice(dev string, dmName string, partitionUuid string, volume *vol
 	}
 
 	keyid := fmt.Sprintf(":%v:logon:%v", len(volume.key), keyname)
-	storageArg := fmt.Sprintf("%v %v %v %v %v %v", volume.storageEncryption, keyid, volume.storageIvTweak, dev, volume.storageOffset, "0") // see get_dm_crypt_params() for more info about formatting this parameter
+	storageArg := cryptTableArgs(dev, keyid, volume)
 
 	spec := []targetSpec{{
 		sectorStart: 0, // always zero
@@ -146,8 +354,17 @@ func createDmDevice(dev string, dmName string, partitionUuid string, volume *vol
 	return nil
 }
 
+// cryptTableArgs formats dm-crypt target arguments, see get_dm_crypt_params() in cryptsetup
+func cryptTableArgs(dev string, keyid string, volume *VolumeInfo) string {
+	args := fmt.Sprintf("%v %v %v %v %v %v", volume.storageEncryption, keyid, volume.storageIvTweak, dev, volume.storageOffset, len(volume.storageFlags))
+	for _, f := range volume.storageFlags {
+		args += " " + f
+	}
+	return args
+}
+
 // calculatePartitionSize dynamically calculates the size of storage in sector size
-func calculatePartitionSize(f *os.File, volumeKey *volumeInfo) (uint64, error) {
+func calculatePartitionSize(f *os.File, volumeKey *VolumeInfo) (uint64, error) {
 	s, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKGETSIZE64)
 	if err != nil {
 		return 0, err
@@ -168,6 +385,13 @@ type targetSpec struct {
 }
 
 func dmIoctl(controlFile *os.File, cmd int, name string, uuid string, specs []targetSpec) error {
+	_, err := dmIoctlData(controlFile, cmd, 0, name, uuid, specs, 0)
+	return err
+}
+
+// dmIoctlData performs a device mapper ioctl call with the given flags. `outSize` bytes are reserved
+// for the kernel output after the input data. It returns the whole ioctl buffer.
+func dmIoctlData(controlFile *os.File, cmd int, flags uint32, name string, uuid string, specs []targetSpec, outSize int) ([]byte, error) {
 	// allocate buffer large enough for dmioctl + specs
 	const alignment = 8
 
@@ -176,6 +400,7 @@ func dmIoctl(controlFile *os.File, cmd int, name string, uuid string, specs []ta
 		length += unix.SizeofDmTargetSpec
 		length += roundUp(len(s.args)+1, alignment) // adding 1 for terminating NUL, then align the data
 	}
+	length += outSize
 
 	data := make([]byte, length, length)
 	var idx uintptr
@@ -186,6 +411,7 @@ func dmIoctl(controlFile *os.File, cmd int, name string, uuid string, specs []ta
 	ioctlData.Data_size = uint32(length)
 	ioctlData.Data_start = unix.SizeofDmIoctl
 	ioctlData.Target_count = uint32(len(specs))
+	ioctlData.Flags = flags
 	idx += unix.SizeofDmIoctl
 
 	for _, s := range specs {
@@ -206,9 +432,9 @@ func dmIoctl(controlFile *os.File, cmd int, name string, uuid string, specs []ta
 		uintptr(unsafe.Pointer(&data[0])),
 	)
 	if err != 0 {
-		return os.NewSyscallError(fmt.Sprintf("dm ioctl (cmd=0x%x)", cmd), err)
+		return nil, os.NewSyscallError(fmt.Sprintf("dm ioctl (cmd=0x%x)", cmd), err)
 	}
-	return nil
+	return data, nil
 }
 
 func unlinkKey(kid int) {
@@ -1,16 +1,15 @@
 package luks
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"fmt"
 	"golang.org/x/crypto/pbkdf2"
-	"golang.org/x/crypto/xts"
 	"hash"
-	"os"
+	"io"
+	"strings"
+
+	"github.com/anatol/luks.go/internal/crypto"
 )
 
 // LUKS v1 format is specified here
@@ -38,17 +37,17 @@ type keySlot struct {
 	Stripes           uint32
 }
 
+// keyslot 'active' field value of an enabled LUKS1 keyslot
+const luksKeyEnabled = 0xAC71F3
+
 type luks1Device struct {
 	hdr *headerV1
 }
 
-func luks1OpenDevice(f *os.File) (*luks1Device, error) {
+func luks1OpenDevice(f io.ReaderAt) (*luks1Device, error) {
 	var hdr headerV1
 
-	if _, err := f.Seek(0, 0); err != nil {
-		return nil, err
-	}
-	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
 		return nil, err
 	}
 
@@ -59,7 +58,7 @@ func (d *luks1Device) uuid() string {
 	return fixedArrayToString(d.hdr.UUID[:])
 }
 
-func (d *luks1Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byte) (*volumeInfo, error) {
+func (d *luks1Device) unlockKeyslot(f io.ReaderAt, keyslotIdx int, passphrase []byte) (*VolumeInfo, error) {
 	header := d.hdr
 
 	keyslots := header.KeySlots
@@ -73,24 +72,24 @@ func (d *luks1Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byt
 		return nil, err
 	}
 
-	afKey := deriveLuks1AfKey(passphrase, slot, int(header.KeyBytes), h)
-	defer clearSlice(afKey)
+	afKey := secretFromBytes(deriveLuks1AfKey(passphrase, slot, int(header.KeyBytes), h))
+	defer afKey.Destroy()
 
-	finalKey, err := decryptLuks1VolumeKey(f, keyslotIdx, header, slot, afKey, h)
+	finalKey, err := decryptLuks1VolumeKey(f, keyslotIdx, header, slot, afKey.Bytes(), h)
 	if err != nil {
 		return nil, err
 	}
+	defer clearSlice(finalKey)
 
 	// verify with digest
 	generatedDigest := pbkdf2.Key(finalKey, header.MkDigestSalt[:], int(header.MkDigestIter), int(header.KeyBytes), h)
 	defer clearSlice(generatedDigest)
-	if !bytes.Equal(generatedDigest[:20], header.MkDigest[:]) {
+	if subtle.ConstantTimeCompare(generatedDigest[:20], header.MkDigest[:]) != 1 {
 		return nil, ErrPassphraseDoesNotMatch
 	}
 
 	encryption := fixedArrayToString(header.CipherName[:]) + "-" + fixedArrayToString(header.CipherMode[:])
-	info := &volumeInfo{
-		key:               finalKey,
+	info := &VolumeInfo{
 		digestId:          0,
 		luksType:          "LUKS1",
 		storageSize:       0, // dynamic size
@@ -99,34 +98,29 @@ func (d *luks1Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byt
 		storageIvTweak:    0,
 		storageSectorSize: storageSectorSize,
 	}
+	info.setKey(finalKey)
 
 	return info, nil
 }
 
-func (d *luks1Device) unlockAnyKeyslot(f *os.File, passphrase []byte) (*volumeInfo, error) {
+func (d *luks1Device) unlockAnyKeyslot(f io.ReaderAt, passphrase []byte, opts ...Option) (*VolumeInfo, error) {
+	var activeKeyslots []int
 	for k, s := range d.hdr.KeySlots {
-		const luksKeyEnabled = 0xAC71F3
 		if s.Active != luksKeyEnabled {
 			continue
 		}
-
-		volumeKey, err := d.unlockKeyslot(f, k, passphrase)
-		if err == nil {
-			return volumeKey, nil
-		} else if err == ErrPassphraseDoesNotMatch {
-			continue
-		} else {
-			return nil, err
-		}
+		activeKeyslots = append(activeKeyslots, k)
 	}
-	return nil, ErrPassphraseDoesNotMatch
+
+	volume, _, err := unlockKeyslots(f, d, activeKeyslots, passphrase, buildOptions(opts))
+	return volume, err
 }
 
-func decryptLuks1VolumeKey(f *os.File, keyslotIdx int, hdr *headerV1, slot keySlot, afKey []byte, h func() hash.Hash) ([]byte, error) {
+func decryptLuks1VolumeKey(f io.ReaderAt, keyslotIdx int, hdr *headerV1, slot keySlot, afKey []byte, h func() hash.Hash) ([]byte, error) {
 	// decrypt keyslotIdx area using the derived key
 	keyslotSize := hdr.KeyBytes * stripesNum
 	if keyslotSize%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] size %v is not multiple of the sector size %v", keyslotIdx, keyslotSize, storageSectorSize)
+		return nil, fmt.Errorf("%w: keyslot[%v] size %v is not multiple of the sector size %v", ErrKeyslotCorrupt, keyslotIdx, keyslotSize, storageSectorSize)
 	}
 	keyData := make([]byte, keyslotSize)
 	defer clearSlice(keyData)
@@ -137,7 +131,7 @@ func decryptLuks1VolumeKey(f *os.File, keyslotIdx int, hdr *headerV1, slot keySl
 
 	ciph, err := buildLuks1AfCipher(hdr, afKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrKeyslotUnsupported, err)
 	}
 
 	for i := 0; i < int(keyslotSize/storageSectorSize); i++ {
@@ -152,24 +146,17 @@ func decryptLuks1VolumeKey(f *os.File, keyslotIdx int, hdr *headerV1, slot keySl
 	return afMerge(keyData, int(hdr.KeyBytes), int(slot.Stripes), h())
 }
 
-func buildLuks1AfCipher(hdr *headerV1, afKey []byte) (*xts.Cipher, error) {
-	var cipherFunc func(key []byte) (cipher.Block, error)
-
+func buildLuks1AfCipher(hdr *headerV1, afKey []byte) (sectorCipher, error) {
 	cipherName := fixedArrayToString(hdr.CipherName[:])
-	switch cipherName {
-	case "aes":
-		cipherFunc = aes.NewCipher
-	default:
-		return nil, fmt.Errorf("Unknown cipher: %v", cipherName)
-	}
 
+	// example of `cipherMode` value is 'xts-plain64'
 	cipherMode := fixedArrayToString(hdr.CipherMode[:])
-	switch cipherMode {
-	case "xts-plain64":
-		return xts.NewCipher(cipherFunc, afKey)
-	default:
-		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
+	modeParts := strings.SplitN(cipherMode, "-", 2)
+	if len(modeParts) != 2 {
+		return nil, fmt.Errorf("Unexpected cipher mode format: %v", cipherMode)
 	}
+
+	return buildSectorCipher(cipherName, modeParts[0], modeParts[1], afKey)
 }
 
 func deriveLuks1AfKey(passphrase []byte, slot keySlot, keySize int, h func() hash.Hash) []byte {
@@ -177,10 +164,9 @@ func deriveLuks1AfKey(passphrase []byte, slot keySlot, keySize int, h func() has
 }
 
 func luks1Hash(hashSpecName string) (func() hash.Hash, error) {
-	switch hashSpecName {
-	case "sha256":
-		return sha256.New, nil
-	default:
-		return nil, fmt.Errorf("Unknown hash spec algorithm: %v", hashSpecName)
+	h, _, err := crypto.GetHashFunc(hashSpecName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown hash spec algorithm: %v", ErrKeyslotUnsupported, hashSpecName)
 	}
+	return h, nil
 }
@@ -2,25 +2,34 @@ package luks
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash"
+	"hash/crc32"
+	"io"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 	"unsafe"
 
+	"github.com/anatol/luks.go/internal/crypto"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
-	"golang.org/x/crypto/xts"
 )
 
+// ErrOPALUnsupported indicates that the data is encrypted by an OPAL self-encrypting drive. Such devices are
+// unlocked by the drive firmware, the volume key from the keyslot cannot be used with dm-crypt alone.
+var ErrOPALUnsupported = fmt.Errorf("LUKS2 devices with OPAL hardware encryption are not supported")
+
+// ErrIntegrityUnsupported indicates that the data segment is protected with dm-integrity. The volume key can be
+// recovered but activation requires a dm-integrity device stacked under dm-crypt that is not implemented yet.
+var ErrIntegrityUnsupported = fmt.Errorf("activation of LUKS2 devices with dm-integrity is not supported")
+
 // LUKS v2 format is specified here
 // https://habd.as/post/external-backup-drive-encryption/assets/luks2_doc_wip.pdf
 type headerV2 struct {
@@ -39,97 +48,301 @@ type headerV2 struct {
 	// padding of size 7*512
 }
 
-type luks2Device struct {
+// Device is a parsed LUKS2 header. It gives access to the metadata and to operations on keyslots, tokens and the
+// header itself. Methods that modify the device take the file to write to explicitly.
+type Device struct {
 	hdr  *headerV2
 	meta *metadata
+
+	physicalBlockSize int      // alignment of keyslot area reads, 0 means no alignment
+	argon2Parallelism int      // overrides argon2 'cpus' of keyslots if not 0
+	reservedAreas     []region // areas allocated by NewKeyslotArea that are not used by a keyslot yet
 }
 
-func luks2OpenDevice(f *os.File) (*luks2Device, error) {
-	var hdr headerV2
+// OpenDevice reads and verifies the LUKS2 header stored at `r`. ErrNotLUKS is returned if `r` does not start with
+// LUKS header magic. LUKS1 devices can be unlocked with Open and Unlock but are not supported by OpenDevice.
+func OpenDevice(r io.ReaderAt, opts ...Option) (*Device, error) {
+	version, err := readLuksVersion(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != 2 {
+		return nil, fmt.Errorf("LUKS version %v is not supported, OpenDevice works with LUKS2 devices only", version)
+	}
+	return luks2OpenDevice(r, opts...)
+}
+
+func luks2OpenDevice(f io.ReaderAt, opts ...Option) (*Device, error) {
+	hdr, data, err := readLuks2Header(f, 0)
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := f.Seek(0, 0); err != nil {
+	var meta metadata
+	jsonData, err := luks2JsonData(hdr, data)
+	if err != nil {
 		return nil, err
 	}
-	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
+
+	if buildOptions(opts).legacyCompat {
+		jsonData, err = convertLegacyMetadata(jsonData)
+		if err != nil {
+			return nil, fmt.Errorf("legacy metadata conversion: %v", err)
+		}
+	}
+	if err := unmarshalMetadata(jsonData, &meta); err != nil {
 		return nil, err
 	}
+	if meta.Keyslots == nil && bytes.Contains(jsonData, []byte(`"key_slots"`)) {
+		return nil, fmt.Errorf("metadata uses pre-release LUKS2 key names, it can be opened with WithLegacyCompat option")
+	}
+	jsonSize, err := meta.Config.JsonSize.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config.json_size value: %v", err)
+	}
+	if uint64(jsonSize) != JsonAreaSize(hdr) {
+		return nil, fmt.Errorf("config.json_size %v does not match the JSON area size %v", jsonSize, JsonAreaSize(hdr))
+	}
+
+	dev := &Device{
+		hdr:  hdr,
+		meta: &meta,
+	}
+	return dev, nil
+}
+
+// luks2JsonData returns the NUL terminated JSON metadata from the header data read by readLuks2Header
+func luks2JsonData(hdr *headerV2, data []byte) ([]byte, error) {
+	jsonData := data[JsonAreaOffset() : JsonAreaOffset()+JsonAreaSize(hdr)]
+	end := bytes.IndexByte(jsonData, 0)
+	if end == -1 {
+		return nil, fmt.Errorf("JSON metadata is not terminated within the JSON area of size %v", len(jsonData))
+	}
+	return jsonData[:end], nil
+}
+
+// size of the binary header, the JSON area follows it
+const luks2BinaryHeaderSize = 4096
+
+// JsonAreaOffset returns offset of the JSON area relative to the start of a LUKS2 header copy
+func JsonAreaOffset() uint64 {
+	return luks2BinaryHeaderSize
+}
+
+// JsonAreaSize returns size of the JSON area of the header, i.e. the header size without the binary header.
+// A valid header has config.json_size equal to this value.
+func JsonAreaSize(hdr *headerV2) uint64 {
+	return JsonSizeFromHeaderSize(hdr.HeaderSize)
+}
+
+// JsonSizeFromHeaderSize returns size of the JSON area for the given LUKS2 header size
+func JsonSizeFromHeaderSize(headerSize uint64) uint64 {
+	return headerSize - luks2BinaryHeaderSize
+}
+
+// readLuks2Header reads the binary header and JSON area located at the given offset and verifies the header
+// checksum. It returns the parsed binary header and the whole checksummed header data.
+func readLuks2Header(r io.ReaderAt, offset int64) (*headerV2, []byte, error) {
+	var hdr headerV2
+	if err := binary.Read(io.NewSectionReader(r, offset, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
+		return nil, nil, err
+	}
 
 	hdrSize := hdr.HeaderSize // size of header + JSON metadata
-	if !isPowerOfTwo(uint(hdrSize)) || hdrSize < 16384 || hdrSize > 4194304 {
-		return nil, fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
+	if !isPowerOfTwo(uint(hdrSize)) || hdrSize < minHeaderSize || hdrSize > maxHeaderSize {
+		return nil, nil, fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
 	}
 
 	// read the whole header
 	data := make([]byte, hdrSize)
-	if _, err := f.ReadAt(data, 0); err != nil {
-		return nil, err
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, nil, err
 	}
 
-	for i := 0; i < 64; i++ {
-		// clear the checksum
-		data[int(unsafe.Offsetof(hdr.Checksum))+i] = 0
+	// calculate the checksum of the whole header
+	checksum, err := luks2HeaderChecksum(data, fixedArrayToString(hdr.ChecksumAlgorithm[:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	expectedChecksum := hdr.Checksum[:len(checksum)]
+	if !bytes.Equal(checksum, expectedChecksum) {
+		return nil, nil, fmt.Errorf("Invalid header checksum")
 	}
 
-	// calculate the checksum of the whole header
-	var h hash.Hash
-	algo := fixedArrayToString(hdr.ChecksumAlgorithm[:])
-	switch algo {
-	case "sha256":
-		h = sha256.New()
-	default:
+	return &hdr, data, nil
+}
+
+func utf8FixedArrayToString(buff []byte, name string) (string, error) {
+	s := fixedArrayToString(buff)
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("header %v is not a valid UTF-8 string: %q", name, s)
+	}
+	return s, nil
+}
+
+// luks2HeaderChecksum calculates the checksum of the whole header area (binary header + JSON metadata).
+// The checksum field itself is treated as zeroed.
+func luks2HeaderChecksum(data []byte, algo string) ([]byte, error) {
+	// some tools other than cryptsetup store the name in upper case or pad it with spaces
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	newHash, _, err := crypto.GetHashFunc(algo)
+	if err != nil {
 		return nil, fmt.Errorf("Unknown header checksum algorithm: %v", algo)
 	}
+	h := newHash()
 
-	h.Write(data)
+	var hdr headerV2
+	checksumOffset := int(unsafe.Offsetof(hdr.Checksum))
+	checksumSize := len(hdr.Checksum)
 
-	checksum := h.Sum(make([]byte, 0))
-	expectedChecksum := hdr.Checksum[:h.Size()]
-	if !bytes.Equal(checksum, expectedChecksum) {
-		return nil, fmt.Errorf("Invalid header checksum")
+	h.Write(data[:checksumOffset])
+	h.Write(make([]byte, checksumSize))
+	h.Write(data[checksumOffset+checksumSize:])
+
+	return h.Sum(nil), nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CalculateHeaderCRC32 returns CRC-32C of the header area (binary header + JSON metadata) with the checksum field
+// treated as zeroed, the same data as covered by the header checksum. It is meant for fast change detection,
+// e.g. to skip a full verification when a repeatedly read header has not changed. CRC is not a cryptographic
+// checksum and LUKS2 does not allow it as the header checksum algorithm, thus it is not stored on disk.
+func CalculateHeaderCRC32(data []byte) uint32 {
+	var hdr headerV2
+	checksumOffset := int(unsafe.Offsetof(hdr.Checksum))
+	checksumSize := len(hdr.Checksum)
+	if len(data) < checksumOffset+checksumSize {
+		return crc32.Checksum(data, crc32cTable)
 	}
 
-	var meta metadata
-	jsonData := data[4096:]
-	jsonData = jsonData[:bytes.IndexByte(jsonData, 0)]
+	crc := crc32.Update(0, crc32cTable, data[:checksumOffset])
+	crc = crc32.Update(crc, crc32cTable, make([]byte, checksumSize))
+	return crc32.Update(crc, crc32cTable, data[checksumOffset+checksumSize:])
+}
+
+// luks2HeaderBytes serializes the binary header followed by the JSON metadata area and sets the header checksum
+func luks2HeaderBytes(hdr *headerV2, jsonData []byte) ([]byte, error) {
+	if uint64(len(jsonData)) >= JsonAreaSize(hdr) { // the JSON has to be followed by at least one NUL byte
+		return nil, fmt.Errorf("JSON metadata of size %v does not fit into the header of size %v", len(jsonData), hdr.HeaderSize)
+	}
 
-	if err := json.Unmarshal(jsonData, &meta); err != nil {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
 		return nil, err
 	}
 
-	dev := &luks2Device{
-		hdr:  &hdr,
-		meta: &meta,
+	data := make([]byte, hdr.HeaderSize)
+	copy(data, buf.Bytes())
+	copy(data[JsonAreaOffset():], jsonData)
+
+	checksum, err := luks2HeaderChecksum(data, fixedArrayToString(hdr.ChecksumAlgorithm[:]))
+	if err != nil {
+		return nil, err
 	}
-	return dev, nil
+	checksumOffset := int(unsafe.Offsetof(hdr.Checksum))
+	checksumData := data[checksumOffset : checksumOffset+len(hdr.Checksum)]
+	clearSlice(checksumData)
+	copy(checksumData, checksum)
+
+	return data, nil
+}
+
+// UpdateHeader writes the in-memory metadata to both the primary and the secondary header
+// and increments the header sequence id. The secondary header is written first so an interrupted
+// update leaves the primary header intact, the same way as cryptsetup does.
+func (d *Device) UpdateHeader(f *os.File) error {
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+
+	return d.writeHeaders(f, d.hdr.HeaderSize, 0)
+}
+
+// writeHeaders writes header copies at `offsets` in the given order with an incremented sequence id
+func (d *Device) writeHeaders(f *os.File, offsets ...uint64) error {
+	jsonData, err := json.Marshal(d.meta)
+	if err != nil {
+		return err
+	}
+
+	hdr := *d.hdr
+	hdr.SequenceId++
+	for _, offset := range offsets {
+		hdr.HeaderOffset = offset
+		data, err := luks2HeaderBytes(&hdr, jsonData)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data, int64(offset)); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	d.hdr.SequenceId = hdr.SequenceId
+	d.releaseUsedKeyslotAreas()
+	return nil
 }
 
-func (d *luks2Device) uuid() string {
+func (d *Device) uuid() string {
 	return fixedArrayToString(d.hdr.UUID[:])
 }
 
-func (d *luks2Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byte) (*volumeInfo, error) {
-	keyslots := d.meta.Keyslots
-	if keyslotIdx < 0 || keyslotIdx >= len(keyslots) {
-		return nil, fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+// Label returns the LUKS2 header label. An error is returned if the label is not a valid UTF-8 string.
+func (d *Device) Label() (string, error) {
+	return utf8FixedArrayToString(d.hdr.Label[:], "label")
+}
+
+// SubsystemLabel returns the LUKS2 header subsystem label. An error is returned if the label is not a valid UTF-8 string.
+func (d *Device) SubsystemLabel() (string, error) {
+	return utf8FixedArrayToString(d.hdr.SubsystemLabel[:], "subsystem label")
+}
+
+func (d *Device) unlockKeyslot(f io.ReaderAt, keyslotIdx int, passphrase []byte) (*VolumeInfo, error) {
+	keyslot, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return nil, fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+	if keyslot.Type == erasedKeyslotType {
+		return nil, fmt.Errorf("%w: keyslot %d is erased", ErrKeyslotUnsupported, keyslotIdx)
+	}
+	if keyslot.Type != "luks2" {
+		return nil, fmt.Errorf("%w: keyslot %d has type %v", ErrKeyslotUnsupported, keyslotIdx, keyslot.Type)
+	}
+
+	if d.meta.usesOpal() {
+		return nil, ErrOPALUnsupported
+	}
+	// fail before the expensive KDF run
+	if err := keyslot.Af.validate(); err != nil {
+		return nil, fmt.Errorf("keyslot %d: %w", keyslotIdx, err)
 	}
 
-	keyslot := keyslots[keyslotIdx]
+	afKey, err := deriveLuks2AfKey(d.keyslotKdf(keyslot), keyslotIdx, passphrase, keyslot.Area.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer afKey.Destroy()
 
-	afKey, err := deriveLuks2AfKey(keyslot.Kdf, keyslotIdx, passphrase, keyslot.KeySize)
+	keyData, err := d.KeyslotAreaRead(f, keyslotIdx)
 	if err != nil {
 		return nil, err
 	}
-	defer clearSlice(afKey)
+	defer clearSlice(keyData)
 
-	finalKey, err := decryptLuks2VolumeKey(f, keyslotIdx, keyslot, afKey)
+	finalKey, err := decryptLuks2VolumeKey(keyData, keyslotIdx, keyslot, afKey.Bytes())
 	if err != nil {
 		return nil, err
 	}
+	defer clearSlice(finalKey)
 
 	// verify with digest
 	digIdx, digInfo := d.findDigestForKeyslot(keyslotIdx)
 	if digInfo == nil {
-		return nil, fmt.Errorf("No digest is found for keyslot %v", keyslotIdx)
+		return nil, ErrKeyslotWithoutDigest{Index: keyslotIdx}
 	}
 
 	generatedDigest, err := computeDigestForKey(digInfo, keyslotIdx, finalKey)
@@ -140,29 +353,56 @@ func (d *luks2Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byt
 
 	expectedDigest, err := base64.StdEncoding.DecodeString(digInfo.Digest)
 	if err != nil {
-		return nil, fmt.Errorf("keyslotIdx[%v].digest.Digest base64 parsing failed: %v", keyslotIdx, err)
+		return nil, fmt.Errorf("%w: keyslotIdx[%v].digest.Digest base64 parsing failed: %v", ErrKeyslotCorrupt, keyslotIdx, err)
 	}
-	if !bytes.Equal(generatedDigest, expectedDigest) {
+	if subtle.ConstantTimeCompare(generatedDigest, expectedDigest) != 1 {
 		return nil, ErrPassphraseDoesNotMatch
 	}
 	clearSlice(generatedDigest)
 
-	if len(digInfo.Segments) != 1 {
-		return nil, fmt.Errorf("LUKS partition expects exactly 1 storage segment, got %+v", len(digInfo.Segments))
+	if len(digInfo.Segments) == 0 {
+		return nil, fmt.Errorf("LUKS partition expects at least 1 storage segment for digest %v", digIdx)
 	}
-	seg, err := digInfo.Segments[0].Int64()
-	if err != nil {
-		return nil, err
+	// during reencryption one digest may cover several segments, each with its own geometry
+	var segments []SegmentInfo
+	for _, s := range digInfo.Segments {
+		seg, err := s.Int64()
+		if err != nil {
+			return nil, err
+		}
+		segInfo, err := d.segmentInfo(int(seg))
+		if err != nil {
+			return nil, err
+		}
+		if segInfo.IsBackup() {
+			continue // backup segments are for reencryption recovery only, they do not map data
+		}
+		if segInfo.SectorSize < storageSectorSize || segInfo.SectorSize > 4096 || !isPowerOfTwo(segInfo.SectorSize) {
+			return nil, fmt.Errorf("segment[%v] has invalid sector size %v", seg, segInfo.SectorSize)
+		}
+		segments = append(segments, segInfo)
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("digest %v covers backup segments only", digIdx)
 	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Offset < segments[j].Offset })
 
-	storageSegment := d.meta.Segments[int(seg)]
+	// the top level volume parameters describe the first segment
+	storageSegment := d.meta.Segments[segments[0].Index]
 	offset, err := storageSegment.Offset.Int64()
 	if err != nil {
 		return nil, err
 	}
 
 	var storageSize uint64
-	if storageSegment.Size != "dynamic" {
+	if storageSegment.Size == "dynamic" {
+		deviceSize, err := dynamicSegmentSize(f, uint64(offset))
+		if err != nil {
+			return nil, err
+		}
+		// a partial sector at the end of the device is not used
+		storageSize = deviceSize - deviceSize%uint64(storageSegment.SectorSize)
+	} else {
 		size, err := strconv.Atoi(storageSegment.Size)
 		if err != nil {
 			return nil, err
@@ -170,6 +410,9 @@ func (d *luks2Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byt
 		if size == 0 {
 			return nil, fmt.Errorf("invalid segment size: %v", size)
 		}
+		if uint64(size)%uint64(storageSegment.SectorSize) != 0 {
+			return nil, fmt.Errorf("segment size %v is not multiple of the sector size %v", size, storageSegment.SectorSize)
+		}
 
 		storageSize = uint64(size)
 	}
@@ -179,8 +422,7 @@ func (d *luks2Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byt
 		return nil, err
 	}
 
-	info := &volumeInfo{
-		key:               finalKey,
+	info := &VolumeInfo{
 		digestId:          digIdx,
 		luksType:          "LUKS2",
 		storageSize:       storageSize / uint64(storageSegment.SectorSize),
@@ -189,170 +431,186 @@ func (d *luks2Device) unlockKeyslot(f *os.File, keyslotIdx int, passphrase []byt
 		storageIvTweak:    uint64(ivTweak),
 		storageSectorSize: uint64(storageSegment.SectorSize),
 	}
+	info.setKey(finalKey)
+	info.storageFlags = d.meta.dmCryptFlags()
+	info.segments = segments
+	if storageSegment.Integrity != nil && storageSegment.Integrity.Type != "none" {
+		info.storageIntegrity = storageSegment.Integrity.Type
+	}
 	return info, nil
 }
 
-func (d *luks2Device) unlockAnyKeyslot(f *os.File, passphrase []byte) (*volumeInfo, error) {
-	// first we iterate over "high"-priority slots, then "normal"
-	var highPrio, normPrio []int
-	for k, v := range d.meta.Keyslots {
-		if v.Priority == "2" {
+// keyslotKdf returns the KDF parameters used to unlock the keyslot, with the parallelism override applied
+func (d *Device) keyslotKdf(ks keyslot) kdf {
+	params := ks.Kdf
+	if d.argon2Parallelism > 0 && (params.Type == "argon2i" || params.Type == "argon2id") {
+		params.Cpus = uint(d.argon2Parallelism)
+	}
+	return params
+}
+
+func (d *Device) unlockAnyKeyslot(f io.ReaderAt, passphrase []byte, opts ...Option) (*VolumeInfo, error) {
+	highPrio, normPrio, _ := d.keyslotsByPriority()
+	activeKeyslots := append(highPrio, normPrio...)
+
+	volume, _, err := unlockKeyslots(f, d, activeKeyslots, passphrase, buildOptions(opts))
+	return volume, err
+}
+
+// keyslotsByPriority returns sorted indexes of "high", "normal" and "ignore" priority keyslots. Erased keyslots
+// are ignored regardless of their priority.
+func (d *Device) keyslotsByPriority() (highPrio, normPrio, ignored []int) {
+	for k, ks := range d.meta.Keyslots {
+		prio, err := d.keyslotPriority(k)
+		switch {
+		case ks.Type == erasedKeyslotType || err != nil:
+			ignored = append(ignored, k)
+		case prio == KeyslotPriorityHigh:
 			highPrio = append(highPrio, k)
-		} else if v.Priority == "" || v.Priority == "1" {
+		case prio == KeyslotPriorityNormal:
 			normPrio = append(normPrio, k)
+		default:
+			ignored = append(ignored, k)
 		}
 	}
 	sort.Ints(highPrio)
 	sort.Ints(normPrio)
-	activeKeyslots := append(highPrio, normPrio...)
-
-	for _, k := range activeKeyslots {
-		volumeKey, err := d.unlockKeyslot(f, k, passphrase)
-		if err == nil {
-			return volumeKey, nil
-		} else if err == ErrPassphraseDoesNotMatch {
-			continue
-		} else {
-			return nil, err
-		}
-	}
-	return nil, ErrPassphraseDoesNotMatch
+	sort.Ints(ignored)
+	return
 }
 
 func computeDigestForKey(dig *digest, keyslotIdx int, finalKey []byte) ([]byte, error) {
 	digSalt, err := base64.StdEncoding.DecodeString(dig.Salt)
 	if err != nil {
-		return nil, fmt.Errorf("keyslotIdx[%v].digest.salt base64 parsing failed: %v", keyslotIdx, err)
+		return nil, fmt.Errorf("%w: keyslotIdx[%v].digest.salt base64 parsing failed: %v", ErrKeyslotCorrupt, keyslotIdx, err)
 	}
 
 	switch dig.Type {
 	case "pbkdf2":
-		var h func() hash.Hash
-		var size int
-		switch dig.Hash {
-		case "sha256":
-			h = sha256.New
-			size = sha256.Size
-		default:
-			return nil, fmt.Errorf("Unknown digest hash algorithm: %v", dig.Hash)
+		h, size, err := crypto.GetHashFunc(dig.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown digest hash algorithm: %v", ErrKeyslotUnsupported, dig.Hash)
 		}
+		// the digest length is the hash output size
 		return pbkdf2.Key(finalKey, digSalt, int(dig.Iterations), size, h), nil
 	default:
-		return nil, fmt.Errorf("Unknown digest kdf type: %v", dig.Type)
+		return nil, fmt.Errorf("%w: unknown digest kdf type: %v", ErrKeyslotUnsupported, dig.Type)
 	}
 }
 
-func decryptLuks2VolumeKey(f *os.File, keyslotIdx int, keyslot keyslot, afKey []byte) ([]byte, error) {
+// decryptLuks2VolumeKey decrypts the anti-forensic material stored at keyslot area `keyData` and merges it into the volume key
+func decryptLuks2VolumeKey(keyData []byte, keyslotIdx int, keyslot keyslot, afKey []byte) ([]byte, error) {
 	// parse encryption mode for the keyslot area, see crypt_parse_name_and_mode()
 	area := keyslot.Area
 
-	// decrypt keyslotIdx area using the derived key
-	keyslotSize := area.KeySize * stripesNum
+	// the anti-forensic material is split from the volume key, the area cipher key may be of a different size.
+	// The material is padded to the sector boundary on disk, e.g. 24-byte keys produce 96000 bytes.
+	afSize := int(keyslot.KeySize) * stripesNum
+	keyslotSize := roundUp(afSize, storageSectorSize)
 
-	areaSize, err := area.Size.Int64()
-	if err != nil {
-		return nil, fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", keyslotIdx, area.Size, err)
-	}
-	if int64(keyslotSize) > areaSize {
-		return nil, fmt.Errorf("keyslot[%v] area size too small, given %v expected at least %v", keyslotIdx, areaSize, keyslotSize)
-	}
-	if keyslotSize%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] size %v is not multiple of the sector size %v", keyslotIdx, keyslotSize, storageSectorSize)
-	}
-
-	keyData := make([]byte, keyslotSize)
-	defer clearSlice(keyData)
-
-	keyslotOffset, err := area.Offset.Int64()
-	if err != nil {
-		return nil, fmt.Errorf("Invalid keyslotIdx[%v] offset: %v. %v", keyslotIdx, area.Offset, err)
-	}
-	if keyslotOffset%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] offset %v is not aligned to sector size %v", keyslotIdx, keyslotOffset, storageSectorSize)
-	}
-
-	if _, err := f.ReadAt(keyData, keyslotOffset); err != nil {
-		return nil, err
+	if keyslotSize > len(keyData) {
+		return nil, fmt.Errorf("%w: keyslot[%v] area size too small, given %v expected at least %v", ErrKeyslotCorrupt, keyslotIdx, len(keyData), keyslotSize)
 	}
 
 	ciph, err := buildLuks2AfCipher(area.Encryption, afKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: keyslot[%v] area: %v", ErrKeyslotUnsupported, keyslotIdx, err)
 	}
 
-	for i := 0; i < int(keyslotSize/storageSectorSize); i++ {
+	// decrypt keyslotIdx area using the derived key
+	for i := 0; i < keyslotSize/storageSectorSize; i++ {
 		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
 		ciph.Decrypt(block, block, uint64(i))
 	}
 
 	// anti-forensic merge
 	af := keyslot.Af
-	if af.Stripes != stripesNum {
-		return nil, fmt.Errorf("LUKS currently supports only af with 4000 stripes")
+	if err := af.validate(); err != nil {
+		return nil, err
 	}
-	var afHash hash.Hash
-	switch af.Hash {
-	case "sha256":
-		afHash = sha256.New()
-	default:
-		return nil, fmt.Errorf("Unknown af hash algorithm: %v", af.Hash)
+	afHash, err := luks2AfHash(af.Hash)
+	if err != nil {
+		return nil, err
 	}
 
-	return afMerge(keyData, int(keyslot.KeySize), int(af.Stripes), afHash)
+	return afMerge(keyData[:afSize], int(keyslot.KeySize), int(af.Stripes), afHash)
 }
 
-func buildLuks2AfCipher(encryption string, afKey []byte) (*xts.Cipher, error) {
-	// example of `encryption` value is 'aes-xts-plain64'
-	encParts := strings.Split(encryption, "-")
-	if len(encParts) != 3 {
-		return nil, fmt.Errorf("Unexpected encryption format: %v", encryption)
+func luks2AfHash(name string) (hash.Hash, error) {
+	h, _, err := crypto.GetHashFunc(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown af hash algorithm: %v", ErrKeyslotUnsupported, name)
 	}
-	cipherName := encParts[0]
-	cipherMode := encParts[1]
-	// ivModeName := encParts[2]
+	return h(), nil
+}
 
-	var cipherFunc func(key []byte) (cipher.Block, error)
-	switch cipherName {
-	case "aes":
-		cipherFunc = aes.NewCipher
-	default:
-		return nil, fmt.Errorf("Unknown cipher: %v", cipherName)
+func buildLuks2AfCipher(encryption string, afKey []byte) (sectorCipher, error) {
+	cipherName, cipherMode, ivModeName, err := ParseEncryption(encryption)
+	if err != nil {
+		return nil, err
 	}
 
-	switch cipherMode {
-	case "xts":
-		return xts.NewCipher(cipherFunc, afKey)
-	default:
-		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
+	return buildSectorCipher(cipherName, cipherMode, ivModeName, afKey)
+}
+
+// ParseEncryption splits a dm-crypt cipher spec into cipher, chaining mode and IV generator, e.g.
+// 'aes-xts-plain64' gives ("aes", "xts", "plain64") and 'aes-cbc-essiv:sha256' gives ("aes", "cbc", "essiv:sha256").
+// Kernel crypto API form 'capi:xts(aes)-plain64' is accepted as well.
+func ParseEncryption(spec string) (cipher, mode, iv string, err error) {
+	if strings.HasPrefix(spec, "capi:") {
+		// capi:<mode>(<cipher>)-<iv>
+		capi := strings.TrimPrefix(spec, "capi:")
+		open := strings.Index(capi, "(")
+		close := strings.LastIndex(capi, ")")
+		if open <= 0 || close < open || !strings.HasPrefix(capi[close+1:], "-") || close+2 == len(capi) {
+			return "", "", "", fmt.Errorf("Unexpected encryption format: %v", spec)
+		}
+		return capi[open+1 : close], capi[:open], capi[close+2:], nil
+	}
+
+	// example of `spec` value is 'aes-xts-plain64'
+	encParts := strings.Split(spec, "-")
+	if len(encParts) != 3 || encParts[0] == "" || encParts[1] == "" || encParts[2] == "" {
+		return "", "", "", fmt.Errorf("Unexpected encryption format: %v", spec)
 	}
+	return encParts[0], encParts[1], encParts[2], nil
 }
 
-func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint) ([]byte, error) {
+// deriveLuks2AfKey derives the keyslot area key from the passphrase, e.g. one held by a SecretBuffer.
+// The key is returned in locked memory, the caller destroys it after use.
+func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint) (*SecretBuffer, error) {
 	salt, err := base64.StdEncoding.DecodeString(kdf.Salt)
 	if err != nil {
-		return nil, fmt.Errorf("keyslotIdx[%v].kdf.salt base64 parsing failed: %v", keyslotIdx, err)
+		return nil, fmt.Errorf("%w: keyslotIdx[%v].kdf.salt base64 parsing failed: %v", ErrKeyslotCorrupt, keyslotIdx, err)
+	}
+
+	if key, ok := testKDFOverride(passphrase, salt, keyLength); ok {
+		return secretFromBytes(key), nil
 	}
 
 	switch kdf.Type {
 	case "pbkdf2":
-		var h func() hash.Hash
-		switch kdf.Hash {
-		case "sha256":
-			h = sha256.New
-		default:
-			return nil, fmt.Errorf("Unknown keyslotIdx[%v].kdf.hash algorithm: %v", keyslotIdx, kdf.Hash)
+		h, _, err := crypto.GetHashFunc(kdf.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown keyslotIdx[%v].kdf.hash algorithm: %v", ErrKeyslotUnsupported, keyslotIdx, kdf.Hash)
 		}
-		return pbkdf2.Key(passphrase, salt, int(kdf.Iterations), int(keyLength), h), nil
+		return secretFromBytes(pbkdf2.Key(passphrase, salt, int(kdf.Iterations), int(keyLength), h)), nil
 	case "argon2i":
-		return argon2.Key(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), uint32(keyLength)), nil
+		if err := checkArgon2Params(kdf, keyslotIdx); err != nil {
+			return nil, err
+		}
+		return secretFromBytes(argon2.Key(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), uint32(keyLength))), nil
 	case "argon2id":
-		return argon2.IDKey(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), uint32(keyLength)), nil
+		if err := checkArgon2Params(kdf, keyslotIdx); err != nil {
+			return nil, err
+		}
+		return secretFromBytes(argon2.IDKey(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), uint32(keyLength))), nil
 	default:
-		return nil, fmt.Errorf("Unknown kdf type: %v", kdf.Type)
+		return nil, fmt.Errorf("%w: unknown kdf type: %v", ErrKeyslotUnsupported, kdf.Type)
 	}
 }
 
-func (d *luks2Device) findDigestForKeyslot(keyslotIdx int) (int, *digest) {
+func (d *Device) findDigestForKeyslot(keyslotIdx int) (int, *digest) {
 	for i, dig := range d.meta.Digests {
 		for _, k := range dig.Keyslots {
 			k, e := k.Int64()
@@ -366,3 +624,101 @@ func (d *luks2Device) findDigestForKeyslot(keyslotIdx int) (int, *digest) {
 	}
 	return 0, nil
 }
+
+// ExportMetadata returns the device metadata as JSON. The JSON is re-marshalled from the parsed metadata thus
+// it is canonical: map keys are sorted and the output is stable across export/import round trips.
+func (d *Device) ExportMetadata() ([]byte, error) {
+	return json.Marshal(d.meta)
+}
+
+// ImportMetadata validates the given JSON and replaces the device metadata with it.
+// Only the in-memory device state is modified, the on-disk header stays intact.
+func (d *Device) ImportMetadata(data []byte) error {
+	var meta metadata
+	if err := unmarshalMetadata(data, &meta); err != nil {
+		return err
+	}
+	if err := meta.validate(); err != nil {
+		return err
+	}
+
+	d.meta = &meta
+	return nil
+}
+
+// ErrUnsupportedRequirement reports a mandatory feature listed in LUKS2 config.requirements that is not implemented.
+// The device must not be modified as the rest of the metadata may have a meaning this package does not know about.
+type ErrUnsupportedRequirement struct {
+	Feature string
+}
+
+func (e ErrUnsupportedRequirement) Error() string {
+	return fmt.Sprintf("LUKS2 requirement %q is not supported", e.Feature)
+}
+
+// CheckRequirements verifies that all mandatory requirements of the device are supported. None of the
+// requirements defined by cryptsetup (online reencryption, OPAL, inline hardware tags) are implemented, thus any
+// mandatory requirement results in ErrUnsupportedRequirement. Operations that modify the header call it first.
+func (d *Device) CheckRequirements() error {
+	if r := d.meta.Config.Requirements; r != nil && len(r.Mandatory) > 0 {
+		return ErrUnsupportedRequirement{Feature: r.Mandatory[0]}
+	}
+	return nil
+}
+
+// usesOpal reports whether the data is encrypted with OPAL hardware encryption, either with 'hw-opal' segments or
+// combined 'hw-opal-crypt' segments, see LUKS2_segment_is_hw_opal() in cryptsetup
+func (m *metadata) usesOpal() bool {
+	if m.Config.Requirements != nil {
+		for _, r := range m.Config.Requirements.Mandatory {
+			if r == "opal" {
+				return true
+			}
+		}
+	}
+	for _, s := range m.Segments {
+		if s.Type == "hw-opal" || s.Type == "hw-opal-crypt" {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that numeric fields are parseable and digests reference existing keyslots and segments
+func (m *metadata) validate() error {
+	if _, err := m.Config.KeyslotsSize.Int64(); err != nil {
+		return fmt.Errorf("invalid config.keyslots_size value: %v", err)
+	}
+
+	for idx, k := range m.Keyslots {
+		if _, err := k.Area.Offset.Int64(); err != nil {
+			return fmt.Errorf("Invalid keyslotIdx[%v] offset: %v. %v", idx, k.Area.Offset, err)
+		}
+		if _, err := k.Area.Size.Int64(); err != nil {
+			return fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", idx, k.Area.Size, err)
+		}
+	}
+
+	for idx, dig := range m.Digests {
+		for _, k := range dig.Keyslots {
+			k, err := k.Int64()
+			if err != nil {
+				return fmt.Errorf("digest[%v] has invalid keyslot reference: %v", idx, err)
+			}
+			if _, ok := m.Keyslots[int(k)]; !ok {
+				return fmt.Errorf("digest[%v] references non-existent keyslot %v", idx, k)
+			}
+		}
+		for _, s := range dig.Segments {
+			s, err := s.Int64()
+			if err != nil {
+				return fmt.Errorf("digest[%v] has invalid segment reference: %v", idx, err)
+			}
+			if _, ok := m.Segments[int(s)]; !ok {
+				return fmt.Errorf("digest[%v] references non-existent segment %v", idx, s)
+			}
+		}
+	}
+
+	return nil
+}
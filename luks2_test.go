@@ -1,11 +1,21 @@
 package luks
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"reflect"
 	"strings"
 	"testing"
+	"unsafe"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func prepareLuks2Disk(t *testing.T, password string) (*os.File, error) {
@@ -87,3 +97,414 @@ func TestLuks2UnlockMultipleKeySlots(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLuks2KeyslotAreaOutsideOfKeyslotsRegion(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+
+	// point the area to the JSON region of the secondary header
+	ks := fx.meta.Keyslots[0]
+	ks.Area.Offset = "20480"
+	fx.meta.Keyslots[0] = ks
+
+	disk, d := fx.open(t)
+
+	_, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err == nil || !strings.Contains(err.Error(), "outside of the keyslots region") {
+		t.Fatalf("expected keyslots region error, got %v", err)
+	}
+}
+
+func TestLuks2ExportImportMetadata(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	exported, err := d.ExportMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ImportMetadata(exported); err != nil {
+		t.Fatal(err)
+	}
+	reexported, err := d.ExportMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exported, reexported) {
+		t.Fatalf("metadata export is not stable:\n%s\n%s", exported, reexported)
+	}
+
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+
+	// some implementations write unquoted numbers
+	unquoted := strings.Replace(string(exported), `"iv_tweak":"0"`, `"iv_tweak":0`, 1)
+	unquoted = strings.Replace(unquoted, `"offset":"1048576"`, `"offset":1048576`, 1)
+	if unquoted == string(exported) {
+		t.Fatalf("no numbers to unquote in %s", exported)
+	}
+	if err := d.ImportMetadata([]byte(unquoted)); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := d.meta.Segments[0].Offset.Int64(); err != nil || offset != fixtureDataOffset {
+		t.Fatalf("unexpected segment offset %v: %v", offset, err)
+	}
+	if d.meta.Segments[0].IvTweak != "0" {
+		t.Fatalf("unexpected iv_tweak %q", d.meta.Segments[0].IvTweak)
+	}
+
+	invalid := strings.Replace(string(exported), `"keyslots":["0"]`, `"keyslots":["7"]`, 1)
+	if err := d.ImportMetadata([]byte(invalid)); err == nil {
+		t.Fatal("metadata with a digest referencing non-existent keyslot is expected to be rejected")
+	}
+}
+
+func TestLuks2UnalignedSegmentSize(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	seg := fx.meta.Segments[0]
+	seg.Size = "1000000"
+	fx.meta.Segments[0] = seg
+
+	disk, d := fx.open(t)
+
+	_, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err == nil || !strings.Contains(err.Error(), "is not multiple of the sector size") {
+		t.Fatalf("expected segment size alignment error, got %v", err)
+	}
+}
+
+func TestOpenDevice(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	d, err := OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ExportMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDevice(bytes.NewReader(make([]byte, 4096))); err != ErrNotLUKS {
+		t.Fatalf("expected ErrNotLUKS, got %v", err)
+	}
+}
+
+func TestLuks2Labels(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	copy(fx.hdr.Label[:], "my volume ✓")
+	copy(fx.hdr.SubsystemLabel[:], []byte{'b', 'a', 'd', 0xff, 0xfe})
+	_, d := fx.open(t)
+
+	label, err := d.Label()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label != "my volume ✓" {
+		t.Fatalf("unexpected label %q", label)
+	}
+
+	if _, err := d.SubsystemLabel(); err == nil {
+		t.Fatal("subsystem label with invalid UTF-8 is expected to fail")
+	}
+}
+
+func TestLuks2UnlockOPAL(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	seg := fx.meta.Segments[0]
+	seg.Type = "hw-opal-crypt"
+	fx.meta.Segments[0] = seg
+	fx.meta.Config.Requirements = &requirements{Mandatory: []string{"opal"}}
+
+	disk, d := fx.open(t)
+
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != ErrOPALUnsupported {
+		t.Fatalf("expected ErrOPALUnsupported, got %v", err)
+	}
+	if _, err := d.unlockAnyKeyslot(disk, []byte("foobar")); err != ErrOPALUnsupported {
+		t.Fatalf("expected ErrOPALUnsupported, got %v", err)
+	}
+}
+
+func TestParseRequirements(t *testing.T) {
+	data := []byte(`{"keyslots": {}, "tokens": {}, "segments": {}, "digests": {},
+		"config": {"json_size": "12288", "keyslots_size": "16744448", "requirements": {"mandatory": ["opal"]}}}`)
+
+	var meta metadata
+	if err := unmarshalMetadata(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.usesOpal() {
+		t.Fatal("opal requirement is not detected")
+	}
+}
+
+func TestJsonAreaSize(t *testing.T) {
+	hdr := headerV2{HeaderSize: 16384}
+	if JsonAreaOffset() != 4096 || JsonAreaSize(&hdr) != 12288 {
+		t.Fatalf("unexpected JSON area [%v, +%v)", JsonAreaOffset(), JsonAreaSize(&hdr))
+	}
+	if JsonSizeFromHeaderSize(4194304) != 4190208 {
+		t.Fatalf("unexpected JSON area size %v", JsonSizeFromHeaderSize(4194304))
+	}
+}
+
+func TestLuks2InvalidJsonSize(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.meta.Config.JsonSize = "8192"
+	disk := fx.writeDisk(t)
+
+	if _, err := luks2OpenDevice(disk); err == nil || !strings.Contains(err.Error(), "does not match the JSON area size") {
+		t.Fatalf("expected json_size mismatch error, got %v", err)
+	}
+}
+
+func TestLuks2UnterminatedJson(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	// pad the JSON with whitespace till the end of the header so there is no terminating NUL
+	data := fx.headerBytes(t, 0)
+	jsonEnd := 4096 + bytes.IndexByte(data[4096:], 0)
+	for i := jsonEnd; i < len(data); i++ {
+		data[i] = ' '
+	}
+	checksum, err := luks2HeaderChecksum(data, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[448:], checksum)
+	if _, err := disk.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := luks2OpenDevice(disk); err == nil || !strings.Contains(err.Error(), "not terminated") {
+		t.Fatalf("expected unterminated JSON error, got %v", err)
+	}
+}
+
+func TestLuks2Unlock48ByteKey(t *testing.T) {
+	fx := newLuks2Fixture(t, 48)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+}
+
+func TestLuks2UnlockSha384(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	digSalt := randomBytes(t, 32)
+	dig := fx.meta.Digests[0]
+	dig.Hash = "sha384"
+	dig.Salt = base64.StdEncoding.EncodeToString(digSalt)
+	dig.Digest = base64.StdEncoding.EncodeToString(pbkdf2.Key(fx.volumeKey, digSalt, fixtureIterations, sha512.Size384, sha512.New384))
+	fx.meta.Digests[0] = dig
+	disk, d := fx.open(t)
+
+	kdfParams := KDFOptions{Type: "pbkdf2", Hash: "sha384", Iterations: fixtureIterations}
+	if err := d.addKeyslot(disk, 0, 0, []byte("foobar"), fx.volumeKey, kdfParams, rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.meta.Keyslots[0].Kdf.Hash != "sha384" {
+		t.Fatalf("unexpected kdf hash %v", d.meta.Keyslots[0].Kdf.Hash)
+	}
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("wrong")); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+}
+
+func TestCalculateHeaderCRC32(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	data := fx.headerBytes(t, 0)
+
+	crc := CalculateHeaderCRC32(data)
+	if crc != CalculateHeaderCRC32(append([]byte(nil), data...)) {
+		t.Fatal("CRC is expected to be stable")
+	}
+
+	// the checksum field is not covered
+	var hdr headerV2
+	modified := append([]byte(nil), data...)
+	modified[unsafe.Offsetof(hdr.Checksum)] ^= 0xff
+	if CalculateHeaderCRC32(modified) != crc {
+		t.Fatal("CRC is expected to ignore the checksum field")
+	}
+
+	modified = append([]byte(nil), data...)
+	modified[JsonAreaOffset()+10] ^= 0xff
+	if CalculateHeaderCRC32(modified) == crc {
+		t.Fatal("CRC is expected to change with the JSON metadata")
+	}
+}
+
+func TestLuks2UnlockWrongPassphrase(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	// passphrases that share a prefix with the correct one or differ only in the last byte as well
+	for _, passphrase := range []string{"", "f", "fooba", "foobaz", "foobar ", "FOOBAR", strings.Repeat("x", 1000)} {
+		if _, err := d.unlockKeyslot(disk, 0, []byte(passphrase)); err != ErrPassphraseDoesNotMatch {
+			t.Fatalf("passphrase %q: expected ErrPassphraseDoesNotMatch, got %v", passphrase, err)
+		}
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLuks2ChecksumAlgorithmVariants(t *testing.T) {
+	for _, algo := range []string{"SHA256", "Sha256", "sha256 ", " SHA512"} {
+		fx := newLuks2Fixture(t, 64)
+		fx.hdr.ChecksumAlgorithm = [32]byte{}
+		copy(fx.hdr.ChecksumAlgorithm[:], algo)
+		fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+		disk, d := fx.open(t)
+		if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+			t.Fatalf("checksum algorithm %q: %v", algo, err)
+		}
+		disk.Close()
+		os.Remove(disk.Name())
+	}
+}
+
+func TestLuks2UnlockUnalignedAfSize(t *testing.T) {
+	// AES-192: 24*4000 bytes of anti-forensic material is not a multiple of the sector size
+	fx := newLuks2Fixture(t, 24)
+	fx.addKeyslot(t, 0, "foobar", "aes-cbc-essiv:sha256")
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+}
+
+func TestLuks2UnlockUnknownAfType(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	ks := fx.meta.Keyslots[0]
+	ks.Af.Type = "luks3"
+	fx.meta.Keyslots[0] = ks
+	disk, d := fx.open(t)
+
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); !errors.Is(err, ErrUnsupportedAfType) {
+		t.Fatalf("expected ErrUnsupportedAfType, got %v", err)
+	}
+}
+
+func TestCheckRequirements(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Config.Requirements = &requirements{Mandatory: []string{"online-reencrypt-v2"}}
+	disk, d := fx.open(t)
+
+	before := make([]byte, fixtureDataOffset)
+	if _, err := disk.ReadAt(before, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ErrUnsupportedRequirement{Feature: "online-reencrypt-v2"}
+	if err := d.CheckRequirements(); err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+	if _, err := d.AddKeyslotWithKey(disk, fx.volumeKey, []byte("barfoo"), &AddKeyslotOptions{KDF: "pbkdf2", Iterations: 1000}); err != expected {
+		t.Fatalf("AddKeyslotWithKey: expected %v, got %v", expected, err)
+	}
+	if err := d.SetAllowDiscards(disk, true); err != expected {
+		t.Fatalf("SetAllowDiscards: expected %v, got %v", expected, err)
+	}
+	if err := d.EraseKeyslotArea(disk, 0); err != expected {
+		t.Fatalf("EraseKeyslotArea: expected %v, got %v", expected, err)
+	}
+	if err := d.UpdateHeader(disk); err != expected {
+		t.Fatalf("UpdateHeader: expected %v, got %v", expected, err)
+	}
+
+	after := make([]byte, fixtureDataOffset)
+	if _, err := disk.ReadAt(after, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("device with unsupported requirement is modified")
+	}
+
+	// the device can still be unlocked
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLuks2LegacyCompat(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	// pre-release LUKS2 header with 'key_slots' names
+	jsonData, err := json.Marshal(&fx.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData = bytes.ReplaceAll(jsonData, []byte(`"keyslots":`), []byte(`"key_slots":`))
+	jsonData = bytes.ReplaceAll(jsonData, []byte(`"keyslots_size":`), []byte(`"key_slots_size":`))
+	data, err := luks2HeaderBytes(&fx.hdr, jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := luks2OpenDevice(disk); err == nil {
+		t.Fatal("legacy metadata is expected to be rejected without WithLegacyCompat")
+	}
+
+	d, err := luks2OpenDevice(disk, WithLegacyCompat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.meta, &fx.meta) {
+		t.Fatalf("converted metadata does not match:\n  got %+v\n want %+v", d.meta, fx.meta)
+	}
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+
+	// both the legacy and the final name is ambiguous
+	if _, err := convertLegacyMetadata([]byte(`{"keyslots": {}, "key_slots": {}}`)); err == nil {
+		t.Fatal("expected an error for metadata with both key names")
+	}
+}
@@ -0,0 +1,266 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOpenNotLUKS(t *testing.T) {
+	zeroed := make([]byte, 4096)
+
+	fat := make([]byte, 4096)
+	copy(fat, []byte{0xeb, 0x3c, 0x90})
+	copy(fat[3:], "MSDOS5.0")
+	copy(fat[54:], "FAT16   ")
+	fat[510], fat[511] = 0x55, 0xaa
+
+	bitlocker := make([]byte, 4096)
+	copy(bitlocker, []byte{0xeb, 0x58, 0x90})
+	copy(bitlocker[3:], "-FVE-FS-")
+	bitlocker[510], bitlocker[511] = 0x55, 0xaa
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"zeroed", zeroed},
+		{"fat", fat},
+		{"bitlocker", bitlocker},
+		{"short", []byte("LUKS")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk, err := ioutil.TempFile("", "luks.go.notluks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer disk.Close()
+			defer os.Remove(disk.Name())
+			if _, err := disk.Write(test.data); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Open(disk.Name(), "notluks", 0, []byte("foobar")); err != ErrNotLUKS {
+				t.Fatalf("expected ErrNotLUKS, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadLuksVersion(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	version, err := readLuksVersion(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected LUKS version 2, got %v", version)
+	}
+}
+
+func TestReadVersionFromMagic(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+
+	// the header is streamed through a pipe, the reader cannot seek
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := pw.Write(fx.headerBytes(t, 0))
+		pw.CloseWithError(err)
+	}()
+	version, err := ReadVersionFromMagic(pr)
+	pr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("expected LUKS version 2, got %v", version)
+	}
+
+	for _, data := range []string{"LUKS\xba\xbe\x00", "BITLOCKER", "LUKS\xba\xbe\x00\x03"} {
+		if _, err := ReadVersionFromMagic(strings.NewReader(data)); err == nil {
+			t.Fatalf("header %q: expected an error", data)
+		}
+	}
+	if _, err := ReadVersionFromMagic(strings.NewReader("short")); err != ErrNotLUKS {
+		t.Fatalf("expected ErrNotLUKS, got %v", err)
+	}
+}
+
+func TestUnlockAnyKeyslotContinueOnKeyslotError(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "foobar", "aes-xts-plain64")
+
+	// corrupt keyslot 0 area reference, it points to the data segment now
+	ks := fx.meta.Keyslots[0]
+	ks.Area.Offset = jsonNumber(strconv.Itoa(fixtureDataOffset))
+	fx.meta.Keyslots[0] = ks
+
+	disk, d := fx.open(t)
+
+	if _, err := d.unlockAnyKeyslot(disk, []byte("foobar")); err == nil || err == ErrPassphraseDoesNotMatch {
+		t.Fatalf("corrupted keyslot is expected to abort the unlock by default, got %v", err)
+	}
+
+	volume, err := d.unlockAnyKeyslot(disk, []byte("foobar"), WithContinueOnKeyslotError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+
+	if _, err := d.unlockAnyKeyslot(disk, []byte("wrong"), WithContinueOnKeyslotError()); err == nil || err == ErrPassphraseDoesNotMatch {
+		t.Fatalf("keyslot error is expected to be reported when no keyslot unlocks, got %v", err)
+	}
+}
+
+func TestUnlockKeyslotErrorCategories(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(ks *keyslot, fx *luks2Fixture)
+		expected error
+	}{
+		{"invalid salt", func(ks *keyslot, fx *luks2Fixture) { ks.Kdf.Salt = "!" }, ErrKeyslotCorrupt},
+		{"unaligned area", func(ks *keyslot, fx *luks2Fixture) {
+			ks.Area.Offset = jsonNumber(strconv.Itoa(fixtureHeaderSize*2 + 1))
+		}, ErrKeyslotCorrupt},
+		{"no digest", func(ks *keyslot, fx *luks2Fixture) {
+			dig := fx.meta.Digests[0]
+			dig.Keyslots = []jsonNumber{"1"}
+			fx.meta.Digests[0] = dig
+		}, ErrKeyslotCorrupt},
+		{"unknown kdf", func(ks *keyslot, fx *luks2Fixture) { ks.Kdf.Type = "scrypt" }, ErrKeyslotUnsupported},
+		{"unknown area cipher", func(ks *keyslot, fx *luks2Fixture) { ks.Area.Encryption = "foo-xts-plain64" }, ErrKeyslotUnsupported},
+		{"unknown af type", func(ks *keyslot, fx *luks2Fixture) { ks.Af.Type = "luks3" }, ErrKeyslotUnsupported},
+		{"unknown keyslot type", func(ks *keyslot, fx *luks2Fixture) { ks.Type = "reencrypt" }, ErrKeyslotUnsupported},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fx := newLuks2Fixture(t, 64)
+			fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+			fx.addKeyslot(t, 1, "foobar", "aes-xts-plain64")
+			ks := fx.meta.Keyslots[0]
+			test.modify(&ks, fx)
+			fx.meta.Keyslots[0] = ks
+			disk, d := fx.open(t)
+
+			_, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+
+			// unsupported keyslots are skipped, corrupted ones abort the unlock
+			_, err = d.unlockAnyKeyslot(disk, []byte("foobar"))
+			if test.expected == ErrKeyslotUnsupported && err != nil {
+				t.Fatalf("unsupported keyslot is expected to be skipped, got %v", err)
+			}
+			if test.expected == ErrKeyslotCorrupt && !errors.Is(err, ErrKeyslotCorrupt) {
+				t.Fatalf("expected corrupted keyslot error, got %v", err)
+			}
+		})
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+	_, err := d.unlockKeyslot(disk, 0, []byte("wrong"))
+	if err != ErrPassphraseDoesNotMatch || errors.Is(err, ErrKeyslotCorrupt) || errors.Is(err, ErrKeyslotUnsupported) {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch only, got %v", err)
+	}
+
+	// unstable keyslot area reads reported by VerifyKeyslotAreaIntegrity
+	err = fmt.Errorf("verify: %w", ErrKeyslotCorrupted{Keyslot: 0, Offset: 32768, Length: 1})
+	if !errors.Is(err, ErrKeyslotCorrupt) || errors.Is(err, ErrKeyslotUnsupported) {
+		t.Fatalf("expected ErrKeyslotCorrupted to be ErrKeyslotCorrupt, got %v", err)
+	}
+}
+
+func TestIsLUKS(t *testing.T) {
+	luks1 := make([]byte, 4096)
+	copy(luks1, "LUKS\xba\xbe\x00\x01aes")
+
+	fx := newLuks2Fixture(t, 64)
+	luks2 := fx.headerBytes(t, 0)
+
+	unknownVersion := make([]byte, 4096)
+	copy(unknownVersion, "LUKS\xba\xbe\x00\x03")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		version int
+		ok      bool
+	}{
+		{"luks1", luks1, 1, true},
+		{"luks2", luks2, 2, true},
+		{"zeroed", make([]byte, 4096), 0, false},
+		{"unknown version", unknownVersion, 0, false},
+		{"empty", nil, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, ok := IsLUKS(bytes.NewReader(test.data))
+			if version != test.version || ok != test.ok {
+				t.Fatalf("expected (%v, %v), got (%v, %v)", test.version, test.ok, version, ok)
+			}
+		})
+	}
+}
+
+// composeAcute is a tiny NFC subset: it composes 'e' + U+0301 COMBINING ACUTE ACCENT into U+00E9
+type composeAcute struct{}
+
+func (composeAcute) Bytes(b []byte) []byte {
+	if !bytes.Contains(b, []byte("e\u0301")) {
+		return b
+	}
+	return bytes.ReplaceAll(b, []byte("e\u0301"), []byte("\u00e9"))
+}
+
+func TestPassphraseNormalization(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "caf\u00e9", "aes-xts-plain64") // composed form
+	disk, d := fx.open(t)
+
+	decomposed := []byte("cafe\u0301")
+	if _, err := d.unlockKeyslot(disk, 0, decomposed); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("decomposed passphrase is not expected to match without normalization, got %v", err)
+	}
+
+	o := buildOptions([]Option{WithPassphraseNormalization(composeAcute{})})
+	normalized, wipe := o.normalizePassphrase(decomposed)
+	volume, err := d.unlockKeyslot(disk, 0, normalized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+	wipe()
+	if !bytes.Equal(normalized, make([]byte, len(normalized))) {
+		t.Fatal("normalized passphrase copy is not wiped")
+	}
+	if !bytes.Equal(decomposed, []byte("cafe\u0301")) {
+		t.Fatal("caller's passphrase is modified")
+	}
+
+	// already normalized passphrase is owned by the caller and must not be wiped
+	composed := []byte("caf\u00e9")
+	same, wipe := o.normalizePassphrase(composed)
+	wipe()
+	if !bytes.Equal(same, []byte("caf\u00e9")) {
+		t.Fatal("caller's passphrase is wiped")
+	}
+}
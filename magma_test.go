@@ -0,0 +1,104 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// test vectors are from https://tools.ietf.org/html/rfc8891
+func TestMagmaTransformations(t *testing.T) {
+	if v := magmaT(0xfdb97531); v != 0x2a196f34 {
+		t.Fatalf("t(fdb97531) expected 2a196f34, got %x", v)
+	}
+	if v := magmaG(0x87654321, 0xfedcba98); v != 0xfdcbc20c {
+		t.Fatalf("g[87654321](fedcba98) expected fdcbc20c, got %x", v)
+	}
+}
+
+func TestMagmaBlock(t *testing.T) {
+	key := decodeHex(t, "ffeeddccbbaa99887766554433221100f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	plaintext := decodeHex(t, "fedcba9876543210")
+	ciphertext := decodeHex(t, "4ee901e5c2d8ca3d")
+
+	c, err := newMagmaCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]byte, 8)
+	c.Encrypt(out, plaintext)
+	if !bytes.Equal(out, ciphertext) {
+		t.Fatalf("expected ciphertext %x, got %x", ciphertext, out)
+	}
+	c.Decrypt(out, ciphertext)
+	if !bytes.Equal(out, plaintext) {
+		t.Fatalf("expected plaintext %x, got %x", plaintext, out)
+	}
+}
+
+func TestMagmaCipherSpec(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := buildLuks2AfCipher("magma-cbc-plain64", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildLuks2AfCipher("magma-cfb-plain64", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildLuks2AfCipher("magma-xts-plain64", key); err == nil {
+		t.Fatal("magma has 64-bit block and cannot be used in xts mode")
+	}
+	if _, err := buildLuks2AfCipher("gost89-cbc-plain64", key); err == nil {
+		t.Fatal("gost89 is expected to be rejected")
+	}
+}
+
+// the first block of the GOST R 34.13-2015 A.2.4 CFB example, the shift register there is two blocks long
+// thus the following blocks differ from the kernel full-block CFB
+func TestMagmaCFB(t *testing.T) {
+	key := decodeHex(t, "ffeeddccbbaa99887766554433221100f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	plaintext := decodeHex(t, "92def06b3c130a59")
+	ciphertext := decodeHex(t, "db37e0e266903c83")
+
+	block, err := newMagmaCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cfbCipher{block: block, iv: func(iv []byte, sectorNum uint64) {
+		copy(iv, decodeHex(t, "1234567890abcdef"))
+	}}
+
+	out := make([]byte, len(plaintext))
+	c.Encrypt(out, plaintext, 0)
+	if !bytes.Equal(out, ciphertext) {
+		t.Fatalf("expected ciphertext %x, got %x", ciphertext, out)
+	}
+	c.Decrypt(out, ciphertext, 0)
+	if !bytes.Equal(out, plaintext) {
+		t.Fatalf("expected plaintext %x, got %x", plaintext, out)
+	}
+}
+
+func TestLuks2UnlockMagmaKeyslot(t *testing.T) {
+	for _, encryption := range []string{"magma-cbc-plain64", "magma-cfb-plain64"} {
+		fx := newLuks2Fixture(t, 32)
+		fx.addKeyslot(t, 0, "foobar", encryption)
+		disk, d := fx.open(t)
+
+		volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+		if err != nil {
+			t.Fatalf("%v: %v", encryption, err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatalf("%v: unlocked volume key does not match", encryption)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package luks
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Option configures optional behavior of the unlock, format and batch operations
+type Option func(*options)
+
+type options struct {
+	continueOnKeyslotError bool
+	readaheadSectors       int
+	workers                int
+	normalizer             PassphraseNormalizer
+	physicalBlockSize      int
+	argon2Parallelism      int
+	skipKeyslotAreaWipe    bool
+	legacyCompat           bool
+	rand                   io.Reader
+	keyslotKeySize         int
+	warn                   func(msg string)
+}
+
+func buildOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithContinueOnKeyslotError makes unlocking with AnyKeyslot skip keyslots that fail with an error other than
+// ErrPassphraseDoesNotMatch (e.g. ErrKeyslotCorrupt or an unreadable keyslot area) and try the remaining keyslots.
+// The unlock fails only if none of the keyslots can be unlocked. ErrKeyslotUnsupported keyslots are skipped
+// even without this option.
+func WithContinueOnKeyslotError() Option {
+	return func(o *options) {
+		o.continueOnKeyslotError = true
+	}
+}
+
+// WithReadahead hints the kernel that LUKS2 keyslot areas are read sequentially and asks it to prefetch up to
+// `sectors` sectors of each area that is going to be tried. It reduces unlock latency on cold-cache rotational
+// disks. A value less or equal to zero disables the hint.
+func WithReadahead(sectors int) Option {
+	return func(o *options) {
+		o.readaheadSectors = sectors
+	}
+}
+
+// WithWorkers sets the number of concurrent workers used by batch operations. By default the number of CPUs is used.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithPhysicalBlockSize makes reads of keyslot areas and volume data aligned to the physical block size of
+// the device, e.g. 4096 for 4K-native devices that reject reads of 512-byte sectors. The data is read in whole
+// physical blocks and sliced to the requested range. By default reads are aligned to the LUKS sector size only.
+func WithPhysicalBlockSize(n int) Option {
+	return func(o *options) {
+		o.physicalBlockSize = n
+	}
+}
+
+// WithArgon2Parallelism forces the Argon2 parallelism (lanes and threads) instead of the 'cpus' value stored in
+// the keyslot. It is a debugging aid for headers with a damaged or wrongly edited 'cpus' field: the derived
+// key depends on the number of lanes thus any value other than the one used at keyslot creation yields
+// ErrPassphraseDoesNotMatch. A value less or equal to zero uses the stored parallelism.
+func WithArgon2Parallelism(n int) Option {
+	return func(o *options) {
+		o.argon2Parallelism = n
+	}
+}
+
+// WithKeyslotAreaWipe controls whether Format fills the whole keyslots region with random data before writing
+// the keyslot material, so unused areas do not reveal stale data or which areas are in use. It is on by default.
+func WithKeyslotAreaWipe(wipe bool) Option {
+	return func(o *options) {
+		o.skipKeyslotAreaWipe = !wipe
+	}
+}
+
+// WithLegacyCompat accepts LUKS2 metadata written by pre-release implementations that use different JSON key names,
+// e.g. 'key_slots' instead of 'keyslots'. The keys are renamed when the header is read, the device is not modified.
+// It is off by default so unexpected keys in damaged metadata are not reinterpreted.
+func WithLegacyCompat() Option {
+	return func(o *options) {
+		o.legacyCompat = true
+	}
+}
+
+// WithRandomSource sets the source of random data used by operations that take Option to generate keys, salts,
+// anti-forensic stripes and the noise written to keyslot areas, e.g. to produce reproducible images in tests.
+// Format and AddKeyslotWithKey use it unless FormatOptions.Rand or AddKeyslotOptions.Rand is set.
+// By default crypto/rand is used.
+func WithRandomSource(rnd io.Reader) Option {
+	return func(o *options) {
+		o.rand = rnd
+	}
+}
+
+// WithKeyslotKeySize sets the size in bytes of the keyslot area encryption key used by ChangeKeyslotEncryption,
+// e.g. 64 to migrate a keyslot from 256-bit to 512-bit 'aes-xts-plain64'. By default the size of the current area
+// key is kept.
+func WithKeyslotKeySize(n int) Option {
+	return func(o *options) {
+		o.keyslotKeySize = n
+	}
+}
+
+// WithWarnings sets a function that receives warnings about unlocked volumes, e.g. a data segment encrypted with
+// the 'plain' IV mode whose IVs wrap around at 2^32 sectors, see IVModeIsWeak. The library never logs by itself,
+// without this option the warnings are dropped.
+func WithWarnings(fn func(msg string)) Option {
+	return func(o *options) {
+		o.warn = fn
+	}
+}
+
+// warnVolume reports weaknesses of the unlocked volume to the warning function
+func (o *options) warnVolume(volume *VolumeInfo) {
+	if o.warn == nil {
+		return
+	}
+	if _, _, ivMode, err := ParseEncryption(volume.storageEncryption); err == nil && IVModeIsWeak(ivMode) {
+		o.warn(fmt.Sprintf("volume is encrypted with %v, its IVs wrap around at 2^32 sectors and repeat on larger devices, consider migrating to plain64", volume.storageEncryption))
+	}
+}
+
+// randomSource returns the configured source of random data, crypto/rand if none is set
+func (o *options) randomSource() io.Reader {
+	if o.rand == nil {
+		return rand.Reader
+	}
+	return o.rand
+}
+
+// PassphraseNormalizer converts a passphrase to a Unicode normalization form. golang.org/x/text/unicode/norm forms,
+// e.g. norm.NFC or norm.NFKC, implement it.
+type PassphraseNormalizer interface {
+	Bytes(b []byte) []byte
+}
+
+// WithPassphraseNormalization applies the Unicode normalization form to the passphrase before the key derivation.
+// The same text may be encoded as different bytes depending on the input method, e.g. 'é' as U+00E9 or as
+// 'e' followed by U+0301, and LUKS keyslots match the exact bytes. Normalization is off by default as cryptsetup
+// uses the passphrase bytes as-is: a keyslot created from a non-normalized passphrase cannot be unlocked with
+// normalization enabled.
+func WithPassphraseNormalization(form PassphraseNormalizer) Option {
+	return func(o *options) {
+		o.normalizer = form
+	}
+}
+
+// normalizePassphrase returns the passphrase in the configured normalization form and a function that wipes
+// the normalized copy
+func (o *options) normalizePassphrase(passphrase []byte) ([]byte, func()) {
+	if o.normalizer == nil {
+		return passphrase, func() {}
+	}
+	normalized := o.normalizer.Bytes(passphrase)
+	if len(normalized) == 0 || len(passphrase) > 0 && &normalized[0] == &passphrase[0] {
+		return normalized, func() {} // the passphrase is already normalized, it is owned by the caller
+	}
+	return normalized, func() { clearSlice(normalized) }
+}
+
+// applyOptions configures the device for unlocking according to the options
+func (d *Device) applyOptions(o *options) error {
+	if err := d.setPhysicalBlockSize(o.physicalBlockSize); err != nil {
+		return err
+	}
+	if o.argon2Parallelism > maxArgon2Cpus {
+		return fmt.Errorf("%w: argon2 parallelism %v, maximum is %v", ErrKDFParamsTooLarge, o.argon2Parallelism, maxArgon2Cpus)
+	}
+	d.argon2Parallelism = o.argon2Parallelism
+	return nil
+}
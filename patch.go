@@ -0,0 +1,91 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+type headerField struct {
+	offset uintptr
+	size   uintptr
+	exact  bool // integer fields require the value of exact size, byte arrays accept shorter NUL padded values
+}
+
+// luks2HeaderFields is a registry of binary header fields that can be patched with PatchHeaderField.
+// HeaderSize is not patchable as it defines the checksummed area, Checksum is always recalculated.
+var luks2HeaderFields = func() map[string]headerField {
+	var hdr headerV2
+	return map[string]headerField{
+		"Magic":             {unsafe.Offsetof(hdr.Magic), unsafe.Sizeof(hdr.Magic), true},
+		"Version":           {unsafe.Offsetof(hdr.Version), unsafe.Sizeof(hdr.Version), true},
+		"SequenceId":        {unsafe.Offsetof(hdr.SequenceId), unsafe.Sizeof(hdr.SequenceId), true},
+		"Label":             {unsafe.Offsetof(hdr.Label), unsafe.Sizeof(hdr.Label), false},
+		"ChecksumAlgorithm": {unsafe.Offsetof(hdr.ChecksumAlgorithm), unsafe.Sizeof(hdr.ChecksumAlgorithm), false},
+		"Salt":              {unsafe.Offsetof(hdr.Salt), unsafe.Sizeof(hdr.Salt), true},
+		"UUID":              {unsafe.Offsetof(hdr.UUID), unsafe.Sizeof(hdr.UUID), false},
+		"SubsystemLabel":    {unsafe.Offsetof(hdr.SubsystemLabel), unsafe.Sizeof(hdr.SubsystemLabel), false},
+		"HeaderOffset":      {unsafe.Offsetof(hdr.HeaderOffset), unsafe.Sizeof(hdr.HeaderOffset), true},
+	}
+}()
+
+// PatchHeaderField overwrites a single field of the primary LUKS2 binary header, recalculates the header checksum
+// and writes the header back. It is intended for forensic repair of partially damaged headers thus the existing
+// checksum is not verified. Integer fields (e.g. "SequenceId") are expected in big-endian on-disk format.
+// Only the primary copy is patched, the secondary header keeps its old value so after changing e.g. UUID or Label
+// the copies diverge and HeaderConsistency reports it.
+func PatchHeaderField(f *os.File, fieldName string, value []byte) error {
+	field, ok := luks2HeaderFields[fieldName]
+	if !ok {
+		return fmt.Errorf("header field %v cannot be patched", fieldName)
+	}
+	if field.exact && uintptr(len(value)) != field.size {
+		return fmt.Errorf("header field %v expects %v bytes value, got %v", fieldName, field.size, len(value))
+	}
+	if uintptr(len(value)) > field.size {
+		return fmt.Errorf("header field %v value is too long: %v bytes, maximum is %v", fieldName, len(value), field.size)
+	}
+
+	var hdr headerV2
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.Version != 2 {
+		return fmt.Errorf("header patching is supported for LUKS2 only, got version %v", hdr.Version)
+	}
+	hdrSize := hdr.HeaderSize
+	if !isPowerOfTwo(uint(hdrSize)) || hdrSize < 16384 || hdrSize > 4194304 {
+		return fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
+	}
+
+	data := make([]byte, hdrSize)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	fieldData := data[field.offset : field.offset+field.size]
+	clearSlice(fieldData)
+	copy(fieldData, value)
+
+	if !bytes.Equal(data[0:6], []byte("LUKS\xba\xbe")) {
+		return fmt.Errorf("invalid LUKS header")
+	}
+
+	// the algorithm might be patched as well, use the new value
+	algo := fixedArrayToString(data[unsafe.Offsetof(hdr.ChecksumAlgorithm) : unsafe.Offsetof(hdr.ChecksumAlgorithm)+unsafe.Sizeof(hdr.ChecksumAlgorithm)])
+	checksum, err := luks2HeaderChecksum(data, algo)
+	if err != nil {
+		return err
+	}
+	checksumData := data[unsafe.Offsetof(hdr.Checksum) : unsafe.Offsetof(hdr.Checksum)+unsafe.Sizeof(hdr.Checksum)]
+	clearSlice(checksumData)
+	copy(checksumData, checksum)
+
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
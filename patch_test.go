@@ -0,0 +1,60 @@
+package luks
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPatchHeaderField(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	// damage the UUID, header checksum becomes invalid
+	if _, err := disk.WriteAt([]byte("garbage"), 168); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := luks2OpenDevice(disk); err == nil {
+		t.Fatal("header with damaged UUID is expected to fail checksum verification")
+	}
+
+	uuid := "8a7ba2d6-6b5b-4a4b-9b4f-1b1c4aa2f4c3"
+	if err := PatchHeaderField(disk, "UUID", []byte(uuid)); err != nil {
+		t.Fatal(err)
+	}
+
+	seqId := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqId, 42)
+	if err := PatchHeaderField(disk, "SequenceId", seqId); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.uuid() != uuid {
+		t.Fatalf("expected UUID %v, got %v", uuid, d.uuid())
+	}
+	if d.hdr.SequenceId != 42 {
+		t.Fatalf("expected sequence id 42, got %v", d.hdr.SequenceId)
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPatchHeaderFieldInvalidValue(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	if err := PatchHeaderField(disk, "SequenceId", []byte{1, 2}); err == nil {
+		t.Fatal("integer field with wrong size value is expected to be rejected")
+	}
+	if err := PatchHeaderField(disk, "Label", make([]byte, 49)); err == nil {
+		t.Fatal("too long label is expected to be rejected")
+	}
+	if err := PatchHeaderField(disk, "Checksum", make([]byte, 64)); err == nil {
+		t.Fatal("checksum field is not expected to be patchable")
+	}
+}
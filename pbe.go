@@ -0,0 +1,171 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PBEOptions specify Argon2id parameters of EncryptWithPassphrase. Zero values are replaced with the same defaults
+// Format uses.
+type PBEOptions struct {
+	Time   uint
+	Memory uint // in KiB
+	Cpus   uint
+}
+
+const (
+	pbeVersion    = 1
+	pbeEncryption = "aes-xts-plain64"
+	pbeKeySize    = 64 // AES-256 in XTS mode
+)
+
+var pbeMagic = [8]byte{'L', 'U', 'K', 'S', '-', 'P', 'B', 'E'}
+
+// pbeHeader precedes the ciphertext produced by EncryptWithPassphrase, the fields are big-endian
+type pbeHeader struct {
+	Magic      [8]byte
+	Version    uint16
+	Time       uint32
+	Memory     uint32
+	Cpus       uint32
+	Salt       [32]byte // Argon2id salt
+	DigestSalt [32]byte
+	Digest     [32]byte // PBKDF2-SHA256 of the derived key, detects a wrong passphrase like LUKS2 digests do
+	IV         uint64   // sector number of the first ciphertext sector
+	Length     uint64   // plaintext length, the ciphertext is padded to the sector size
+}
+
+// EncryptWithPassphrase encrypts `data` with a key derived from the passphrase using the LUKS2 defaults: Argon2id
+// and AES-256 in XTS mode over 512-byte sectors. The result starts with a header that stores the KDF parameters.
+// This is not the LUKS on-disk format. Like dm-crypt, the encryption is not authenticated: modification of the
+// ciphertext is not detected.
+func EncryptWithPassphrase(data, passphrase []byte, opts *PBEOptions) ([]byte, error) {
+	var o PBEOptions
+	if opts != nil {
+		o = *opts
+	}
+	defaults := (&FormatOptions{KDF: "argon2id"}).withDefaults()
+	if o.Time == 0 {
+		o.Time = defaults.Iterations
+	}
+	if o.Memory == 0 {
+		o.Memory = defaults.Memory
+	}
+	if o.Cpus == 0 {
+		o.Cpus = defaults.Cpus
+	}
+
+	hdr := pbeHeader{
+		Magic:   pbeMagic,
+		Version: pbeVersion,
+		Time:    uint32(o.Time),
+		Memory:  uint32(o.Memory),
+		Cpus:    uint32(o.Cpus),
+		Length:  uint64(len(data)),
+	}
+	if uint(hdr.Time) != o.Time || uint(hdr.Memory) != o.Memory || uint(hdr.Cpus) != o.Cpus {
+		return nil, fmt.Errorf("%w: %+v", ErrKDFParamsTooLarge, o)
+	}
+	var iv [8]byte
+	for _, buf := range [][]byte{hdr.Salt[:], hdr.DigestSalt[:], iv[:]} {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+	hdr.IV = binary.BigEndian.Uint64(iv[:]) >> 1 // leave room for sector numbers to grow
+
+	key, err := hdr.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+	copy(hdr.Digest[:], pbkdf2.Key(key.Bytes(), hdr.DigestSalt[:], formatDigestIterations, len(hdr.Digest), sha256.New))
+
+	ciph, err := buildLuks2AfCipher(pbeEncryption, key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var buff bytes.Buffer
+	if err := binary.Write(&buff, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	headerSize := buff.Len()
+
+	result := make([]byte, headerSize+roundUp(len(data), storageSectorSize))
+	copy(result, buff.Bytes())
+	payload := result[headerSize:]
+	copy(payload, data)
+	for i := 0; i < len(payload)/storageSectorSize; i++ {
+		sector := payload[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(sector, sector, hdr.IV+uint64(i))
+	}
+	return result, nil
+}
+
+// DecryptWithPassphrase decrypts data produced by EncryptWithPassphrase. ErrPassphraseDoesNotMatch is returned
+// if the passphrase is wrong.
+func DecryptWithPassphrase(ciphertext, passphrase []byte) ([]byte, error) {
+	var hdr pbeHeader
+	headerSize := binary.Size(hdr)
+	if len(ciphertext) < headerSize {
+		return nil, fmt.Errorf("ciphertext is too short: %v bytes", len(ciphertext))
+	}
+	if err := binary.Read(bytes.NewReader(ciphertext[:headerSize]), binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic != pbeMagic {
+		return nil, fmt.Errorf("ciphertext is not produced by EncryptWithPassphrase")
+	}
+	if hdr.Version != pbeVersion {
+		return nil, fmt.Errorf("unsupported passphrase encryption version %v", hdr.Version)
+	}
+
+	payload := ciphertext[headerSize:]
+	if len(payload)%storageSectorSize != 0 || uint64(len(payload)) < hdr.Length || uint64(len(payload))-hdr.Length >= storageSectorSize {
+		return nil, fmt.Errorf("ciphertext size %v does not match the plaintext length %v", len(payload), hdr.Length)
+	}
+
+	key, err := hdr.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+	digest := pbkdf2.Key(key.Bytes(), hdr.DigestSalt[:], formatDigestIterations, len(hdr.Digest), sha256.New)
+	if subtle.ConstantTimeCompare(digest, hdr.Digest[:]) != 1 {
+		return nil, ErrPassphraseDoesNotMatch
+	}
+
+	ciph, err := buildLuks2AfCipher(pbeEncryption, key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(payload))
+	for i := 0; i < len(payload)/storageSectorSize; i++ {
+		sector := payload[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Decrypt(plaintext[i*storageSectorSize:(i+1)*storageSectorSize], sector, hdr.IV+uint64(i))
+	}
+	return plaintext[:hdr.Length], nil
+}
+
+// deriveKey derives the encryption key with Argon2id, the parameters are verified against the configured limits
+func (h *pbeHeader) deriveKey(passphrase []byte) (*SecretBuffer, error) {
+	params := kdf{
+		Type:   "argon2id",
+		Salt:   base64.StdEncoding.EncodeToString(h.Salt[:]),
+		Time:   uint(h.Time),
+		Memory: uint(h.Memory),
+		Cpus:   uint(h.Cpus),
+	}
+	if params.Time == 0 || params.Memory == 0 || params.Cpus == 0 {
+		return nil, fmt.Errorf("invalid Argon2 parameters: %+v", params)
+	}
+	return deriveLuks2AfKey(params, 0, passphrase, pbeKeySize)
+}
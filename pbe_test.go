@@ -0,0 +1,60 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptWithPassphrase(t *testing.T) {
+	opts := &PBEOptions{Time: 1, Memory: 64, Cpus: 1}
+	for _, size := range []int{0, 1, 511, 512, 513, 5000} {
+		data := randomBytes(t, size)
+		ciphertext, err := EncryptWithPassphrase(data, []byte("foobar"), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size >= 16 && bytes.Contains(ciphertext, data[:16]) {
+			t.Fatalf("%v: ciphertext contains the plaintext", size)
+		}
+
+		plaintext, err := DecryptWithPassphrase(ciphertext, []byte("foobar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, data) {
+			t.Fatalf("%v: decrypted data does not match", size)
+		}
+
+		if _, err := DecryptWithPassphrase(ciphertext, []byte("wrong")); err != ErrPassphraseDoesNotMatch {
+			t.Fatalf("%v: expected ErrPassphraseDoesNotMatch, got %v", size, err)
+		}
+	}
+}
+
+func TestDecryptWithPassphraseInvalid(t *testing.T) {
+	ciphertext, err := EncryptWithPassphrase([]byte("secret data"), []byte("foobar"), &PBEOptions{Time: 1, Memory: 64, Cpus: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecryptWithPassphrase(ciphertext[:40], []byte("foobar")); err == nil {
+		t.Fatal("expected an error for a truncated header")
+	}
+	if _, err := DecryptWithPassphrase(ciphertext[:len(ciphertext)-1], []byte("foobar")); err == nil {
+		t.Fatal("expected an error for a truncated payload")
+	}
+
+	// crafted KDF memory cost is refused before the derivation
+	crafted := append([]byte(nil), ciphertext...)
+	copy(crafted[14:18], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := DecryptWithPassphrase(crafted, []byte("foobar")); !errors.Is(err, ErrKDFParamsTooLarge) {
+		t.Fatalf("expected ErrKDFParamsTooLarge, got %v", err)
+	}
+
+	crafted = append([]byte(nil), ciphertext...)
+	crafted[0] = 'X'
+	if _, err := DecryptWithPassphrase(crafted, []byte("foobar")); err == nil {
+		t.Fatal("expected an error for invalid magic")
+	}
+}
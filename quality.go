@@ -0,0 +1,125 @@
+package luks
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+// QualityReport is an estimation of passphrase strength
+type QualityReport struct {
+	EntropyBits float64 // length * log2(size of the alphabet formed by the used character classes)
+	HasUpper    bool
+	HasLower    bool
+	HasDigit    bool
+	HasSpecial  bool
+	Length      int // in characters
+
+	// IsBreached reports that the passphrase appears in the HaveIBeenPwned breach database. PasswordQualityCheck
+	// works offline and leaves it false, hibp.UpdateReport fills it in.
+	IsBreached bool
+}
+
+// sizes of character classes used for the entropy estimation
+const (
+	lowerClassSize   = 26
+	upperClassSize   = 26
+	digitClassSize   = 10
+	specialClassSize = 33  // printable ASCII punctuation and space
+	unicodeClassSize = 100 // a rough guess for letters outside of ASCII
+)
+
+// PasswordQualityCheck estimates the passphrase entropy with a character class model: the alphabet is the union
+// of classes (lowercase, uppercase, digits, special characters) present in the passphrase. The model does not
+// detect dictionary words or patterns, thus it is an upper bound of the real entropy.
+func PasswordQualityCheck(passphrase []byte) (*QualityReport, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	if !utf8.Valid(passphrase) {
+		return nil, fmt.Errorf("passphrase is not a valid UTF-8 string")
+	}
+
+	var report QualityReport
+	var hasUnicode bool
+	for _, r := range string(passphrase) {
+		report.Length++
+		switch {
+		case r >= 'a' && r <= 'z':
+			report.HasLower = true
+		case r >= 'A' && r <= 'Z':
+			report.HasUpper = true
+		case r >= '0' && r <= '9':
+			report.HasDigit = true
+		case r < utf8.RuneSelf:
+			report.HasSpecial = true
+		case unicode.IsLetter(r):
+			hasUnicode = true
+		default:
+			report.HasSpecial = true
+		}
+	}
+
+	var alphabet int
+	if report.HasLower {
+		alphabet += lowerClassSize
+	}
+	if report.HasUpper {
+		alphabet += upperClassSize
+	}
+	if report.HasDigit {
+		alphabet += digitClassSize
+	}
+	if report.HasSpecial {
+		alphabet += specialClassSize
+	}
+	if hasUnicode {
+		alphabet += unicodeClassSize
+	}
+	report.EntropyBits = float64(report.Length) * math.Log2(float64(alphabet))
+
+	return &report, nil
+}
+
+// PassphraseChecker validates a new passphrase before a keyslot is created for it
+type PassphraseChecker func(passphrase []byte) error
+
+// NewPassphraseConfirmationChecker returns a checker that requires the passphrase length in bytes to be within
+// [minLen, maxLen]. maxLen less or equal to zero means no upper limit.
+func NewPassphraseConfirmationChecker(minLen, maxLen int) PassphraseChecker {
+	return func(passphrase []byte) error {
+		if len(passphrase) < minLen {
+			return fmt.Errorf("passphrase is too short: %v bytes, at least %v required", len(passphrase), minLen)
+		}
+		if maxLen > 0 && len(passphrase) > maxLen {
+			return fmt.Errorf("passphrase is too long: %v bytes, at most %v allowed", len(passphrase), maxLen)
+		}
+		return nil
+	}
+}
+
+// NoBinaryNullChecker rejects passphrases that contain NUL bytes. Tools that handle the passphrase as a C string
+// truncate it at the first NUL, such keyslot cannot be unlocked with them.
+func NoBinaryNullChecker(passphrase []byte) error {
+	if i := bytes.IndexByte(passphrase, 0); i != -1 {
+		return fmt.Errorf("passphrase contains a NUL byte at position %v", i)
+	}
+	return nil
+}
+
+// MaxEntropyChecker returns a checker that requires the entropy estimated by PasswordQualityCheck to be at least
+// minBits
+func MaxEntropyChecker(minBits float64) PassphraseChecker {
+	return func(passphrase []byte) error {
+		report, err := PasswordQualityCheck(passphrase)
+		if err != nil {
+			return err
+		}
+		if report.EntropyBits < minBits {
+			return fmt.Errorf("passphrase is too weak: estimated entropy %.1f bits, at least %.1f required", report.EntropyBits, minBits)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,56 @@
+package luks
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPasswordQualityCheck(t *testing.T) {
+	report, err := PasswordQualityCheck([]byte("Passw0rd!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HasUpper || !report.HasLower || !report.HasDigit || !report.HasSpecial || report.Length != 9 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if expected := 9 * math.Log2(26+26+10+33); math.Abs(report.EntropyBits-expected) > 1e-9 {
+		t.Fatalf("expected entropy %v, got %v", expected, report.EntropyBits)
+	}
+
+	report, err = PasswordQualityCheck([]byte("пароль"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Length != 6 || report.HasLower || report.HasSpecial {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if _, err := PasswordQualityCheck(nil); err == nil {
+		t.Fatal("expected an error for an empty passphrase")
+	}
+}
+
+func TestPassphraseCheckers(t *testing.T) {
+	tests := []struct {
+		checker    PassphraseChecker
+		passphrase string
+		valid      bool
+	}{
+		{NewPassphraseConfirmationChecker(8, 16), "password", true},
+		{NewPassphraseConfirmationChecker(8, 16), "short", false},
+		{NewPassphraseConfirmationChecker(8, 16), "way too long passphrase", false},
+		{NewPassphraseConfirmationChecker(1, 0), strings.Repeat("x", 10000), true},
+		{NoBinaryNullChecker, "foobar", true},
+		{NoBinaryNullChecker, "foo\x00bar", false},
+		{MaxEntropyChecker(40), "correct horse battery", true},
+		{MaxEntropyChecker(40), "abc", false},
+		{MaxEntropyChecker(40), "", false},
+	}
+	for i, test := range tests {
+		err := test.checker([]byte(test.passphrase))
+		if (err == nil) != test.valid {
+			t.Errorf("test %v: passphrase %q, expected valid=%v, got %v", i, test.passphrase, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package luks
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// volumeReader provides random access to the decrypted content of an unlocked volume
+type volumeReader struct {
+	r          io.ReaderAt
+	ciph       sectorCipher
+	sectorSize int64
+	offset     int64  // offset of the encrypted data at the underlying device, in bytes
+	size       int64  // size of the encrypted data in bytes, -1 means the data spans till the end of the device
+	ivTweak    uint64 // IV offset, in 512-byte sectors
+}
+
+// NewReaderAt returns a reader for the decrypted content of the unlocked volume stored at `r`. It allows to read
+// the volume without dm-crypt, e.g. from an image file. A read decrypts only the sectors that cover the
+// requested range. WithPhysicalBlockSize option aligns reads from `r` to the device physical block size.
+func NewReaderAt(r io.ReaderAt, volume *VolumeInfo, opts ...Option) (io.ReaderAt, error) {
+	o := buildOptions(opts)
+	if err := checkPhysicalBlockSize(o.physicalBlockSize); err != nil {
+		return nil, err
+	}
+	if volume.storageIntegrity != "" {
+		// dm-integrity interleaves data with its metadata and journal, sectors cannot be read directly
+		return nil, fmt.Errorf("%w: segment uses %v", ErrIntegrityUnsupported, volume.storageIntegrity)
+	}
+	if len(volume.segments) > 1 {
+		return nil, fmt.Errorf("reading a volume with %v segments is not supported", len(volume.segments))
+	}
+	sectorSize := volumeSectorSize(volume)
+	if sectorSize < storageSectorSize || !isPowerOfTwo(uint(sectorSize)) {
+		return nil, fmt.Errorf("invalid sector size %v", sectorSize)
+	}
+
+	ciph, err := buildLuks2AfCipher(volume.storageEncryption, volume.key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(-1)
+	if volume.storageSize != 0 {
+		size = int64(volume.storageSize) * sectorSize
+	}
+
+	return &volumeReader{
+		r:          newAlignedReaderAt(r, o.physicalBlockSize),
+		ciph:       ciph,
+		sectorSize: sectorSize,
+		offset:     int64(volume.storageOffset) * sectorSize,
+		size:       size,
+		ivTweak:    volume.storageIvTweak,
+	}, nil
+}
+
+// volumeSectorSize returns the encryption sector size of the volume, LUKS1 volumes do not set it
+func volumeSectorSize(volume *VolumeInfo) int64 {
+	if volume.storageSectorSize == 0 {
+		return storageSectorSize
+	}
+	return int64(volume.storageSectorSize)
+}
+
+func (v *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid read offset %v", off)
+	}
+
+	var eof bool
+	if v.size >= 0 {
+		if off >= v.size {
+			return 0, io.EOF
+		}
+		if off+int64(len(p)) > v.size {
+			p = p[:v.size-off]
+			eof = true
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// read only the sectors that cover [off, off+len(p))
+	firstSector := off / v.sectorSize
+	lastSector := (off + int64(len(p)) + v.sectorSize - 1) / v.sectorSize
+	buff := make([]byte, (lastSector-firstSector)*v.sectorSize)
+	defer clearSlice(buff)
+
+	n, err := v.r.ReadAt(buff, v.offset+firstSector*v.sectorSize)
+	sectors := int64(n) / v.sectorSize // a partially read sector cannot be decrypted
+	for i := int64(0); i < sectors; i++ {
+		sector := buff[i*v.sectorSize : (i+1)*v.sectorSize]
+		// with sector size larger than 512 the IV is counted in sector size units (dm-crypt iv_large_sectors)
+		sectorsPerBlock := uint64(v.sectorSize / storageSectorSize)
+		ivSector := IVTweakToSectorIdx(v.ivTweak, uint64(firstSector+i)*sectorsPerBlock) / sectorsPerBlock
+		v.ciph.Decrypt(sector, sector, ivSector)
+	}
+
+	skip := off - firstSector*v.sectorSize
+	read := 0
+	if available := sectors*v.sectorSize - skip; available > 0 {
+		read = copy(p, buff[skip:skip+available])
+	}
+	if read < len(p) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return read, err
+	}
+	if eof {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// IVTweakToSectorIdx returns the sector number used as the IV of the volume sector at `sectorOffset`. The LUKS2
+// segment 'iv_tweak' shifts the IV of every sector, e.g. a segment moved during reencryption keeps the IVs it had
+// at the original offset. Both values are in 512-byte sectors as in the dm-crypt table. For encryption sectors
+// larger than 512 bytes dm-crypt (iv_large_sectors option) divides the result by sector_size/512.
+func IVTweakToSectorIdx(ivTweak uint64, sectorOffset uint64) uint64 {
+	return sectorOffset + ivTweak
+}
+
+// ReadMultipleSectors reads and decrypts `count` contiguous volume sectors starting at `startSector`. Sectors are
+// in units of the volume sector size. The data is read with a single read and all sectors are decrypted with
+// the same cipher instance, only the IV changes from sector to sector.
+func ReadMultipleSectors(f *os.File, info *VolumeInfo, startSector, count uint64) ([]byte, error) {
+	r, err := NewReaderAt(f, info)
+	if err != nil {
+		return nil, err
+	}
+	sectorSize := volumeSectorSize(info)
+	if count == 0 || count > math.MaxInt64/uint64(sectorSize) || startSector > (math.MaxInt64/uint64(sectorSize))-count {
+		return nil, fmt.Errorf("invalid sector range: start %v, count %v", startSector, count)
+	}
+
+	data := make([]byte, count*uint64(sectorSize))
+	if _, err := r.ReadAt(data, int64(startSector)*sectorSize); err != nil {
+		clearSlice(data)
+		if err == io.EOF {
+			err = fmt.Errorf("sectors %v-%v are beyond the end of the volume", startSector, startSector+count-1)
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,189 @@
+package luks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// countingReaderAt records the byte ranges read from the underlying reader
+type countingReaderAt struct {
+	r      io.ReaderAt
+	ranges [][2]int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.ranges = append(c.ranges, [2]int64{off, off + int64(len(p))})
+	return c.r.ReadAt(p, off)
+}
+
+// writeEncryptedSectors encrypts `plaintext` and writes it to `w` at the given sector of the volume
+func writeEncryptedSectors(t *testing.T, w io.WriterAt, volume *VolumeInfo, sector int64, plaintext []byte) {
+	ciph, err := buildLuks2AfCipher(volume.storageEncryption, volume.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sectorSize := int64(volume.storageSectorSize)
+	data := append([]byte(nil), plaintext...)
+	for i := int64(0); i < int64(len(data))/sectorSize; i++ {
+		block := data[i*sectorSize : (i+1)*sectorSize]
+		ciph.Encrypt(block, block, uint64(sector+i)+volume.storageIvTweak*storageSectorSize/uint64(sectorSize))
+	}
+	if _, err := w.WriteAt(data, int64(volume.storageOffset)*sectorSize+sector*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderAtRandomAccess(t *testing.T) {
+	const dataOffset = 16 * 1024 * 1024
+	const gib = 1024 * 1024 * 1024
+
+	disk, err := ioutil.TempFile("", "luks.go.reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+	if err := disk.Truncate(dataOffset + 2*gib); err != nil { // sparse file
+		t.Fatal(err)
+	}
+
+	volume := &VolumeInfo{
+		key:               randomBytes(t, 64),
+		storageEncryption: "aes-xts-plain64",
+		storageSectorSize: 512,
+		storageOffset:     dataOffset / 512,
+	}
+	plaintext := randomBytes(t, 3*4096)
+	writeEncryptedSectors(t, disk, volume, (gib-4096)/512, plaintext)
+
+	counter := &countingReaderAt{r: disk}
+	r, err := NewReaderAt(counter, volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	window := make([]byte, 4096)
+	if _, err := r.ReadAt(window, gib); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(window, plaintext[4096:8192]) {
+		t.Fatal("decrypted window does not match")
+	}
+	expected := [][2]int64{{dataOffset + gib, dataOffset + gib + 4096}}
+	if len(counter.ranges) != 1 || counter.ranges[0] != expected[0] {
+		t.Fatalf("expected only covering sectors %v to be read, got %v", expected, counter.ranges)
+	}
+
+	// unaligned window covers 2 partial sectors
+	counter.ranges = nil
+	window = make([]byte, 100)
+	if _, err := r.ReadAt(window, gib+4096-50); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(window, plaintext[8192-50:8192+50]) {
+		t.Fatal("decrypted unaligned window does not match")
+	}
+	expected = [][2]int64{{dataOffset + gib + 4096 - 512, dataOffset + gib + 4096 + 512}}
+	if len(counter.ranges) != 1 || counter.ranges[0] != expected[0] {
+		t.Fatalf("expected only covering sectors %v to be read, got %v", expected, counter.ranges)
+	}
+}
+
+func TestReaderAtLargeSectors(t *testing.T) {
+	disk, err := ioutil.TempFile("", "luks.go.reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	volume := &VolumeInfo{
+		key:               randomBytes(t, 32),
+		storageEncryption: "aes-cbc-essiv:sha256",
+		storageSectorSize: 4096,
+		storageOffset:     1,
+		storageIvTweak:    64,
+		storageSize:       4,
+	}
+	plaintext := randomBytes(t, 4*4096)
+	writeEncryptedSectors(t, disk, volume, 0, plaintext)
+
+	r, err := NewReaderAt(disk, volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 5000)
+	if _, err := r.ReadAt(data, 4000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plaintext[4000:9000]) {
+		t.Fatal("decrypted data does not match")
+	}
+
+	// reads past the end of the segment are truncated
+	data = make([]byte, 8192)
+	n, err := r.ReadAt(data, 3*4096)
+	if err != io.EOF || n != 4096 {
+		t.Fatalf("expected 4096 bytes and EOF at the end of the segment, got %v %v", n, err)
+	}
+	if !bytes.Equal(data[:n], plaintext[3*4096:]) {
+		t.Fatal("decrypted data at the end of the segment does not match")
+	}
+}
+
+func TestIVTweakToSectorIdx(t *testing.T) {
+	tests := []struct {
+		ivTweak, sectorOffset, expected uint64
+	}{
+		{0, 0, 0},
+		{0, 7, 7},
+		// a segment that starts 16 MiB into the original volume
+		{32768, 0, 32768},
+		{32768, 100, 32868},
+		{1 << 40, 1 << 40, 1 << 41},
+	}
+	for _, test := range tests {
+		if iv := IVTweakToSectorIdx(test.ivTweak, test.sectorOffset); iv != test.expected {
+			t.Errorf("IVTweakToSectorIdx(%v, %v) = %v, expected %v", test.ivTweak, test.sectorOffset, iv, test.expected)
+		}
+	}
+}
+
+func TestReadMultipleSectors(t *testing.T) {
+	disk, err := ioutil.TempFile("", "luks.go.reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	volume := &VolumeInfo{
+		key:               randomBytes(t, 64),
+		storageEncryption: "aes-xts-plain64",
+		storageSectorSize: 512,
+		storageOffset:     8,
+		storageIvTweak:    3,
+		storageSize:       64,
+	}
+	plaintext := randomBytes(t, 64*512)
+	writeEncryptedSectors(t, disk, volume, 0, plaintext)
+
+	data, err := ReadMultipleSectors(disk, volume, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plaintext[10*512:30*512]) {
+		t.Fatal("decrypted sectors do not match")
+	}
+
+	if _, err := ReadMultipleSectors(disk, volume, 60, 5); err == nil {
+		t.Fatal("reading past the end of the volume is expected to fail")
+	}
+	if _, err := ReadMultipleSectors(disk, volume, 0, 0); err == nil {
+		t.Fatal("empty sector range is expected to fail")
+	}
+}
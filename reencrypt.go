@@ -0,0 +1,144 @@
+package luks
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ReencryptState describes an interrupted LUKS2 re-encryption
+type ReencryptState struct {
+	Keyslot   int    // index of the 'reencrypt' keyslot, -1 if the state is recorded in a token
+	Token     int    // index of the re-encryption token, -1 if the state is recorded in a keyslot
+	Mode      string // 'reencrypt', 'encrypt' or 'decrypt'
+	Direction string // 'forward' or 'backward'
+	Offset    uint64 // offset of the data that is not re-encrypted yet, in bytes
+	Length    uint64 // length of the data that is not re-encrypted yet, in bytes. Zero if unknown or if it spans till the end of the device.
+}
+
+// HasPendingReencryption reports whether the device has an unfinished re-encryption
+func (d *Device) HasPendingReencryption() (bool, error) {
+	state, err := d.PendingReencryption()
+	if err != nil {
+		return false, err
+	}
+	return state != nil, nil
+}
+
+// PendingReencryption returns the state of an unfinished re-encryption or nil if there is none.
+// cryptsetup records the state in a keyslot of type 'reencrypt', older tools use a token of type
+// 'luks2-reencrypt' or 'reencrypt' with 'offset' and 'length' of the remaining data.
+// For the keyslot form the pending range is taken from the segments. If cryptsetup was interrupted while
+// re-encrypting a hotzone, it is the segment flagged 'in-reencryption'. Otherwise it is the segment that still
+// uses the old encryption, i.e. the one matching the 'backup-previous' segment.
+func (d *Device) PendingReencryption() (*ReencryptState, error) {
+	var keyslots []int
+	for idx, k := range d.meta.Keyslots {
+		if k.Type == "reencrypt" {
+			keyslots = append(keyslots, idx)
+		}
+	}
+	if len(keyslots) > 0 {
+		sort.Ints(keyslots)
+		k := d.meta.Keyslots[keyslots[0]]
+		state := &ReencryptState{
+			Keyslot:   keyslots[0],
+			Token:     -1,
+			Mode:      k.Mode,
+			Direction: k.Direction,
+		}
+		pending, err := d.pendingReencryptionSegment()
+		if err != nil {
+			return nil, err
+		}
+		if pending != nil {
+			state.Offset, state.Length = pending.Offset, pending.Size
+		}
+		return state, nil
+	}
+
+	var tokens []int
+	for idx, tok := range d.meta.Tokens {
+		if tok["type"] == "luks2-reencrypt" || tok["type"] == "reencrypt" {
+			tokens = append(tokens, idx)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	sort.Ints(tokens)
+	return parseReencryptToken(tokens[0], d.meta.Tokens[tokens[0]])
+}
+
+// pendingReencryptionSegment returns the segment that is not re-encrypted yet, nil if the segments do not tell
+func (d *Device) pendingReencryptionSegment() (*SegmentInfo, error) {
+	segments, err := d.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	// the hotzone that was being re-encrypted when the process was interrupted
+	for _, s := range segments {
+		if !s.IsBackup() && s.InReencryption() {
+			return &s, nil
+		}
+	}
+
+	var previous *SegmentInfo
+	for i, s := range segments {
+		for _, f := range s.Flags {
+			if f == "backup-previous" {
+				previous = &segments[i]
+			}
+		}
+	}
+	if previous == nil {
+		return nil, nil
+	}
+	for _, s := range segments {
+		if !s.IsBackup() && s.Type == previous.Type && s.Encryption == previous.Encryption {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+func parseReencryptToken(tokenIdx int, tok token) (*ReencryptState, error) {
+	type reencryptToken struct {
+		Mode      string     `json:"mode"`
+		Direction string     `json:"direction"`
+		Offset    jsonNumber `json:"offset"`
+		Length    jsonNumber `json:"length"`
+	}
+
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+	var rt reencryptToken
+	if err := json.Unmarshal(data, &rt); err != nil {
+		return nil, fmt.Errorf("invalid re-encryption token %v: %v", tokenIdx, err)
+	}
+
+	state := &ReencryptState{
+		Keyslot:   -1,
+		Token:     tokenIdx,
+		Mode:      rt.Mode,
+		Direction: rt.Direction,
+	}
+	if rt.Offset != "" {
+		offset, err := rt.Offset.Int64()
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid re-encryption token %v offset: %v", tokenIdx, rt.Offset)
+		}
+		state.Offset = uint64(offset)
+	}
+	if rt.Length != "" {
+		length, err := rt.Length.Int64()
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid re-encryption token %v length: %v", tokenIdx, rt.Length)
+		}
+		state.Length = uint64(length)
+	}
+	return state, nil
+}
@@ -0,0 +1,133 @@
+package luks
+
+import (
+	"testing"
+)
+
+func TestHasPendingReencryption(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	_, d := fx.open(t)
+
+	pending, err := d.HasPendingReencryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending {
+		t.Fatal("fresh device is not expected to have pending re-encryption")
+	}
+}
+
+func TestPendingReencryptionToken(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Tokens[3] = token{
+		"type":      "luks2-reencrypt",
+		"keyslots":  []interface{}{},
+		"mode":      "reencrypt",
+		"direction": "forward",
+		"offset":    "16777216",
+		"length":    "8388608",
+	}
+	_, d := fx.open(t)
+
+	pending, err := d.HasPendingReencryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		t.Fatal("re-encryption token is not detected")
+	}
+
+	state, err := d.PendingReencryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ReencryptState{Keyslot: -1, Token: 3, Mode: "reencrypt", Direction: "forward", Offset: 16777216, Length: 8388608}
+	if *state != expected {
+		t.Fatalf("expected %+v, got %+v", expected, *state)
+	}
+}
+
+func TestPendingReencryptionKeyslot(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Keyslots[1] = keyslot{
+		Type:      "reencrypt",
+		KeySize:   1,
+		Mode:      "encrypt",
+		Direction: "backward",
+		Area:      area{Type: "none", Offset: "290816", Size: "4096"},
+	}
+	_, d := fx.open(t)
+
+	state, err := d.PendingReencryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil {
+		t.Fatal("reencrypt keyslot is not detected")
+	}
+	if state.Keyslot != 1 || state.Token != -1 || state.Mode != "encrypt" || state.Direction != "backward" {
+		t.Fatalf("unexpected re-encryption state %+v", *state)
+	}
+}
+
+// cryptsetupReencryptFixture mimics metadata written by `cryptsetup reencrypt` that moves the data from
+// aes-cbc-essiv:sha256 to aes-xts-plain64 in forward direction
+func cryptsetupReencryptFixture(t *testing.T) *luks2Fixture {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Keyslots[1] = keyslot{
+		Type:      "reencrypt",
+		KeySize:   1,
+		Mode:      "reencrypt",
+		Direction: "forward",
+		Area:      area{Type: "checksum", Offset: "290816", Size: "4096"},
+	}
+	newSegment := func(offset, size string, encryption string, flags ...string) segment {
+		return segment{Type: "crypt", Offset: jsonNumber(offset), IvTweak: "0", Size: size, Encryption: encryption, SectorSize: 512, Flags: flags}
+	}
+	fx.meta.Segments = map[int]segment{
+		0: newSegment("1048576", "262144", "aes-xts-plain64"),
+		1: newSegment("1310720", "65536", "aes-xts-plain64", "in-reencryption"),
+		2: newSegment("1376256", "dynamic", "aes-cbc-essiv:sha256"),
+		3: newSegment("1048576", "dynamic", "aes-xts-plain64", "backup-final"),
+		4: newSegment("1048576", "dynamic", "aes-cbc-essiv:sha256", "backup-previous"),
+	}
+	fx.meta.Config.Requirements = &requirements{Mandatory: []string{"online-reencrypt-v2"}}
+	return fx
+}
+
+func TestPendingReencryptionHotzone(t *testing.T) {
+	fx := cryptsetupReencryptFixture(t)
+	_, d := fx.open(t)
+
+	state, err := d.PendingReencryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ReencryptState{Keyslot: 1, Token: -1, Mode: "reencrypt", Direction: "forward", Offset: 1310720, Length: 65536}
+	if state == nil || *state != expected {
+		t.Fatalf("expected %+v, got %+v", expected, state)
+	}
+}
+
+func TestPendingReencryptionPaused(t *testing.T) {
+	// between two hotzones the remaining data is the segment with the old encryption
+	fx := cryptsetupReencryptFixture(t)
+	delete(fx.meta.Segments, 1)
+	seg := fx.meta.Segments[0]
+	seg.Size = "327680"
+	fx.meta.Segments[0] = seg
+	_, d := fx.open(t)
+
+	state, err := d.PendingReencryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ReencryptState{Keyslot: 1, Token: -1, Mode: "reencrypt", Direction: "forward", Offset: 1376256}
+	if state == nil || *state != expected {
+		t.Fatalf("expected %+v, got %+v", expected, state)
+	}
+}
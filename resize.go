@@ -0,0 +1,121 @@
+package luks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// LUKS2 header size limits
+const (
+	minHeaderSize = 16384
+	maxHeaderSize = 4194304
+)
+
+// ResizeHeader changes the size of both LUKS2 header copies, e.g. grows the JSON area to fit more tokens.
+// The end of the keyslots region stays the same thus the region shrinks when the header grows. Keyslot areas
+// that overlap the enlarged headers are copied to free space of the region first, then the primary header is
+// written followed by the secondary one, and the stale areas are wiped with WipeFreeSpace. An interrupted resize
+// may leave the secondary header invalid, make a HeaderBackup before the resize.
+func ResizeHeader(f *os.File, newSize uint64) error {
+	if !isPowerOfTwo(uint(newSize)) || newSize < minHeaderSize || newSize > maxHeaderSize {
+		return fmt.Errorf("invalid LUKS2 header size %v, it must be a power of two between %v and %v", newSize, minHeaderSize, maxHeaderSize)
+	}
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		return err
+	}
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	if newSize == d.hdr.HeaderSize {
+		return nil
+	}
+
+	_, end, err := d.keyslotsRegion()
+	if err != nil {
+		return err
+	}
+	newStart := 2 * newSize
+	if newStart >= end {
+		return fmt.Errorf("headers of size %v do not fit before the end of the keyslots region at %v", newSize, end)
+	}
+	if layout := d.Layout(); layout.DataOffset != 0 && newStart > layout.DataOffset {
+		return fmt.Errorf("headers of size %v overlap the data at offset %v", newSize, layout.DataOffset)
+	}
+
+	// read the areas that are going to be overwritten by the headers before the layout is changed
+	var moved []int
+	var oldAreas []region
+	for idx := range d.meta.Keyslots {
+		offset, size, err := d.keyslotArea(idx)
+		if err != nil {
+			return err
+		}
+		if uint64(offset) < newStart {
+			moved = append(moved, idx)
+			oldAreas = append(oldAreas, region{uint64(offset), uint64(offset + size)})
+		}
+	}
+	sort.Ints(moved)
+	areas := make(map[int][]byte, len(moved))
+	defer func() {
+		for _, data := range areas {
+			clearSlice(data)
+		}
+	}()
+	for _, idx := range moved {
+		areas[idx], err = d.KeyslotAreaRead(f, idx)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.hdr.HeaderSize = newSize
+	d.meta.Config.JsonSize = jsonNumber(strconv.FormatUint(JsonSizeFromHeaderSize(newSize), 10))
+	d.meta.Config.KeyslotsSize = jsonNumber(strconv.FormatUint(end-newStart, 10))
+
+	// old areas stay in use until the new headers are written, the copies go to the space free in both layouts.
+	// The moved keyslots lie outside of the new region, they are added back once they get the new offset.
+	movedKeyslots := make(map[int]keyslot, len(moved))
+	for _, idx := range moved {
+		movedKeyslots[idx] = d.meta.Keyslots[idx]
+		delete(d.meta.Keyslots, idx)
+	}
+	newOffsets := make(map[int]uint64, len(moved))
+	for _, idx := range moved {
+		offset, err := d.findFreeKeyslotArea(uint64(len(areas[idx])), append(oldAreas, d.reservedAreas...)...)
+		if err != nil {
+			return err
+		}
+		ks := movedKeyslots[idx]
+		ks.Area.Offset = jsonNumber(strconv.FormatUint(offset, 10))
+		d.meta.Keyslots[idx] = ks
+		newOffsets[idx] = offset
+	}
+
+	jsonData, err := json.Marshal(d.meta)
+	if err != nil {
+		return err
+	}
+	if uint64(len(jsonData)) >= JsonAreaSize(d.hdr) {
+		return fmt.Errorf("JSON metadata of size %v does not fit into the header of size %v", len(jsonData), newSize)
+	}
+
+	for _, idx := range moved {
+		if _, err := f.WriteAt(areas[idx], int64(newOffsets[idx])); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// the new primary header overwrites the old secondary one, thus it goes first
+	if err := d.writeHeaders(f, 0, newSize); err != nil {
+		return err
+	}
+	return WipeFreeSpace(f, d)
+}
@@ -0,0 +1,68 @@
+package luks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResizeHeader(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "barfoo", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	for _, size := range []uint64{1000, 8192, 8 * 1024 * 1024, 1024 * 1024} {
+		if err := ResizeHeader(disk, size); err == nil {
+			t.Fatalf("header size %v is expected to be rejected", size)
+		}
+	}
+
+	if err := ResizeHeader(disk, 65536); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.hdr.HeaderSize != 65536 || d.hdr.SequenceId != fx.hdr.SequenceId+1 {
+		t.Fatalf("unexpected header size %v, sequence id %v", d.hdr.HeaderSize, d.hdr.SequenceId)
+	}
+	layout := d.Layout()
+	if layout.KeyslotsOffset != 2*65536 || layout.KeyslotsOffset+layout.KeyslotsSize != fixtureDataOffset {
+		t.Fatalf("unexpected layout %+v", layout)
+	}
+	if _, _, err := readLuks2Header(disk, 65536); err != nil {
+		t.Fatalf("secondary header: %v", err)
+	}
+
+	// keyslot 0 area overlapped the new headers and is moved, keyslot 1 stays in place
+	offset, _, err := d.keyslotArea(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 2*65536 {
+		t.Fatalf("keyslot 0 area at %v overlaps the headers", offset)
+	}
+	for idx, passphrase := range []string{"foobar", "barfoo"} {
+		volume, err := d.unlockKeyslot(disk, idx, []byte(passphrase))
+		if err != nil {
+			t.Fatalf("keyslot %v: %v", idx, err)
+		}
+		if !bytes.Equal(volume.key, fx.volumeKey) {
+			t.Fatalf("keyslot %v: unlocked volume key does not match", idx)
+		}
+	}
+
+	// and back to the original size
+	if err := ResizeHeader(disk, fixtureHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	d, err = luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.unlockKeyslot(disk, 0, []byte("foobar")); err != nil {
+		t.Fatal(err)
+	}
+}
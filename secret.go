@@ -0,0 +1,149 @@
+package luks
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// SecretBuffer holds a secret (passphrase or volume key) in memory that is allocated outside of the Go heap,
+// locked into RAM and excluded from core dumps. The garbage collector never moves or copies the content.
+// OpenWithSecret and UnlockWithSecret take the passphrase as a SecretBuffer, other functions that accept
+// a passphrase or a key as []byte use the slice returned by Bytes() directly without copying it.
+// The keys derived from the passphrase and the unlocked volume key are stored in SecretBuffers as well,
+// see VolumeInfo.Destroy. A normalized passphrase copy lives in the Go heap and is zeroed after use.
+type SecretBuffer struct {
+	mem  []byte // whole mapped region rounded up to the page size, nil if the buffer is not locked
+	data []byte
+}
+
+// munmapSecret releases the memory of a SecretBuffer. It is a variable so tests can inspect the memory
+// after Destroy.
+var munmapSecret = unix.Munmap
+
+// NewSecretBuffer allocates a locked buffer of `n` bytes
+func NewSecretBuffer(n int) (*SecretBuffer, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid secret buffer size: %v", n)
+	}
+
+	size := roundUp(n, os.Getpagesize())
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("secret buffer mmap: %v", err)
+	}
+	if err := unix.Mlock(mem); err != nil {
+		_ = unix.Munmap(mem)
+		return nil, fmt.Errorf("secret buffer mlock: %v", err)
+	}
+	// do not leak the secret into core dumps, not all kernels support it
+	_ = unix.Madvise(mem, unix.MADV_DONTDUMP)
+
+	return &SecretBuffer{mem: mem, data: mem[:n]}, nil
+}
+
+// newSecret allocates a buffer for a secret computed by the library. If locked memory is not available,
+// e.g. RLIMIT_MEMLOCK is exhausted, the buffer falls back to the Go heap instead of failing the unlock.
+func newSecret(n int) *SecretBuffer {
+	if b, err := NewSecretBuffer(n); err == nil {
+		return b
+	}
+	return &SecretBuffer{data: make([]byte, n)}
+}
+
+// secretFromBytes moves `b` into a new secret buffer and zeroes `b`
+func secretFromBytes(b []byte) *SecretBuffer {
+	s := newSecret(len(b))
+	copy(s.data, b)
+	clearSlice(b)
+	return s
+}
+
+// Bytes returns the secret content. The slice is valid until Destroy is called.
+func (b *SecretBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Destroy zeroes the secret and releases the locked memory
+func (b *SecretBuffer) Destroy() error {
+	clearSlice(b.mem)
+	clearSlice(b.data)
+	mem := b.mem
+	b.mem, b.data = nil, nil
+	if mem == nil {
+		return nil
+	}
+
+	if err := unix.Munlock(mem); err != nil {
+		return err
+	}
+	return munmapSecret(mem)
+}
+
+// SecurePassphrase owns a passphrase stored in the Go heap and zeroes it when closed or, as a fallback, when it is
+// garbage collected. Unlike SecretBuffer the memory is not locked, but an unreferenced passphrase does not stay
+// in memory until it is overwritten by chance. Use the *Secure variants of the unlock functions, they keep
+// the passphrase reachable until the unlock finishes. A slice returned by Bytes() does not keep the passphrase
+// reachable: once the SecurePassphrase itself is unreferenced the garbage collector may zero the slice while
+// it is still in use.
+type SecurePassphrase struct {
+	data []byte
+}
+
+// NewSecurePassphrase takes ownership of `p`, the slice is zeroed when the passphrase is closed
+func NewSecurePassphrase(p []byte) *SecurePassphrase {
+	s := &SecurePassphrase{data: p}
+	runtime.SetFinalizer(s, (*SecurePassphrase).Close)
+	return s
+}
+
+// Bytes returns the passphrase. The slice is valid until Close is called.
+func (s *SecurePassphrase) Bytes() []byte {
+	return s.data
+}
+
+// Close zeroes the passphrase without waiting for the garbage collector
+func (s *SecurePassphrase) Close() error {
+	clearSlice(s.data)
+	s.data = nil
+	runtime.SetFinalizer(s, nil)
+	return nil
+}
+
+// OpenWithSecret is Open with the passphrase held by a SecretBuffer
+func OpenWithSecret(dev string, name string, keyslot int, passphrase *SecretBuffer, opts ...Option) error {
+	return Open(dev, name, keyslot, passphrase.Bytes(), opts...)
+}
+
+// UnlockWithSecret is Unlock with the passphrase held by a SecretBuffer. The volume key of the returned
+// VolumeInfo is stored in a SecretBuffer too, call VolumeInfo.Destroy once the volume is not needed.
+func UnlockWithSecret(r io.ReaderAt, keyslot int, passphrase *SecretBuffer, opts ...Option) (*VolumeInfo, error) {
+	return Unlock(r, keyslot, passphrase.Bytes(), opts...)
+}
+
+// OpenSecure is Open with the passphrase held by a SecurePassphrase
+func OpenSecure(dev string, name string, keyslot int, passphrase *SecurePassphrase, opts ...Option) error {
+	defer runtime.KeepAlive(passphrase)
+	return Open(dev, name, keyslot, passphrase.Bytes(), opts...)
+}
+
+// UnlockSecure is Unlock with the passphrase held by a SecurePassphrase
+func UnlockSecure(r io.ReaderAt, keyslot int, passphrase *SecurePassphrase, opts ...Option) (*VolumeInfo, error) {
+	defer runtime.KeepAlive(passphrase)
+	return Unlock(r, keyslot, passphrase.Bytes(), opts...)
+}
+
+// UnlockAllSecure is UnlockAll with the passphrase held by a SecurePassphrase
+func UnlockAllSecure(devices []*Device, files []*os.File, passphrase *SecurePassphrase, opts ...Option) ([]*VolumeInfo, error) {
+	defer runtime.KeepAlive(passphrase)
+	return UnlockAll(devices, files, passphrase.Bytes(), opts...)
+}
+
+// UnlockWithExpiryCheckSecure is UnlockWithExpiryCheck with the passphrase held by a SecurePassphrase
+func UnlockWithExpiryCheckSecure(f *os.File, passphrase *SecurePassphrase, opts ...Option) (*VolumeInfo, error) {
+	defer runtime.KeepAlive(passphrase)
+	return UnlockWithExpiryCheck(f, passphrase.Bytes(), opts...)
+}
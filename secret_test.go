@@ -0,0 +1,129 @@
+package luks
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSecretBufferUnlock(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, _ := fx.open(t)
+
+	secret, err := NewSecretBuffer(len("foobar"))
+	if err != nil {
+		t.Skipf("locked memory is not available: %v", err)
+	}
+	copy(secret.Bytes(), "foobar")
+
+	volume, err := UnlockWithSecret(disk, AnyKeyslot, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("volume key unlocked with a secret buffer does not match")
+	}
+	if volume.keySecret == nil || volume.keySecret.mem == nil {
+		t.Fatal("volume key is expected to be stored in locked memory")
+	}
+
+	// keep the memory mapped so it can be inspected after Destroy
+	var unmapped [][]byte
+	munmapSecret = func(mem []byte) error {
+		unmapped = append(unmapped, mem)
+		return nil
+	}
+	defer func() {
+		munmapSecret = unix.Munmap
+		for _, mem := range unmapped {
+			_ = unix.Munmap(mem)
+		}
+	}()
+
+	key := volume.key
+	if err := volume.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) || volume.key != nil {
+		t.Fatal("volume key is not zeroed on Destroy")
+	}
+
+	data := secret.Bytes()
+	if err := secret.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(unmapped) != 2 {
+		t.Fatalf("expected the volume key and the passphrase buffers to be unmapped, got %v", len(unmapped))
+	}
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Fatal("secret buffer is not zeroed on Destroy")
+	}
+	if secret.Bytes() != nil {
+		t.Fatal("destroyed secret buffer still exposes its memory")
+	}
+	if err := secret.Destroy(); err != nil {
+		t.Fatal("second Destroy is expected to be a no-op")
+	}
+}
+
+func TestSecretBufferInvalidSize(t *testing.T) {
+	if _, err := NewSecretBuffer(0); err == nil {
+		t.Fatal("zero sized secret buffer is expected to be rejected")
+	}
+}
+
+func TestSecurePassphrase(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	data := []byte("foobar")
+	passphrase := NewSecurePassphrase(data)
+	if _, err := d.unlockKeyslot(disk, 0, passphrase.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := passphrase.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Fatal("passphrase is not zeroed on close")
+	}
+	if passphrase.Bytes() != nil {
+		t.Fatal("closed passphrase still exposes its memory")
+	}
+	if err := passphrase.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gcNormalizer runs the garbage collector in the middle of an unlock and leaves the passphrase as-is
+type gcNormalizer struct{}
+
+func (gcNormalizer) Bytes(b []byte) []byte {
+	// finalizers run in a separate goroutine, give them a chance to run
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return b
+}
+
+func TestSecurePassphraseGCDuringUnlock(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, _ := fx.open(t)
+
+	// the passphrase is not referenced after the call, only the unlock keeps it alive
+	volume, err := UnlockSecure(disk, 0, NewSecurePassphrase([]byte("foobar")), WithPassphraseNormalization(gcNormalizer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+}
@@ -0,0 +1,201 @@
+package luks
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SegmentInfo describes a LUKS2 data segment
+type SegmentInfo struct {
+	Index      int
+	Type       string // 'crypt' for dm-crypt segments
+	Offset     uint64 // offset of the segment data at the device, in bytes
+	Size       uint64 // size of the segment in bytes, zero if the segment is dynamic
+	Dynamic    bool   // the segment spans till the end of the device
+	IvTweak    uint64
+	Encryption string
+	SectorSize uint
+	Integrity  *IntegrityInfo // nil if the segment has no integrity protection
+	Flags      []string
+}
+
+// IsBackup reports whether the segment is a reencryption backup segment ('backup-previous', 'backup-final' or
+// 'backup-moved-segment' flag). Backup segments describe the old or the new data layout for reencryption
+// recovery and do not map any data, thus they are not used for reads and activation.
+func (s SegmentInfo) IsBackup() bool {
+	for _, f := range s.Flags {
+		if strings.HasPrefix(f, "backup-") {
+			return true
+		}
+	}
+	return false
+}
+
+// InReencryption reports whether the segment is being reencrypted ('in-reencryption' flag)
+func (s SegmentInfo) InReencryption() bool {
+	for _, f := range s.Flags {
+		if f == "in-reencryption" {
+			return true
+		}
+	}
+	return false
+}
+
+// IntegrityInfo describes dm-integrity parameters of a segment that uses authenticated encryption
+type IntegrityInfo struct {
+	Type              string // integrity algorithm, e.g. 'hmac(sha256)' or 'aead'
+	JournalEncryption string // journal encryption algorithm, 'none' if the journal is not encrypted
+	JournalIntegrity  string // journal integrity algorithm, 'none' if the journal is not protected
+	NoJournal         bool   // the device is activated without the journal (`--integrity-no-journal`)
+}
+
+// ErrNoIntegrityData is returned by GetIntegrityParams for segments without integrity protection
+var ErrNoIntegrityData = fmt.Errorf("segment has no integrity parameters")
+
+// IntegrityParams are dm-integrity parameters of a segment, as needed to configure dm-integrity underneath
+// dm-crypt. Key and tag sizes are in bytes, zero if the header does not specify them. In that case they are
+// implied by the integrity algorithm, e.g. 32 bytes for 'hmac(sha256)'.
+type IntegrityParams struct {
+	Type             string
+	JournalCrypt     string
+	JournalIntegrity string
+	IntegrityKeySize int
+	TagSize          int
+}
+
+// GetIntegrityParams returns the 'integrity' parameters of segment `segmentIdx`
+func (d *Device) GetIntegrityParams(segmentIdx int) (*IntegrityParams, error) {
+	s, ok := d.meta.Segments[segmentIdx]
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not found", segmentIdx)
+	}
+	if s.Integrity == nil || s.Integrity.Type == "" || s.Integrity.Type == "none" {
+		return nil, fmt.Errorf("segment %d: %w", segmentIdx, ErrNoIntegrityData)
+	}
+	return &IntegrityParams{
+		Type:             s.Integrity.Type,
+		JournalCrypt:     s.Integrity.JournalEncryption,
+		JournalIntegrity: s.Integrity.JournalIntegrity,
+		IntegrityKeySize: int(s.Integrity.KeySize),
+		TagSize:          int(s.Integrity.TagSize),
+	}, nil
+}
+
+// Segments returns the data segments of the device ordered by index. Reencryption backup segments are included,
+// see SegmentInfo.IsBackup.
+func (d *Device) Segments() ([]SegmentInfo, error) {
+	var indexes []int
+	for idx := range d.meta.Segments {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	result := make([]SegmentInfo, 0, len(indexes))
+	for _, idx := range indexes {
+		info, err := d.segmentInfo(idx)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (d *Device) segmentInfo(idx int) (SegmentInfo, error) {
+	s, ok := d.meta.Segments[idx]
+	if !ok {
+		return SegmentInfo{}, fmt.Errorf("segment %d is not found", idx)
+	}
+	info := SegmentInfo{
+		Index:      idx,
+		Type:       s.Type,
+		Encryption: s.Encryption,
+		SectorSize: s.SectorSize,
+		Flags:      s.Flags,
+	}
+
+	offset, err := s.Offset.Int64()
+	if err != nil || offset < 0 {
+		return SegmentInfo{}, fmt.Errorf("segment[%v] has invalid offset %q", idx, s.Offset)
+	}
+	info.Offset = uint64(offset)
+
+	if s.IvTweak != "" {
+		ivTweak, err := s.IvTweak.Int64()
+		if err != nil || ivTweak < 0 {
+			return SegmentInfo{}, fmt.Errorf("segment[%v] has invalid iv_tweak %q", idx, s.IvTweak)
+		}
+		info.IvTweak = uint64(ivTweak)
+	}
+
+	if s.Size == "dynamic" {
+		info.Dynamic = true
+	} else {
+		info.Size, err = strconv.ParseUint(s.Size, 10, 64)
+		if err != nil {
+			return SegmentInfo{}, fmt.Errorf("segment[%v] has invalid size %q", idx, s.Size)
+		}
+	}
+
+	if s.Integrity != nil && s.Integrity.Type != "none" {
+		info.Integrity = &IntegrityInfo{
+			Type:              s.Integrity.Type,
+			JournalEncryption: s.Integrity.JournalEncryption,
+			JournalIntegrity:  s.Integrity.JournalIntegrity,
+			NoJournal:         d.meta.hasConfigFlag("no-journal"),
+		}
+	}
+	return info, nil
+}
+
+// SegmentEncryption returns cipher, chaining mode and IV generator of the segment data encryption
+func (d *Device) SegmentEncryption(segmentIdx int) (cipher, mode, iv string, err error) {
+	s, ok := d.meta.Segments[segmentIdx]
+	if !ok {
+		return "", "", "", fmt.Errorf("segment %d is not found", segmentIdx)
+	}
+	return ParseEncryption(s.Encryption)
+}
+
+// AutoDetectDynamicSegmentSize returns size in bytes of a 'dynamic' segment that starts at `headerSize` bytes from
+// the device start and spans till the end of the device. Both regular files and block devices are supported.
+func AutoDetectDynamicSegmentSize(f *os.File, headerSize uint64) (uint64, error) {
+	return dynamicSegmentSize(f, headerSize)
+}
+
+// dynamicSegmentSize is AutoDetectDynamicSegmentSize for any device readerSize can get the size of
+func dynamicSegmentSize(f io.ReaderAt, headerSize uint64) (uint64, error) {
+	name := deviceName(f)
+	size, err := readerSize(f)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get size of %v: %v", name, err)
+	}
+	if uint64(size) <= headerSize {
+		return 0, fmt.Errorf("%v of size %v is too small for a dynamic segment at offset %v", name, size, headerSize)
+	}
+	return uint64(size) - headerSize, nil
+}
+
+// readerSize returns size of a block device, a regular file or an in-memory reader like ImageFile or bytes.Reader
+func readerSize(r io.ReaderAt) (int64, error) {
+	switch r := r.(type) {
+	case *os.File:
+		return deviceSize(r)
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	default:
+		return 0, fmt.Errorf("size of %T is unknown", r)
+	}
+}
+
+// deviceName returns the file name of the device for error messages
+func deviceName(r io.ReaderAt) string {
+	if f, ok := r.(*os.File); ok {
+		return f.Name()
+	}
+	return "device"
+}
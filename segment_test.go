@@ -0,0 +1,196 @@
+package luks
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSegmentsIntegrity(t *testing.T) {
+	data := []byte(`{"keyslots": {}, "tokens": {}, "digests": {},
+		"segments": {"0": {"type": "crypt", "offset": "16777216", "size": "dynamic", "iv_tweak": "0",
+			"encryption": "aes-xts-plain64", "sector_size": 4096,
+			"integrity": {"type": "hmac(sha256)", "journal_encryption": "none", "journal_integrity": "none"}}},
+		"config": {"json_size": "12288", "keyslots_size": "16744448", "flags": ["no-journal"]}}`)
+
+	d := &Device{meta: &metadata{}}
+	if err := unmarshalMetadata(data, d.meta); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := d.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %v", len(segments))
+	}
+	seg := segments[0]
+	if !seg.Dynamic || seg.Offset != 16777216 || seg.SectorSize != 4096 {
+		t.Fatalf("unexpected segment geometry: %+v", seg)
+	}
+	expected := IntegrityInfo{Type: "hmac(sha256)", JournalEncryption: "none", JournalIntegrity: "none", NoJournal: true}
+	if seg.Integrity == nil || *seg.Integrity != expected {
+		t.Fatalf("unexpected integrity parameters: %+v", seg.Integrity)
+	}
+}
+
+func TestUnlockIntegritySegment(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	seg := fx.meta.Segments[0]
+	seg.Integrity = &segmentIntegrity{Type: "hmac(sha256)", JournalEncryption: "none", JournalIntegrity: "none"}
+	fx.meta.Segments[0] = seg
+
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.storageIntegrity != "hmac(sha256)" {
+		t.Fatalf("unexpected volume integrity %q", volume.storageIntegrity)
+	}
+	if _, err := NewReaderAt(disk, volume); !errors.Is(err, ErrIntegrityUnsupported) {
+		t.Fatalf("expected ErrIntegrityUnsupported, got %v", err)
+	}
+}
+
+func TestKeyslotAndSegmentEncryption(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	seg := fx.meta.Segments[0]
+	seg.Encryption = "capi:xts(aes)-plain64"
+	fx.meta.Segments[0] = seg
+	_, d := fx.open(t)
+
+	if cipher, mode, iv, err := d.KeyslotEncryption(0); err != nil || cipher != "aes" || mode != "xts" || iv != "plain64" {
+		t.Fatalf("unexpected keyslot encryption (%v, %v, %v), err %v", cipher, mode, iv, err)
+	}
+	if cipher, mode, iv, err := d.SegmentEncryption(0); err != nil || cipher != "aes" || mode != "xts" || iv != "plain64" {
+		t.Fatalf("unexpected segment encryption (%v, %v, %v), err %v", cipher, mode, iv, err)
+	}
+	if _, _, _, err := d.KeyslotEncryption(5); err == nil {
+		t.Fatal("expected an error for a missing keyslot")
+	}
+}
+
+func TestUnlockDynamicSegmentSize(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := uint64(fx.diskSize-fixtureDataOffset) / storageSectorSize; volume.storageSize != expected {
+		t.Fatalf("expected dynamic segment of %v sectors, got %v", expected, volume.storageSize)
+	}
+
+	if _, err := AutoDetectDynamicSegmentSize(disk, uint64(fx.diskSize)); err == nil {
+		t.Fatal("expected an error for a segment that starts at the end of the device")
+	}
+}
+
+func TestUnlockMultipleSegmentsSharedDigest(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	// reencryption from 512 to 4096 byte sectors in progress, the first 64 KiB are already converted
+	fx.meta.Segments[0] = segment{Type: "crypt", Offset: "1048576", IvTweak: "0", Size: "65536", Encryption: "aes-xts-plain64", SectorSize: 4096}
+	fx.meta.Segments[1] = segment{Type: "crypt", Offset: "1114112", IvTweak: "128", Size: "dynamic", Encryption: "aes-xts-plain64", SectorSize: 512}
+	dig := fx.meta.Digests[0]
+	dig.Segments = []jsonNumber{"1", "0"}
+	fx.meta.Digests[0] = dig
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := volume.Segments()
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments, got %+v", segments)
+	}
+	if segments[0].Index != 0 || segments[0].SectorSize != 4096 || segments[0].Size != 65536 {
+		t.Fatalf("unexpected first segment: %+v", segments[0])
+	}
+	if segments[1].Index != 1 || segments[1].SectorSize != 512 || !segments[1].Dynamic || segments[1].IvTweak != 128 {
+		t.Fatalf("unexpected second segment: %+v", segments[1])
+	}
+	if volume.storageSectorSize != 4096 || volume.storageOffset != 1048576/4096 || volume.storageSize != 65536/4096 {
+		t.Fatalf("volume geometry does not describe the first segment: %+v", volume)
+	}
+	if _, err := NewReaderAt(disk, volume); err == nil {
+		t.Fatal("reading a multi-segment volume is expected to fail")
+	}
+}
+
+func TestGetIntegrityParams(t *testing.T) {
+	data := []byte(`{"keyslots": {}, "tokens": {}, "digests": {},
+		"segments": {
+			"0": {"type": "crypt", "offset": "16777216", "size": "dynamic", "iv_tweak": "0",
+				"encryption": "aes-xts-plain64", "sector_size": 4096,
+				"integrity": {"type": "hmac(sha256)", "journal_encryption": "none", "journal_integrity": "hmac(sha256)", "key_size": 32, "tag_size": 32}},
+			"1": {"type": "crypt", "offset": "33554432", "size": "dynamic", "iv_tweak": "0",
+				"encryption": "aes-xts-plain64", "sector_size": 512}},
+		"config": {"json_size": "12288", "keyslots_size": "16744448"}}`)
+
+	d := &Device{meta: &metadata{}}
+	if err := unmarshalMetadata(data, d.meta); err != nil {
+		t.Fatal(err)
+	}
+	params, err := d.GetIntegrityParams(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := IntegrityParams{Type: "hmac(sha256)", JournalCrypt: "none", JournalIntegrity: "hmac(sha256)", IntegrityKeySize: 32, TagSize: 32}
+	if *params != expected {
+		t.Fatalf("unexpected integrity parameters: %+v", params)
+	}
+
+	if _, err := d.GetIntegrityParams(1); !errors.Is(err, ErrNoIntegrityData) {
+		t.Fatalf("expected ErrNoIntegrityData, got %v", err)
+	}
+	if _, err := d.GetIntegrityParams(2); err == nil || errors.Is(err, ErrNoIntegrityData) {
+		t.Fatalf("missing segment is expected to fail with a different error, got %v", err)
+	}
+}
+
+func TestUnlockSkipsBackupSegment(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	// the backup segment describes the data layout before reencryption started, it overlaps the data segment
+	fx.meta.Segments[1] = segment{Type: "crypt", Offset: "1048576", IvTweak: "0", Size: "dynamic", Encryption: "aes-cbc-essiv:sha256",
+		SectorSize: 512, Flags: []string{"backup-previous"}}
+	dig := fx.meta.Digests[0]
+	dig.Segments = []jsonNumber{"1", "0"}
+	fx.meta.Digests[0] = dig
+	disk, d := fx.open(t)
+
+	// reencryption aware callers see both segments
+	all, err := d.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].IsBackup() || !all[1].IsBackup() || !reflect.DeepEqual(all[1].Flags, []string{"backup-previous"}) {
+		t.Fatalf("unexpected segments %+v", all)
+	}
+
+	volume, err := d.unlockKeyslot(disk, 0, []byte("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := volume.Segments()
+	if len(segments) != 1 || segments[0].Index != 0 {
+		t.Fatalf("backup segment is expected to be skipped, got %+v", segments)
+	}
+	if volume.storageEncryption != "aes-xts-plain64" {
+		t.Fatalf("volume is expected to use the data segment encryption, got %v", volume.storageEncryption)
+	}
+	if _, err := NewReaderAt(disk, volume); err != nil {
+		t.Fatal(err)
+	}
+	if layout := d.Layout(); layout.DataOffset != fixtureDataOffset || !layout.DynamicData {
+		t.Fatalf("unexpected layout %+v", layout)
+	}
+}
@@ -0,0 +1,144 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// type of the LUKS2 token that stores the Ed25519 header signature
+const headerSignatureTokenType = "luks2-header-signature"
+
+// SignHeader signs the LUKS2 header with the Ed25519 key and stores the signature in a "luks2-header-signature"
+// token, an existing signature is replaced. The signature covers the binary header and the JSON metadata except
+// the checksum and the signature token. The sequence id is signed as well thus any later header update
+// invalidates the signature until the header is signed again.
+func SignHeader(f *os.File, privKey ed25519.PrivateKey) error {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid Ed25519 private key size %v", len(privKey))
+	}
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		return err
+	}
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+
+	d.meta.Tokens = withoutSignatureTokens(d.meta.Tokens)
+
+	// UpdateHeader increments the sequence id, sign the header the way it is going to be stored
+	hdr := *d.hdr
+	hdr.SequenceId++
+	msg, err := headerSignatureMessage(&hdr, d.meta)
+	if err != nil {
+		return err
+	}
+
+	tokenIdx, err := d.meta.freeTokenIndex()
+	if err != nil {
+		return err
+	}
+
+	d.meta.Tokens[tokenIdx] = token{
+		"type":      headerSignatureTokenType,
+		"keyslots":  []interface{}{},
+		"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(privKey, msg)),
+	}
+	return d.UpdateHeader(f)
+}
+
+// VerifyHeaderSignature checks the header signature created by SignHeader. It returns false if the header has been
+// modified after signing or it is signed with a different key, and an error if the header has no signature.
+// Headers whose JSON metadata is not in the canonical form written by SignHeader, e.g. with fields this package
+// does not know about, are reported as modified.
+func VerifyHeaderSignature(f *os.File, pubKey ed25519.PublicKey) (bool, error) {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("invalid Ed25519 public key size %v", len(pubKey))
+	}
+	d, err := luks2OpenDevice(f)
+	if err != nil {
+		return false, err
+	}
+
+	// The signature covers the metadata as this package models it. Fields that are unknown to it are dropped
+	// by parsing, thus the on-disk JSON has to be exactly the form SignHeader writes.
+	hdr, data, err := readLuks2Header(f, 0)
+	if err != nil {
+		return false, err
+	}
+	rawJson, err := luks2JsonData(hdr, data)
+	if err != nil {
+		return false, err
+	}
+	canonicalJson, err := json.Marshal(d.meta)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(rawJson, canonicalJson) {
+		return false, nil
+	}
+
+	var signature []byte
+	for idx, tok := range d.meta.Tokens {
+		if tok["type"] != headerSignatureTokenType {
+			continue
+		}
+		if signature != nil {
+			return false, fmt.Errorf("header has multiple signature tokens")
+		}
+		encoded, ok := tok["signature"].(string)
+		if !ok {
+			return false, fmt.Errorf("token %v has no signature", idx)
+		}
+		signature, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return false, fmt.Errorf("token %v signature base64 parsing failed: %v", idx, err)
+		}
+	}
+	if signature == nil {
+		return false, fmt.Errorf("header is not signed")
+	}
+
+	d.meta.Tokens = withoutSignatureTokens(d.meta.Tokens)
+	msg, err := headerSignatureMessage(d.hdr, d.meta)
+	if err != nil {
+		return false, err
+	}
+	return ed25519.Verify(pubKey, msg, signature), nil
+}
+
+func withoutSignatureTokens(tokens map[int]token) map[int]token {
+	result := make(map[int]token, len(tokens))
+	for idx, tok := range tokens {
+		if tok["type"] != headerSignatureTokenType {
+			result[idx] = tok
+		}
+	}
+	return result
+}
+
+// headerSignatureMessage returns the signed data: the binary header with zeroed checksum followed by
+// the canonical JSON metadata
+func headerSignatureMessage(hdr *headerV2, meta *metadata) ([]byte, error) {
+	h := *hdr
+	h.HeaderOffset = 0
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	msg := buf.Bytes()
+	checksumOffset := int(unsafe.Offsetof(h.Checksum))
+	clearSlice(msg[checksumOffset : checksumOffset+len(h.Checksum)])
+
+	jsonData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, jsonData...), nil
+}
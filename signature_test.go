@@ -0,0 +1,96 @@
+package luks
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestSignHeader(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VerifyHeaderSignature(disk, pub); err == nil {
+		t.Fatal("unsigned header is expected to fail verification")
+	}
+
+	if err := SignHeader(disk, priv); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyHeaderSignature(disk, pub); err != nil || !ok {
+		t.Fatalf("signature verification failed: %v %v", ok, err)
+	}
+	if ok, err := VerifyHeaderSignature(disk, otherPub); err != nil || ok {
+		t.Fatalf("signature is expected to not match a different key: %v %v", ok, err)
+	}
+
+	// re-signing replaces the signature token
+	if err := SignHeader(disk, priv); err != nil {
+		t.Fatal(err)
+	}
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.meta.Tokens) != 1 {
+		t.Fatalf("expected a single signature token, got %v", d.meta.Tokens)
+	}
+
+	// unsigned modification of the header
+	if err := d.SetAllowDiscards(disk, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyHeaderSignature(disk, pub); err != nil || ok {
+		t.Fatalf("modified header is expected to fail verification: %v %v", ok, err)
+	}
+}
+
+func TestSignHeaderUnmodelledField(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	disk := fx.writeDisk(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignHeader(disk, priv); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a field the metadata structs do not model, it is dropped when the header is parsed
+	hdr, data, err := readLuks2Header(disk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := luks2JsonData(hdr, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := strings.Replace(string(jsonData), `"config":{`, `"config":{"unknown":"x",`, 1)
+	if modified == string(jsonData) {
+		t.Fatalf("no config object in %s", jsonData)
+	}
+	data, err = luks2HeaderBytes(hdr, []byte(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := VerifyHeaderSignature(disk, pub); err != nil || ok {
+		t.Fatalf("header with an unmodelled field is expected to fail verification: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,96 @@
+package luks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// TokenHandler retrieves passphrase material for keyslots bound to a LUKS2 token of a specific type.
+type TokenHandler interface {
+	// Type returns the token type the handler understands, e.g. "systemd-pkcs11"
+	Type() string
+	// Passphrase returns the passphrase for the token keyslots. tokenJSON is the raw token JSON object.
+	Passphrase(tokenJSON []byte) ([]byte, error)
+}
+
+// maximum number of LUKS2 tokens, see LUKS2_TOKENS_MAX in cryptsetup
+const maxTokens = 32
+
+// freeTokenIndex returns the lowest unused token index
+func (m *metadata) freeTokenIndex() (int, error) {
+	for i := 0; i < maxTokens; i++ {
+		if _, ok := m.Tokens[i]; !ok {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("all %v tokens are in use", maxTokens)
+}
+
+// tokenKeyslots returns the list of keyslots the token is bound to
+func tokenKeyslots(tok token) ([]int, error) {
+	type tokenInfo struct {
+		Type     string       `json:"type"`
+		Keyslots []jsonNumber `json:"keyslots"`
+	}
+
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+	var info tokenInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	var keyslots []int
+	for _, k := range info.Keyslots {
+		idx, err := k.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid token keyslot %v: %v", k, err)
+		}
+		keyslots = append(keyslots, int(idx))
+	}
+	return keyslots, nil
+}
+
+// unlockWithToken asks the handler for the passphrase of token `tokenIdx` and tries it with the token keyslots.
+// The options are applied the same way as by Unlock.
+func (d *Device) unlockWithToken(f *os.File, tokenIdx int, h TokenHandler, opts ...Option) (*VolumeInfo, error) {
+	o := buildOptions(opts)
+	if err := d.applyOptions(o); err != nil {
+		return nil, err
+	}
+
+	tok, ok := d.meta.Tokens[tokenIdx]
+	if !ok {
+		return nil, fmt.Errorf("token %v is not found", tokenIdx)
+	}
+	if tok["type"] != h.Type() {
+		return nil, fmt.Errorf("token %v has type %v, handler expects %v", tokenIdx, tok["type"], h.Type())
+	}
+
+	keyslots, err := tokenKeyslots(tok)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenJSON, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := h.Passphrase(tokenJSON)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(passphrase)
+	normalized, wipe := o.normalizePassphrase(passphrase)
+	defer wipe()
+
+	volume, _, err := unlockKeyslots(f, d, keyslots, normalized, o)
+	if err != nil {
+		return nil, err
+	}
+	o.warnVolume(volume)
+	return volume, nil
+}
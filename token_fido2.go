@@ -0,0 +1,80 @@
+package luks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Fido2AssertionOptions are the assertion requirements recorded in the token at enrollment time
+type Fido2AssertionOptions struct {
+	PinRequired              bool
+	UserPresenceRequired     bool
+	UserVerificationRequired bool
+}
+
+// Fido2Authenticator performs a FIDO2 assertion with the hmac-secret extension and returns the hmac-secret output.
+// It is implemented by callers on top of a FIDO2 library (e.g. libfido2 bindings).
+type Fido2Authenticator interface {
+	HmacSecret(rp string, credentialID []byte, salt []byte, opts Fido2AssertionOptions) ([]byte, error)
+}
+
+type fido2TokenHandler struct {
+	authenticator Fido2Authenticator
+}
+
+// NewFido2TokenHandler returns a handler for 'systemd-fido2' tokens as enrolled by systemd-cryptenroll.
+// The hmac-secret output is base64 encoded and used as the keyslot passphrase.
+func NewFido2TokenHandler(authenticator Fido2Authenticator) TokenHandler {
+	return &fido2TokenHandler{authenticator: authenticator}
+}
+
+func (h *fido2TokenHandler) Type() string {
+	return "systemd-fido2"
+}
+
+func (h *fido2TokenHandler) Passphrase(tokenJSON []byte) ([]byte, error) {
+	var tok struct {
+		Credential  string `json:"fido2-credential"`
+		Salt        string `json:"fido2-salt"`
+		Rp          string `json:"fido2-rp"`
+		PinRequired bool   `json:"fido2-clientPin-required"`
+		UpRequired  *bool  `json:"fido2-up-required"`
+		UvRequired  bool   `json:"fido2-uv-required"`
+	}
+	if err := json.Unmarshal(tokenJSON, &tok); err != nil {
+		return nil, err
+	}
+
+	credential, err := base64.StdEncoding.DecodeString(tok.Credential)
+	if err != nil {
+		return nil, fmt.Errorf("fido2 token 'fido2-credential' base64 parsing failed: %v", err)
+	}
+	if len(credential) == 0 {
+		return nil, fmt.Errorf("fido2 token does not have 'fido2-credential' field")
+	}
+	salt, err := base64.StdEncoding.DecodeString(tok.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("fido2 token 'fido2-salt' base64 parsing failed: %v", err)
+	}
+
+	rp := tok.Rp
+	if rp == "" {
+		rp = "io.systemd.cryptsetup" // default relying party used by systemd
+	}
+	opts := Fido2AssertionOptions{
+		PinRequired:              tok.PinRequired,
+		UserPresenceRequired:     tok.UpRequired == nil || *tok.UpRequired, // user presence is required unless stated otherwise
+		UserVerificationRequired: tok.UvRequired,
+	}
+
+	secret, err := h.authenticator.HmacSecret(rp, credential, salt, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(secret)
+
+	passphrase := make([]byte, base64.StdEncoding.EncodedLen(len(secret)))
+	base64.StdEncoding.Encode(passphrase, secret)
+	return passphrase, nil
+}
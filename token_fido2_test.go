@@ -0,0 +1,68 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+// mockFido2Authenticator computes hmac-secret deterministically from a device secret
+type mockFido2Authenticator struct {
+	credential []byte
+	deviceKey  []byte
+	opts       Fido2AssertionOptions
+}
+
+func (m *mockFido2Authenticator) HmacSecret(rp string, credentialID []byte, salt []byte, opts Fido2AssertionOptions) ([]byte, error) {
+	if rp != "io.systemd.cryptsetup" || !bytes.Equal(credentialID, m.credential) {
+		return nil, fmt.Errorf("unknown credential")
+	}
+	m.opts = opts
+	mac := hmac.New(sha256.New, m.deviceKey)
+	mac.Write(salt)
+	return mac.Sum(nil), nil
+}
+
+func TestFido2TokenUnlock(t *testing.T) {
+	authenticator := &mockFido2Authenticator{
+		credential: []byte("credential id"),
+		deviceKey:  []byte("device key"),
+	}
+	salt := []byte("fido2 salt")
+	secret, err := authenticator.HmacSecret("io.systemd.cryptsetup", authenticator.credential, salt, Fido2AssertionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, base64.StdEncoding.EncodeToString(secret), "aes-xts-plain64")
+	fx.meta.Tokens[0] = token{
+		"type":                     "systemd-fido2",
+		"keyslots":                 []interface{}{"0"},
+		"fido2-credential":         base64.StdEncoding.EncodeToString(authenticator.credential),
+		"fido2-salt":               base64.StdEncoding.EncodeToString(salt),
+		"fido2-rp":                 "io.systemd.cryptsetup",
+		"fido2-clientPin-required": true,
+	}
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockWithToken(disk, 0, NewFido2TokenHandler(authenticator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+	if !authenticator.opts.PinRequired || !authenticator.opts.UserPresenceRequired || authenticator.opts.UserVerificationRequired {
+		t.Fatalf("unexpected assertion options %+v", authenticator.opts)
+	}
+
+	// another authenticator produces a different secret
+	other := &mockFido2Authenticator{credential: authenticator.credential, deviceKey: []byte("other device")}
+	if _, err := d.unlockWithToken(disk, 0, NewFido2TokenHandler(other)); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package luks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Pkcs11Decrypter decrypts data using a private key stored on a PKCS#11 token.
+// It is implemented by callers on top of a PKCS#11 library binding, uri is the RFC 7512 URI
+// that identifies the module/slot/object to use.
+type Pkcs11Decrypter interface {
+	Decrypt(uri string, ciphertext []byte) ([]byte, error)
+}
+
+type pkcs11TokenHandler struct {
+	decrypter Pkcs11Decrypter
+}
+
+// NewPkcs11TokenHandler returns a handler for 'systemd-pkcs11' tokens as enrolled by systemd-cryptenroll.
+// The token stores a secret encrypted with the public key of the PKCS#11 object, the decrypted secret
+// is base64 encoded and used as the keyslot passphrase.
+func NewPkcs11TokenHandler(decrypter Pkcs11Decrypter) TokenHandler {
+	return &pkcs11TokenHandler{decrypter: decrypter}
+}
+
+func (h *pkcs11TokenHandler) Type() string {
+	return "systemd-pkcs11"
+}
+
+func (h *pkcs11TokenHandler) Passphrase(tokenJSON []byte) ([]byte, error) {
+	var tok struct {
+		URI string `json:"pkcs11-uri"`
+		Key string `json:"pkcs11-key"`
+	}
+	if err := json.Unmarshal(tokenJSON, &tok); err != nil {
+		return nil, err
+	}
+	if tok.URI == "" {
+		return nil, fmt.Errorf("pkcs11 token does not have 'pkcs11-uri' field")
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(tok.Key)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 token 'pkcs11-key' base64 parsing failed: %v", err)
+	}
+
+	secret, err := h.decrypter.Decrypt(tok.URI, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(secret)
+
+	passphrase := make([]byte, base64.StdEncoding.EncodedLen(len(secret)))
+	base64.StdEncoding.Encode(passphrase, secret)
+	return passphrase, nil
+}
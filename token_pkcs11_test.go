@@ -0,0 +1,93 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+type mockPkcs11Decrypter struct {
+	uri        string
+	ciphertext []byte
+	secret     []byte
+}
+
+func (m *mockPkcs11Decrypter) Decrypt(uri string, ciphertext []byte) ([]byte, error) {
+	if uri != m.uri || !bytes.Equal(ciphertext, m.ciphertext) {
+		return nil, fmt.Errorf("unexpected pkcs11 object")
+	}
+	return append([]byte(nil), m.secret...), nil
+}
+
+func TestPkcs11TokenUnlock(t *testing.T) {
+	decrypter := &mockPkcs11Decrypter{
+		uri:        "pkcs11:token=test;object=luks",
+		ciphertext: []byte("encrypted secret"),
+		secret:     []byte("known secret"),
+	}
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, base64.StdEncoding.EncodeToString(decrypter.secret), "aes-xts-plain64")
+	fx.meta.Tokens[0] = token{
+		"type":       "systemd-pkcs11",
+		"keyslots":   []interface{}{"1"},
+		"pkcs11-uri": decrypter.uri,
+		"pkcs11-key": base64.StdEncoding.EncodeToString(decrypter.ciphertext),
+	}
+	disk, d := fx.open(t)
+
+	volume, err := d.unlockWithToken(disk, 0, NewPkcs11TokenHandler(decrypter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+
+	decrypter.secret = []byte("wrong secret")
+	if _, err := d.unlockWithToken(disk, 0, NewPkcs11TokenHandler(decrypter)); err != ErrPassphraseDoesNotMatch {
+		t.Fatalf("expected ErrPassphraseDoesNotMatch, got %v", err)
+	}
+}
+
+func TestTokenUnlockSkipsUnusableKeyslots(t *testing.T) {
+	decrypter := &mockPkcs11Decrypter{
+		uri:        "pkcs11:token=test;object=luks",
+		ciphertext: []byte("encrypted secret"),
+		secret:     []byte("known secret"),
+	}
+	passphrase := base64.StdEncoding.EncodeToString(decrypter.secret)
+
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, passphrase, "aes-xts-plain64")
+	fx.addKeyslot(t, 1, passphrase, "aes-xts-plain64")
+	fx.addKeyslot(t, 2, passphrase, "aes-xts-plain64")
+	erased := fx.meta.Keyslots[0]
+	erased.Type = erasedKeyslotType
+	fx.meta.Keyslots[0] = erased
+	// keyslot 1 area points to the data segment
+	corrupted := fx.meta.Keyslots[1]
+	corrupted.Area.Offset = jsonNumber(strconv.Itoa(fixtureDataOffset))
+	fx.meta.Keyslots[1] = corrupted
+	fx.meta.Tokens[0] = token{
+		"type":       "systemd-pkcs11",
+		"keyslots":   []interface{}{"0", "1", "2"},
+		"pkcs11-uri": decrypter.uri,
+		"pkcs11-key": base64.StdEncoding.EncodeToString(decrypter.ciphertext),
+	}
+	disk, d := fx.open(t)
+
+	if _, err := d.unlockWithToken(disk, 0, NewPkcs11TokenHandler(decrypter)); err == nil || err == ErrPassphraseDoesNotMatch {
+		t.Fatalf("corrupted keyslot is expected to abort the unlock by default, got %v", err)
+	}
+	volume, err := d.unlockWithToken(disk, 0, NewPkcs11TokenHandler(decrypter), WithContinueOnKeyslotError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(volume.key, fx.volumeKey) {
+		t.Fatal("unlocked volume key does not match")
+	}
+}
@@ -0,0 +1,93 @@
+package luks
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// type of the LUKS2 token that tags a keyslot with its purpose, e.g. "recovery" or "automatic"
+const purposeTokenType = "luks2-purpose"
+
+// GetKeyslotByPurpose returns the first keyslot tagged with the purpose by SetKeyslotPurpose.
+// Tokens are searched in the order of their indexes.
+func (d *Device) GetKeyslotByPurpose(purpose string) (int, error) {
+	indexes := make([]int, 0, len(d.meta.Tokens))
+	for idx := range d.meta.Tokens {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	for _, idx := range indexes {
+		tok := d.meta.Tokens[idx]
+		if tok["type"] != purposeTokenType || tok["purpose"] != purpose {
+			continue
+		}
+		keyslots, err := tokenKeyslots(tok)
+		if err != nil {
+			return 0, fmt.Errorf("token %v: %v", idx, err)
+		}
+		if len(keyslots) > 0 {
+			return keyslots[0], nil
+		}
+	}
+	return 0, fmt.Errorf("no keyslot with purpose %q is found", purpose)
+}
+
+// SetKeyslotPurpose tags the keyslot with the purpose and writes the updated header. The purpose token of
+// the keyslot is updated if it exists, an empty purpose removes the token.
+func (d *Device) SetKeyslotPurpose(f *os.File, keyslotIdx int, purpose string) error {
+	if err := d.CheckRequirements(); err != nil {
+		return err
+	}
+	if _, ok := d.meta.Keyslots[keyslotIdx]; !ok {
+		return fmt.Errorf("keyslot %d is not found", keyslotIdx)
+	}
+
+	tokenIdx := -1
+	for idx, tok := range d.meta.Tokens {
+		if tok["type"] != purposeTokenType {
+			continue
+		}
+		keyslots, err := tokenKeyslots(tok)
+		if err != nil {
+			return fmt.Errorf("token %v: %v", idx, err)
+		}
+		if len(keyslots) == 1 && keyslots[0] == keyslotIdx {
+			tokenIdx = idx
+			break
+		}
+	}
+
+	oldToken, exists := d.meta.Tokens[tokenIdx]
+	if purpose == "" {
+		if !exists {
+			return nil
+		}
+		delete(d.meta.Tokens, tokenIdx)
+	} else {
+		if !exists {
+			var err error
+			tokenIdx, err = d.meta.freeTokenIndex()
+			if err != nil {
+				return err
+			}
+		}
+		d.meta.Tokens[tokenIdx] = token{
+			"type":     purposeTokenType,
+			"keyslots": []interface{}{strconv.Itoa(keyslotIdx)},
+			"purpose":  purpose,
+		}
+	}
+
+	if err := d.UpdateHeader(f); err != nil {
+		if exists {
+			d.meta.Tokens[tokenIdx] = oldToken
+		} else {
+			delete(d.meta.Tokens, tokenIdx)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeyslotPurpose(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.addKeyslot(t, 1, "recovery", "aes-xts-plain64")
+	disk, d := fx.open(t)
+
+	if _, err := d.GetKeyslotByPurpose("recovery"); err == nil {
+		t.Fatal("untagged keyslots are expected to not match")
+	}
+	if err := d.SetKeyslotPurpose(disk, 5, "recovery"); err == nil {
+		t.Fatal("tagging a missing keyslot is expected to fail")
+	}
+
+	if err := d.SetKeyslotPurpose(disk, 0, "automatic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetKeyslotPurpose(disk, 1, "automatic"); err != nil {
+		t.Fatal(err)
+	}
+	// update of the existing token
+	if err := d.SetKeyslotPurpose(disk, 1, "recovery"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the purpose is stored in the on-disk header
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.meta.Tokens) != 2 {
+		t.Fatalf("expected 2 purpose tokens, got %v", d.meta.Tokens)
+	}
+	for purpose, expected := range map[string]int{"automatic": 0, "recovery": 1} {
+		idx, err := d.GetKeyslotByPurpose(purpose)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx != expected {
+			t.Fatalf("expected keyslot %v for purpose %v, got %v", expected, purpose, idx)
+		}
+	}
+
+	if err := d.SetKeyslotPurpose(disk, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetKeyslotByPurpose("automatic"); err == nil {
+		t.Fatal("removed purpose is expected to not match")
+	}
+}
+
+func TestTokensMissingFromMetadata(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	fx.addKeyslot(t, 0, "foobar", "aes-xts-plain64")
+	fx.meta.Tokens = nil
+	disk := fx.writeDisk(t)
+
+	// rewrite both headers without the tokens object
+	jsonData, err := json.Marshal(&fx.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := bytes.Replace(jsonData, []byte(`"tokens":null,`), nil, 1)
+	if bytes.Equal(stripped, jsonData) {
+		t.Fatalf("no tokens object in %s", jsonData)
+	}
+	for _, offset := range []uint64{0, fx.hdr.HeaderSize} {
+		hdr := fx.hdr
+		hdr.HeaderOffset = offset
+		data, err := luks2HeaderBytes(&hdr, stripped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := disk.WriteAt(data, int64(offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetKeyslotPurpose(disk, 0, "recovery"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpireKeyslot(disk, 0, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	d, err = luks2OpenDevice(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.meta.Tokens) != 2 {
+		t.Fatalf("expected purpose and expiry tokens, got %v", d.meta.Tokens)
+	}
+}
@@ -0,0 +1,42 @@
+package luks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// magics of LUKS2 secondary header copy, cryptsetup uses 'SKUL' while some tools write the primary magic
+var luks2SecondaryMagics = [][]byte{[]byte("SKUL\xba\xbe"), []byte("LUKS\xba\xbe")}
+
+// WipeSignature zeroes the LUKS binary header at the device start and any LUKS2 secondary header copy, so
+// the device is no longer detected as LUKS e.g. by IsLUKS or blkid. Keyslot areas are not touched, use it
+// before formatting a device. As the operation destroys access to the data `confirm` must be true.
+func WipeSignature(f *os.File, confirm bool) error {
+	if !confirm {
+		return fmt.Errorf("wiping LUKS signature of %v is not confirmed", f.Name())
+	}
+
+	zeroes := make([]byte, luks2BinaryHeaderSize)
+	if _, err := f.WriteAt(zeroes, 0); err != nil {
+		return err
+	}
+
+	magic := make([]byte, len(luks2SecondaryMagics[0]))
+	for _, offset := range luks2SecondaryHeaderOffsets {
+		if _, err := f.ReadAt(magic, offset); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if !bytes.Equal(magic, luks2SecondaryMagics[0]) && !bytes.Equal(magic, luks2SecondaryMagics[1]) {
+			continue
+		}
+		if _, err := f.WriteAt(zeroes, offset); err != nil {
+			return err
+		}
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,27 @@
+package luks
+
+import (
+	"testing"
+)
+
+func TestWipeSignature(t *testing.T) {
+	fx := newLuks2Fixture(t, 64)
+	disk := fx.writeDisk(t)
+
+	if err := WipeSignature(disk, false); err == nil {
+		t.Fatal("wipe without confirmation is expected to fail")
+	}
+	if _, ok := IsLUKS(disk); !ok {
+		t.Fatal("unconfirmed wipe modified the device")
+	}
+
+	if err := WipeSignature(disk, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := IsLUKS(disk); ok {
+		t.Fatal("device is still detected as LUKS after the wipe")
+	}
+	if _, _, err := readLuks2Header(disk, int64(fx.hdr.HeaderSize)); err == nil {
+		t.Fatal("secondary header is expected to be wiped")
+	}
+}